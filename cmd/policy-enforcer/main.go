@@ -1,21 +1,102 @@
 package main
 
 import (
+	"expvar"
 	"log"
 	"net/http"
+	"os"
 
+	"github.com/cainelli/opa-firewall/pkg/extauthz"
 	"github.com/cainelli/opa-firewall/pkg/firewall"
+	"github.com/cainelli/opa-firewall/pkg/proxy"
 	"github.com/sirupsen/logrus"
 )
 
+// The management endpoints are served on MANAGEMENT_ADDRESS in every mode, see serveManagement.
+const (
+	// modeHTTP serves the firewall debug handler. The ip trees and policies are still served
+	// on :8080 as well.
+	modeHTTP = "http"
+	// modeExtAuthz serves the envoy ext_authz gRPC service plus its HTTP counterpart. The
+	// management endpoints are not served on :8080 so they aren't authorized as requests.
+	modeExtAuthz = "ext-authz"
+	// modeProxy serves a reverse proxy to PROXY_UPSTREAM. The management endpoints are not
+	// served on :8080 so they don't shadow upstream paths.
+	modeProxy = "proxy"
+)
+
+// serveManagement serves the management endpoints on MANAGEMENT_ADDRESS, :8081 by default.
+func serveManagement(management http.Handler, logger *logrus.Logger) {
+	managementAddress := os.Getenv("MANAGEMENT_ADDRESS")
+	if managementAddress == "" {
+		managementAddress = ":8081"
+	}
+	go func() {
+		logger.Infof("management listening on %s", managementAddress)
+		logger.Fatal(http.ListenAndServe(managementAddress, management))
+	}()
+}
+
 func main() {
 	logger := logrus.New()
 
-	handler := firewall.New(logger)
-	http.HandleFunc("/", handler.OnRequest)
-	http.HandleFunc("/iptrees", handler.DumpIPTrees)
-	http.HandleFunc("/policies", handler.DumpPolicies)
+	configuration, err := firewall.NewConfiguration()
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	handler := firewall.New(logger, configuration)
+
+	management := http.NewServeMux()
+	management.HandleFunc("/iptrees", handler.DumpIPTrees)
+	management.HandleFunc("/policies", handler.DumpPolicies)
+	management.HandleFunc("/policies/", handler.DumpPolicy)
+	management.Handle("/debug/vars", expvar.Handler())
+
+	// importing expvar registers /debug/vars on the default mux, it must not be served on :8080.
+	mux := http.NewServeMux()
+
+	mode := os.Getenv("ENFORCER_MODE")
+	switch mode {
+	case modeHTTP, "":
+		mux.HandleFunc("/", handler.OnRequest)
+		mux.Handle("/iptrees", management)
+		mux.Handle("/policies", management)
+		mux.Handle("/policies/", management)
+	case modeExtAuthz:
+		extAuthzConfiguration, err := extauthz.NewConfiguration()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		server := extauthz.New(handler, extAuthzConfiguration, logger)
+		go func() {
+			logger.Infof("ext_authz grpc server listening on %s", extAuthzConfiguration.GRPCAddress)
+			logger.Fatal(server.ListenAndServe())
+		}()
+		mux.Handle("/", server)
+	case modeProxy:
+		proxyConfiguration, err := proxy.NewConfiguration()
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		reverseProxy, err := proxy.New(handler, proxyConfiguration, logger)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		mux.Handle("/", reverseProxy)
+	default:
+		logger.Fatalf("unknown ENFORCER_MODE %s", mode)
+	}
+	serveManagement(management, logger)
+
+	// terminating TLS here exposes the sni, alpn and cipher suite to the policies.
+	if certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"); certFile != "" && keyFile != "" {
+		log.Print("server ready (tls)")
+		logger.Fatal(http.ListenAndServeTLS(":8080", certFile, keyFile, mux))
+	}
 
 	log.Print("server ready")
-	http.ListenAndServe(":8080", nil)
+	http.ListenAndServe(":8080", mux)
 }
@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"time"
 
 	"github.com/cainelli/opa-firewall/pkg/policies"
 	nouseragent "github.com/cainelli/opa-firewall/pkg/policies/no-user-agent"
@@ -18,11 +17,13 @@ func main() {
 		nouseragent.New(logger),
 	}, logger)
 
-	for {
-		select {
-		case <-time.After(5 * time.Second):
+	configuration, err := policies.NewConsumerConfiguration()
+	if err != nil {
+		logger.Fatal(err)
+	}
 
-			policyController.Run()
-		}
+	logger.Infof("consuming %s with %d workers", configuration.Topic, configuration.Workers)
+	if err := policyController.Consume(configuration); err != nil {
+		logger.Fatal(err)
 	}
 }
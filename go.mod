@@ -5,6 +5,7 @@ go 1.13
 require (
 	github.com/Pallinder/go-randomdata v1.2.0
 	github.com/confluentinc/confluent-kafka-go v1.1.0
+	github.com/envoyproxy/go-control-plane v0.9.4
 	github.com/ghodss/yaml v1.0.0
 	github.com/gophercloud/gophercloud v0.8.0 // indirect
 	github.com/hashicorp/go-immutable-radix v1.1.0
@@ -14,4 +15,6 @@ require (
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	github.com/sirupsen/logrus v1.4.1
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
+	google.golang.org/grpc v1.27.1
 )
@@ -0,0 +1,269 @@
+package extauthz
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// New initializes the ext_authz server
+func New(fw *firewall.Firewall, configuration *Configuration, logger *logrus.Logger) *Server {
+	return &Server{
+		Configuration: configuration,
+		Firewall:      fw,
+		Logger:        logger,
+	}
+}
+
+// NewConfiguration reads the ext_authz configuration from the environment.
+func NewConfiguration() (*Configuration, error) {
+	configuration := &Configuration{
+		GRPCAddress:   ":9191",
+		DeniedStatus:  http.StatusTooManyRequests,
+		DeniedBody:    os.Getenv("EXT_AUTHZ_DENIED_BODY"),
+		DeniedHeaders: make(map[string]string),
+	}
+
+	if address := os.Getenv("EXT_AUTHZ_GRPC_ADDRESS"); address != "" {
+		configuration.GRPCAddress = address
+	}
+
+	if deniedStatus := os.Getenv("EXT_AUTHZ_DENIED_STATUS"); deniedStatus != "" {
+		code, err := strconv.Atoi(deniedStatus)
+		if err != nil {
+			return nil, err
+		}
+		if code < 400 || code > 599 {
+			return nil, fmt.Errorf("EXT_AUTHZ_DENIED_STATUS must be a 4xx or 5xx status, got %d", code)
+		}
+		configuration.DeniedStatus = code
+	}
+
+	if deniedHeaders := os.Getenv("EXT_AUTHZ_DENIED_HEADERS"); deniedHeaders != "" {
+		for _, pair := range strings.Split(deniedHeaders, ",") {
+			keyValue := strings.SplitN(pair, "=", 2)
+			if len(keyValue) != 2 {
+				return nil, fmt.Errorf("invalid EXT_AUTHZ_DENIED_HEADERS entry %q, expected key=value", pair)
+			}
+			configuration.DeniedHeaders[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+		}
+	}
+
+	return configuration, nil
+}
+
+// ListenAndServe serves the gRPC Authorization service on the configured address.
+func (server *Server) ListenAndServe() error {
+	listener, err := net.Listen("tcp", server.Configuration.GRPCAddress)
+	if err != nil {
+		return err
+	}
+
+	grpcServer := grpc.NewServer()
+	auth.RegisterAuthorizationServer(grpcServer, server)
+
+	return grpcServer.Serve(listener)
+}
+
+// Check implements the envoy Authorization service. Allowed requests carry the headers added
+// by the decision upstream, the v2 api can't remove request headers.
+func (server *Server) Check(ctx context.Context, request *auth.CheckRequest) (*auth.CheckResponse, error) {
+	input := server.CheckRequestInput(request)
+	decision := server.Firewall.Decide(input)
+
+	headers := http.Header{}
+	if server.Firewall.Configuration.DecisionHeaders {
+		decision.SetHeaders(headers)
+	}
+
+	if !decision.Blocks() {
+		if decision.RequestHeaders != nil {
+			for key, value := range decision.RequestHeaders.Add {
+				headers.Set(key, value)
+			}
+		}
+		return &auth.CheckResponse{
+			Status: &status.Status{Code: int32(codes.OK)},
+			HttpResponse: &auth.CheckResponse_OkResponse{
+				OkResponse: &auth.OkHttpResponse{Headers: headerValueOptions(headers)},
+			},
+		}, nil
+	}
+
+	response := server.blockResponse(input, decision)
+	for key, values := range response.Header {
+		headers[key] = values
+	}
+
+	return &auth.CheckResponse{
+		Status: &status.Status{Code: int32(codes.PermissionDenied)},
+		HttpResponse: &auth.CheckResponse_DeniedResponse{
+			DeniedResponse: &auth.DeniedHttpResponse{
+				Status:  &envoytype.HttpStatus{Code: envoytype.StatusCode(response.Status)},
+				Headers: headerValueOptions(headers),
+				Body:    string(response.Body),
+			},
+		},
+	}, nil
+}
+
+// ServeHTTP implements the ext_authz HTTP service. Envoy forwards the original request and
+// lets it through on 200, any other response is returned to the client. Headers added by
+// the decision are in the 200 response, envoy must list them in allowed_upstream_headers.
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	input := server.Firewall.RequestInput(downstreamRequest(request))
+	decision := server.Firewall.Decide(input)
+
+	if server.Firewall.Configuration.DecisionHeaders {
+		decision.SetHeaders(writer.Header())
+	}
+
+	if decision.Blocks() {
+		server.blockResponse(input, decision).Write(writer, request)
+		return
+	}
+
+	if decision.RequestHeaders != nil {
+		for key, value := range decision.RequestHeaders.Add {
+			writer.Header().Set(key, value)
+		}
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// downstreamRequest returns the request as received by envoy. The check request is sent by
+// envoy itself so its address is not the one of the client: the peer connected to envoy is the
+// last hop envoy appended to x-forwarded-for, which is trusted as is. The connection manager
+// must set use_remote_address and the filter list x-forwarded-for in its allowed_headers,
+// otherwise envoy is the client of every request.
+func downstreamRequest(request *http.Request) *http.Request {
+	forwardedFor := strings.Split(strings.Join(request.Header["X-Forwarded-For"], ","), ",")
+	peer := strings.TrimSpace(forwardedFor[len(forwardedFor)-1])
+	if net.ParseIP(peer) == nil {
+		return request
+	}
+
+	downstream := request.Clone(request.Context())
+	downstream.RemoteAddr = peer
+	if hops := forwardedFor[:len(forwardedFor)-1]; len(hops) > 0 {
+		downstream.Header.Set("X-Forwarded-For", strings.Join(hops, ","))
+	} else {
+		downstream.Header.Del("X-Forwarded-For")
+	}
+	return downstream
+}
+
+// blockResponse is the response envoy returns for the blocked request. Tarpits are denied right
+// away: envoy fails the check once its ext_authz timeout, 200ms by default, passes, so waiting
+// here would only hold the request of the client until it is answered by the failure mode.
+func (server *Server) blockResponse(input map[string]interface{}, decision firewall.Decision) firewall.Response {
+	response := server.Firewall.BlockResponse(input, decision, server.deniedResponse())
+	response.Delay = 0
+	return response
+}
+
+// deniedResponse is the configured denied response, used unless the decision action overrides it.
+func (server *Server) deniedResponse() firewall.Response {
+	response := firewall.Response{
+		Status: server.Configuration.DeniedStatus,
+		Header: make(http.Header),
+		Body:   []byte(server.Configuration.DeniedBody),
+	}
+	for key, value := range server.Configuration.DeniedHeaders {
+		response.Header.Set(key, value)
+	}
+	return response
+}
+
+// CheckRequestInput builds the OPA input document from the request attributes with the
+// firewall input builder. The source address is the peer connected to envoy.
+func (server *Server) CheckRequestInput(request *auth.CheckRequest) map[string]interface{} {
+	httpRequest := request.GetAttributes().GetRequest().GetHttp()
+
+	// envoy joins repeated headers with a comma into a single value.
+	normalizedHeaders := make(map[string][]string)
+	for header, value := range httpRequest.GetHeaders() {
+		normalizedHeaders[strings.ToLower(header)] = []string{value}
+	}
+
+	host := httpRequest.GetHost()
+	if host == "" {
+		// http/2 requests carry the host as the :authority pseudo header.
+		if authority, ok := normalizedHeaders[":authority"]; ok {
+			host = authority[0]
+		}
+	}
+
+	pathAndQuery := strings.SplitN(httpRequest.GetPath(), "?", 2)
+	rawQuery := httpRequest.GetQuery()
+	if rawQuery == "" && len(pathAndQuery) == 2 {
+		rawQuery = pathAndQuery[1]
+	}
+
+	// envoy reports the body size seen so far, unknown unless it was buffered.
+	contentLength := httpRequest.GetSize()
+	if contentLength <= 0 {
+		contentLength = -1
+		if value, ok := normalizedHeaders["content-length"]; ok {
+			if parsed, err := strconv.ParseInt(value[0], 10, 64); err == nil {
+				contentLength = parsed
+			}
+		}
+	}
+
+	requestTime := time.Now()
+	if timestamp := request.GetAttributes().GetRequest().GetTime(); timestamp != nil {
+		requestTime = time.Unix(timestamp.GetSeconds(), int64(timestamp.GetNanos()))
+	}
+
+	inputRequest := firewall.InputRequest{
+		Host:          host,
+		Method:        httpRequest.GetMethod(),
+		Path:          pathAndQuery[0],
+		RawQuery:      rawQuery,
+		Scheme:        httpRequest.GetScheme(),
+		Protocol:      httpRequest.GetProtocol(),
+		Headers:       normalizedHeaders,
+		RemoteAddr:    request.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress(),
+		ContentLength: contentLength,
+		Time:          requestTime,
+	}
+
+	// the body is only sent by envoy when with_request_body is configured on the filter.
+	if server.Firewall.Configuration.InspectsBody(host, inputRequest.Path) {
+		body := []byte(httpRequest.GetBody())
+		inputRequest.Inspected = true
+		inputRequest.BodyTruncated = normalizedHeaders["x-envoy-auth-partial-body"] != nil && normalizedHeaders["x-envoy-auth-partial-body"][0] == "true"
+		if int64(len(body)) > server.Firewall.Configuration.BodyMaxSize {
+			body = body[:server.Firewall.Configuration.BodyMaxSize]
+			inputRequest.BodyTruncated = true
+		}
+		inputRequest.Body = body
+	}
+
+	return server.Firewall.BuildInput(inputRequest)
+}
+
+func headerValueOptions(headers http.Header) []*core.HeaderValueOption {
+	options := make([]*core.HeaderValueOption, 0, len(headers))
+	for key := range headers {
+		options = append(options, &core.HeaderValueOption{
+			Header: &core.HeaderValue{Key: key, Value: headers.Get(key)},
+		})
+	}
+	return options
+}
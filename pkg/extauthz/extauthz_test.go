@@ -0,0 +1,310 @@
+package extauthz
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	auth "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// testPolicy denies 203.0.113.7 and answers a few paths with the other actions.
+const testPolicy = `package enforcer
+
+deny {
+  input.ip == "203.0.113.7"
+}
+
+deny {
+  input.path != "/"
+}
+
+action = {"type": "tarpit", "delay_ms": 5000} {
+  input.path == "/slow"
+}
+
+action = {"type": "redirect", "location": "https://www.example.com/blocked"} {
+  input.path == "/moved"
+}
+
+action = {"type": "headers", "add": {"x-suspicious": "1"}} {
+  input.path == "/tagged"
+}
+`
+
+func newTestServer(trustedProxies ...string) *Server {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	configuration := &firewall.Configuration{
+		IsEnabled:          true,
+		DecisionHeaders:    true,
+		CombiningAlgorithm: firewall.CombiningAllowOverrides,
+	}
+	for _, proxy := range trustedProxies {
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			panic(err)
+		}
+		configuration.TrustedProxies = append(configuration.TrustedProxies, network)
+	}
+
+	fw := firewall.NewStatic(logger, configuration, firewall.PolicyEvent{Name: "enforcer", Type: firewall.EventTypeFull, Rego: testPolicy})
+	return New(fw, &Configuration{
+		DeniedStatus:  http.StatusForbidden,
+		DeniedBody:    "denied",
+		DeniedHeaders: map[string]string{"X-Denied": "1"},
+	}, logger)
+}
+
+func checkRequest(ip, path string, headers map[string]string) *auth.CheckRequest {
+	return &auth.CheckRequest{
+		Attributes: &auth.AttributeContext{
+			Source: &auth.AttributeContext_Peer{
+				Address: &core.Address{Address: &core.Address_SocketAddress{SocketAddress: &core.SocketAddress{
+					Address:       ip,
+					PortSpecifier: &core.SocketAddress_PortValue{PortValue: 41234},
+				}}},
+			},
+			Request: &auth.AttributeContext_Request{
+				Http: &auth.AttributeContext_HttpRequest{
+					Method:   http.MethodGet,
+					Host:     "www.example.com",
+					Path:     path,
+					Scheme:   "https",
+					Protocol: "HTTP/1.1",
+					Headers:  headers,
+				},
+			},
+		},
+	}
+}
+
+func responseHeaders(options []*core.HeaderValueOption) http.Header {
+	headers := http.Header{}
+	for _, option := range options {
+		headers.Set(option.GetHeader().GetKey(), option.GetHeader().GetValue())
+	}
+	return headers
+}
+
+func TestCheck(t *testing.T) {
+	server := newTestServer()
+
+	tests := []struct {
+		name        string
+		ip          string
+		path        string
+		wantCode    codes.Code
+		wantStatus  int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "allowed",
+			ip:          "198.51.100.1",
+			path:        "/",
+			wantCode:    codes.OK,
+			wantHeaders: map[string]string{firewall.HeaderDecision: firewall.DecisionAllow},
+		},
+		{
+			name:        "denied",
+			ip:          "203.0.113.7",
+			path:        "/",
+			wantCode:    codes.PermissionDenied,
+			wantStatus:  http.StatusForbidden,
+			wantBody:    "denied",
+			wantHeaders: map[string]string{"X-Denied": "1", firewall.HeaderDecision: firewall.DecisionDeny, firewall.HeaderDeniedBy: "enforcer"},
+		},
+		{
+			name:        "redirect",
+			ip:          "198.51.100.1",
+			path:        "/moved",
+			wantCode:    codes.PermissionDenied,
+			wantStatus:  http.StatusFound,
+			wantHeaders: map[string]string{"Location": "https://www.example.com/blocked"},
+		},
+		{
+			name:        "tarpit",
+			ip:          "198.51.100.1",
+			path:        "/slow",
+			wantCode:    codes.PermissionDenied,
+			wantStatus:  http.StatusForbidden,
+			wantBody:    "denied",
+			wantHeaders: map[string]string{"X-Denied": "1"},
+		},
+		{
+			name:        "headers action",
+			ip:          "198.51.100.1",
+			path:        "/tagged",
+			wantCode:    codes.OK,
+			wantHeaders: map[string]string{"X-Suspicious": "1", firewall.HeaderDecision: firewall.DecisionDeny},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			response, err := server.Check(context.Background(), checkRequest(test.ip, test.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// envoy fails the check once its timeout passes, tarpits must not hold it.
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("Check() took %s", elapsed)
+			}
+
+			if code := codes.Code(response.GetStatus().GetCode()); code != test.wantCode {
+				t.Fatalf("code = %s, want %s", code, test.wantCode)
+			}
+
+			var headers http.Header
+			if test.wantCode == codes.OK {
+				headers = responseHeaders(response.GetOkResponse().GetHeaders())
+			} else {
+				denied := response.GetDeniedResponse()
+				if status := int(denied.GetStatus().GetCode()); status != test.wantStatus {
+					t.Errorf("status = %d, want %d", status, test.wantStatus)
+				}
+				if denied.GetBody() != test.wantBody {
+					t.Errorf("body = %q, want %q", denied.GetBody(), test.wantBody)
+				}
+				headers = responseHeaders(denied.GetHeaders())
+			}
+
+			for key, value := range test.wantHeaders {
+				if headers.Get(key) != value {
+					t.Errorf("header %s = %q, want %q", key, headers.Get(key), value)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRequestInput(t *testing.T) {
+	server := newTestServer("10.0.0.0/8")
+
+	request := checkRequest("10.0.0.2", "/search?q=firewall", map[string]string{
+		":authority":      "www.example.com",
+		"User-Agent":      "curl/7.64.1",
+		"x-forwarded-for": "203.0.113.7, 10.0.0.1",
+	})
+	request.Attributes.Request.Http.Host = ""
+
+	input := server.CheckRequestInput(request)
+
+	want := map[string]interface{}{
+		"host":      "www.example.com",
+		"path":      "/search",
+		"raw_query": "q=firewall",
+		"scheme":    "https",
+		"ip":        "203.0.113.7",
+	}
+	for key, value := range want {
+		if input[key] != value {
+			t.Errorf("input[%s] = %v, want %v", key, input[key], value)
+		}
+	}
+
+	headers, _ := input["headers"].(map[string][]string)
+	if userAgent := headers["user-agent"]; len(userAgent) != 1 || userAgent[0] != "curl/7.64.1" {
+		t.Errorf("user-agent = %v, want the lower cased header", userAgent)
+	}
+	if contentLength := input["content_length"]; contentLength != int64(-1) {
+		t.Errorf("content_length = %v, want -1 when unknown", contentLength)
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		forwardedFor   string
+		path           string
+		wantStatus     int
+		wantHeaders    map[string]string
+	}{
+		{
+			name:         "client appended by envoy",
+			forwardedFor: "203.0.113.7",
+			path:         "/",
+			wantStatus:   http.StatusForbidden,
+		},
+		{
+			name:         "spoofed hops are ignored",
+			forwardedFor: "198.51.100.1, 203.0.113.7",
+			path:         "/",
+			wantStatus:   http.StatusForbidden,
+		},
+		{
+			name:         "untrusted peer of envoy",
+			forwardedFor: "203.0.113.7, 198.51.100.1",
+			path:         "/",
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:           "trusted proxy in front of envoy",
+			trustedProxies: []string{"198.51.100.0/24"},
+			forwardedFor:   "203.0.113.7, 198.51.100.1",
+			path:           "/",
+			wantStatus:     http.StatusForbidden,
+		},
+		{
+			name:       "without x-forwarded-for envoy is the client",
+			path:       "/",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:         "tarpit",
+			forwardedFor: "198.51.100.1",
+			path:         "/slow",
+			wantStatus:   http.StatusForbidden,
+		},
+		{
+			name:         "headers action",
+			forwardedFor: "198.51.100.1",
+			path:         "/tagged",
+			wantStatus:   http.StatusOK,
+			wantHeaders:  map[string]string{"X-Suspicious": "1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newTestServer(test.trustedProxies...)
+
+			request := httptest.NewRequest(http.MethodGet, "http://www.example.com"+test.path, nil)
+			request.RemoteAddr = "10.0.0.2:41234"
+			if test.forwardedFor != "" {
+				request.Header.Set("X-Forwarded-For", test.forwardedFor)
+			}
+
+			start := time.Now()
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, request)
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("ServeHTTP() took %s", elapsed)
+			}
+
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			for key, value := range test.wantHeaders {
+				if recorder.Header().Get(key) != value {
+					t.Errorf("header %s = %q, want %q", key, recorder.Header().Get(key), value)
+				}
+			}
+			if request.Header.Get("X-Forwarded-For") != test.forwardedFor {
+				t.Errorf("x-forwarded-for of the check request changed to %q", request.Header.Get("X-Forwarded-For"))
+			}
+		})
+	}
+}
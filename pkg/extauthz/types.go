@@ -0,0 +1,27 @@
+package extauthz
+
+import (
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	"github.com/sirupsen/logrus"
+)
+
+// Server implements the envoy ext_authz v2 Authorization gRPC service and the ext_authz
+// HTTP service on top of the firewall.
+type Server struct {
+	Configuration *Configuration
+	Firewall      *firewall.Firewall
+	Logger        *logrus.Logger
+}
+
+// Configuration defines how denied requests are answered.
+type Configuration struct {
+	// GRPCAddress is where the gRPC Authorization service listens.
+	GRPCAddress string
+	// DeniedStatus is the http status returned to the client for denied requests.
+	DeniedStatus int
+	// DeniedBody is the body returned to the client for denied requests.
+	DeniedBody string
+	// DeniedHeaders are added to the response of denied requests. From the environment
+	// they are read as comma separated key=value pairs.
+	DeniedHeaders map[string]string
+}
@@ -0,0 +1,212 @@
+package firewall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// ActionBlock answers with Status (defaults to the enforcer block status), Body and Headers.
+	ActionBlock = "block"
+	// ActionRedirect answers with a redirect to Location, Status defaults to 302.
+	ActionRedirect = "redirect"
+	// ActionTarpit waits DelayMs before blocking, slowing down the client. The ext_authz
+	// enforcer blocks right away, envoy doesn't wait longer than its ext_authz timeout.
+	ActionTarpit = "tarpit"
+	// ActionChallenge answers with a challenge the client must solve, see Challenger.
+	ActionChallenge = "challenge"
+	// ActionHeaders lets the request through adding (Add) and removing (Remove) request headers.
+	ActionHeaders = "headers"
+	// ActionLog lets the request through, the deny is only logged.
+	ActionLog = "log"
+)
+
+// maxTarpitDelay bounds the delay of the tarpit action to keep connections from piling up.
+const maxTarpitDelay = 30 * time.Second
+
+// Action is the response a policy asks the enforcer to execute when it matches. It's the value
+// of the action rule of the policy package. Ex.:
+//
+//	action = {"type": "redirect", "location": "https://www.example.com/blocked"} {
+//	  deny
+//	}
+type Action struct {
+	Type        string `json:"type"`
+	Status      int    `json:"status,omitempty"`
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Location    string `json:"location,omitempty"`
+	DelayMs     int    `json:"delay_ms,omitempty"`
+	// Headers are added to the response of blocking actions.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Add and Remove change the headers of the request forwarded upstream.
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// HeaderChanges are the request header changes collected from the matching headers actions.
+type HeaderChanges struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// Response is what an enforcer writes for a blocked request.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+	// Delay must pass before the response is written.
+	Delay time.Duration
+}
+
+// Challenger serves the challenge action and verifies the clients which solved it, the
+// policies check it with the challenge_passed(input) builtin.
+type Challenger interface {
+	Challenge(input map[string]interface{}, action Action) Response
+	Passed(input map[string]interface{}) bool
+}
+
+// parseAction decodes the action rule value.
+func parseAction(value interface{}) (*Action, error) {
+	// rego values are plain json documents, going through json gives us a typed action.
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	action := &Action{}
+	if err := json.Unmarshal(bytes, action); err != nil {
+		return nil, fmt.Errorf("invalid action: %v", err)
+	}
+	return action, action.validate()
+}
+
+func (action *Action) validate() error {
+	switch action.Type {
+	case ActionBlock, ActionTarpit, ActionChallenge, ActionHeaders, ActionLog:
+		if action.Status != 0 && (action.Status < 200 || action.Status > 599) {
+			return fmt.Errorf("invalid %s action status %d", action.Type, action.Status)
+		}
+	case ActionRedirect:
+		if action.Location == "" {
+			return fmt.Errorf("redirect action without location")
+		}
+		if action.Status != 0 && (action.Status < 300 || action.Status > 399) {
+			return fmt.Errorf("invalid redirect action status %d", action.Status)
+		}
+	default:
+		return fmt.Errorf("unknown action type %q", action.Type)
+	}
+
+	if action.DelayMs < 0 {
+		return fmt.Errorf("invalid %s action delay %dms", action.Type, action.DelayMs)
+	}
+	return nil
+}
+
+// blocks tells whether the action keeps the request from reaching the upstream.
+func (action *Action) blocks() bool {
+	return action.Type != ActionLog && action.Type != ActionHeaders
+}
+
+// Blocks tells whether the enforcer must block the request, denied requests whose action
+// only logs or changes headers are let through.
+func (decision Decision) Blocks() bool {
+	return decision.String() == DecisionDeny && (decision.Action == nil || decision.Action.blocks())
+}
+
+// addHeaderChanges merges the changes of a headers action, the first policy setting a header wins.
+func (decision *Decision) addHeaderChanges(action *Action) {
+	if action == nil || action.Type != ActionHeaders {
+		return
+	}
+	if decision.RequestHeaders == nil {
+		decision.RequestHeaders = &HeaderChanges{Add: make(map[string]string)}
+	}
+	for key, value := range action.Add {
+		key = http.CanonicalHeaderKey(key)
+		if _, ok := decision.RequestHeaders.Add[key]; !ok {
+			decision.RequestHeaders.Add[key] = value
+		}
+	}
+	decision.RequestHeaders.Remove = append(decision.RequestHeaders.Remove, action.Remove...)
+}
+
+// Apply changes the request headers.
+func (changes *HeaderChanges) Apply(header http.Header) {
+	if changes == nil {
+		return
+	}
+	for _, key := range changes.Remove {
+		header.Del(key)
+	}
+	for key, value := range changes.Add {
+		header.Set(key, value)
+	}
+}
+
+// BlockResponse builds the response for a blocked request executing the decision action on
+// top of the fallback, the enforcer default block response.
+func (firewall *Firewall) BlockResponse(input map[string]interface{}, decision Decision, fallback Response) Response {
+	response := fallback
+	response.Header = make(http.Header)
+	for key, values := range fallback.Header {
+		response.Header[key] = values
+	}
+
+	action := decision.Action
+	if action == nil {
+		return response
+	}
+
+	switch action.Type {
+	case ActionChallenge:
+		if firewall.Challenger != nil {
+			return firewall.Challenger.Challenge(input, *action)
+		}
+		firewall.Logger.Warn("challenge action without challenger, blocking instead")
+	case ActionRedirect:
+		response = Response{Status: http.StatusFound, Header: make(http.Header)}
+		response.Header.Set("Location", action.Location)
+	case ActionTarpit:
+		response.Delay = time.Duration(action.DelayMs) * time.Millisecond
+		if response.Delay > maxTarpitDelay {
+			response.Delay = maxTarpitDelay
+		}
+	}
+
+	if action.Status != 0 {
+		response.Status = action.Status
+	}
+	if action.Body != "" {
+		response.Body = []byte(action.Body)
+		response.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		if action.ContentType != "" {
+			response.Header.Set("Content-Type", action.ContentType)
+		}
+	}
+	for key, value := range action.Headers {
+		response.Header.Set(key, value)
+	}
+
+	return response
+}
+
+// Write waits for the response delay, unless the client goes away, and writes the response.
+func (response Response) Write(writer http.ResponseWriter, request *http.Request) {
+	if response.Delay > 0 {
+		select {
+		case <-time.After(response.Delay):
+		case <-request.Context().Done():
+			return
+		}
+	}
+
+	for key, values := range response.Header {
+		writer.Header()[key] = values
+	}
+	writer.WriteHeader(response.Status)
+	_, _ = writer.Write(response.Body)
+}
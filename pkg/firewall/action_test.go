@@ -0,0 +1,203 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    *Action
+		wantErr bool
+	}{
+		{
+			name:  "block",
+			value: map[string]interface{}{"type": "block", "status": 403, "body": "go away"},
+			want:  &Action{Type: ActionBlock, Status: 403, Body: "go away"},
+		},
+		{
+			name:  "redirect",
+			value: map[string]interface{}{"type": "redirect", "location": "https://www.example.com/blocked"},
+			want:  &Action{Type: ActionRedirect, Location: "https://www.example.com/blocked"},
+		},
+		{
+			name:  "tarpit",
+			value: map[string]interface{}{"type": "tarpit", "delay_ms": 1500},
+			want:  &Action{Type: ActionTarpit, DelayMs: 1500},
+		},
+		{
+			name:  "headers",
+			value: map[string]interface{}{"type": "headers", "add": map[string]interface{}{"x-suspicious": "1"}, "remove": []interface{}{"cookie"}},
+			want:  &Action{Type: ActionHeaders, Add: map[string]string{"x-suspicious": "1"}, Remove: []string{"cookie"}},
+		},
+		{name: "unknown type", value: map[string]interface{}{"type": "drop"}, wantErr: true},
+		{name: "missing type", value: map[string]interface{}{"status": 403}, wantErr: true},
+		{name: "redirect without location", value: map[string]interface{}{"type": "redirect"}, wantErr: true},
+		{name: "redirect with a block status", value: map[string]interface{}{"type": "redirect", "location": "/", "status": 403}, wantErr: true},
+		{name: "block with an invalid status", value: map[string]interface{}{"type": "block", "status": 99}, wantErr: true},
+		{name: "negative delay", value: map[string]interface{}{"type": "tarpit", "delay_ms": -1}, wantErr: true},
+		{name: "status of the wrong type", value: map[string]interface{}{"type": "block", "status": "403"}, wantErr: true},
+		{name: "not an object", value: "block", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			action, err := parseAction(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("parseAction() = %+v, want an error", action)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAction() error = %v", err)
+			}
+			if !reflect.DeepEqual(action, test.want) {
+				t.Errorf("parseAction() = %+v, want %+v", action, test.want)
+			}
+		})
+	}
+}
+
+func TestDecisionBlocks(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision Decision
+		want     bool
+	}{
+		{name: "allow", decision: Decision{Allowed: true}, want: false},
+		{name: "deny", decision: Decision{}, want: true},
+		{name: "dry run deny", decision: Decision{DryRun: true}, want: false},
+		{name: "deny with a block action", decision: Decision{Action: &Action{Type: ActionBlock}}, want: true},
+		{name: "deny with a tarpit action", decision: Decision{Action: &Action{Type: ActionTarpit}}, want: true},
+		{name: "deny with a log action", decision: Decision{Action: &Action{Type: ActionLog}}, want: false},
+		{name: "deny with a headers action", decision: Decision{Action: &Action{Type: ActionHeaders}}, want: false},
+	}
+
+	for _, test := range tests {
+		if got := test.decision.Blocks(); got != test.want {
+			t.Errorf("%s: Blocks() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// fakeChallenger answers every challenge with a 401.
+type fakeChallenger struct{}
+
+func (challenger fakeChallenger) Challenge(input map[string]interface{}, action Action) Response {
+	return Response{Status: http.StatusUnauthorized, Header: make(http.Header)}
+}
+
+func (challenger fakeChallenger) Passed(input map[string]interface{}) bool {
+	return false
+}
+
+func TestBlockResponse(t *testing.T) {
+	fallback := Response{
+		Status: http.StatusTooManyRequests,
+		Header: http.Header{"X-Blocked": {"1"}},
+		Body:   []byte("blocked"),
+	}
+
+	tests := []struct {
+		name       string
+		action     *Action
+		challenger Challenger
+		want       Response
+	}{
+		{
+			name: "without action",
+			want: fallback,
+		},
+		{
+			name:   "block",
+			action: &Action{Type: ActionBlock, Status: 403, Body: `{"error":"forbidden"}`, ContentType: "application/json", Headers: map[string]string{"X-Reason": "bot"}},
+			want: Response{
+				Status: 403,
+				Header: http.Header{"X-Blocked": {"1"}, "Content-Type": {"application/json"}, "X-Reason": {"bot"}},
+				Body:   []byte(`{"error":"forbidden"}`),
+			},
+		},
+		{
+			name:   "block with a plain body",
+			action: &Action{Type: ActionBlock, Body: "go away"},
+			want: Response{
+				Status: http.StatusTooManyRequests,
+				Header: http.Header{"X-Blocked": {"1"}, "Content-Type": {"text/plain; charset=utf-8"}},
+				Body:   []byte("go away"),
+			},
+		},
+		{
+			name:   "redirect",
+			action: &Action{Type: ActionRedirect, Location: "https://www.example.com/blocked"},
+			want: Response{
+				Status: http.StatusFound,
+				Header: http.Header{"Location": {"https://www.example.com/blocked"}},
+			},
+		},
+		{
+			name:   "permanent redirect",
+			action: &Action{Type: ActionRedirect, Location: "/blocked", Status: http.StatusMovedPermanently},
+			want: Response{
+				Status: http.StatusMovedPermanently,
+				Header: http.Header{"Location": {"/blocked"}},
+			},
+		},
+		{
+			name:   "tarpit",
+			action: &Action{Type: ActionTarpit, DelayMs: 1500},
+			want:   Response{Status: fallback.Status, Header: fallback.Header, Body: fallback.Body, Delay: 1500 * time.Millisecond},
+		},
+		{
+			name:   "tarpit longer than the maximum",
+			action: &Action{Type: ActionTarpit, DelayMs: 3600000},
+			want:   Response{Status: fallback.Status, Header: fallback.Header, Body: fallback.Body, Delay: maxTarpitDelay},
+		},
+		{
+			name:       "challenge",
+			action:     &Action{Type: ActionChallenge},
+			challenger: fakeChallenger{},
+			want:       Response{Status: http.StatusUnauthorized, Header: http.Header{}},
+		},
+		{
+			name:   "challenge without challenger",
+			action: &Action{Type: ActionChallenge},
+			want:   fallback,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			firewall := newTestFirewall()
+			firewall.Challenger = test.challenger
+
+			response := firewall.BlockResponse(nil, Decision{Action: test.action}, fallback)
+			if !reflect.DeepEqual(response, test.want) {
+				t.Errorf("BlockResponse() = %+v, want %+v", response, test.want)
+			}
+			if len(fallback.Header) != 1 {
+				t.Errorf("BlockResponse() modified the fallback headers: %v", fallback.Header)
+			}
+		})
+	}
+}
+
+func TestResponseWrite(t *testing.T) {
+	response := Response{Status: http.StatusForbidden, Header: http.Header{"X-Blocked": {"1"}}, Body: []byte("blocked"), Delay: 20 * time.Millisecond}
+
+	recorder := httptest.NewRecorder()
+	start := time.Now()
+	response.Write(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if elapsed := time.Since(start); elapsed < response.Delay {
+		t.Errorf("Write() took %s, want at least the %s delay", elapsed, response.Delay)
+	}
+	if recorder.Code != http.StatusForbidden || recorder.Header().Get("X-Blocked") != "1" || recorder.Body.String() != "blocked" {
+		t.Errorf("Write() = %d %v %q", recorder.Code, recorder.Header(), recorder.Body.String())
+	}
+}
@@ -0,0 +1,106 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultBodyMaxSize is the number of body bytes buffered for inspection when FIREWALL_BODY_MAX_SIZE is not set.
+const DefaultBodyMaxSize = 64 * 1024
+
+// BodyInspectionRule selects the requests whose body is buffered for inspection.
+type BodyInspectionRule struct {
+	// Host is matched exactly, "*" matches any host.
+	Host string
+	// PathPrefix is matched against the beginning of the path.
+	PathPrefix string
+}
+
+// ParseBodyInspectionRule parses a rule in the host/path-prefix form, Ex.: www.example.com/login, */api/.
+func ParseBodyInspectionRule(entry string) (BodyInspectionRule, error) {
+	slash := strings.Index(entry, "/")
+	if slash <= 0 {
+		return BodyInspectionRule{}, fmt.Errorf("invalid body inspection rule %s, expected host/path-prefix", entry)
+	}
+	return BodyInspectionRule{Host: strings.ToLower(entry[:slash]), PathPrefix: entry[slash:]}, nil
+}
+
+// InspectsBody tells whether the body of requests to host and path must be buffered for inspection.
+func (configuration *Configuration) InspectsBody(host, path string) bool {
+	host = strings.ToLower(stripHostPort(host))
+	for _, rule := range configuration.BodyInspection {
+		if (rule.Host == "*" || rule.Host == host) && strings.HasPrefix(path, rule.PathPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferBody reads up to BodyMaxSize bytes of the request body and puts them back in front of
+// the remaining body, so the request can still be forwarded in full. Truncated is set when the
+// body is larger than BodyMaxSize.
+func (configuration *Configuration) bufferBody(request *http.Request) (body []byte, truncated bool, err error) {
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, false, nil
+	}
+
+	body, err = ioutil.ReadAll(io.LimitReader(request.Body, configuration.BodyMaxSize+1))
+	if int64(len(body)) > configuration.BodyMaxSize {
+		truncated = true
+	}
+	request.Body = &replayedBody{Reader: io.MultiReader(bytes.NewReader(body), request.Body), Closer: request.Body}
+
+	if truncated {
+		body = body[:configuration.BodyMaxSize]
+	}
+	return body, truncated, err
+}
+
+type replayedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// parseBody returns the body document for the input: the decoded JSON value or the form values
+// depending on the content type. Nil is returned for other content types, truncated or malformed bodies.
+func parseBody(contentType string, body []byte, truncated bool) interface{} {
+	if truncated || len(body) == 0 {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var document interface{}
+		if err := json.Unmarshal(body, &document); err != nil {
+			return nil
+		}
+		return document
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil
+		}
+		return map[string][]string(values)
+	}
+
+	return nil
+}
+
+func stripHostPort(host string) string {
+	if colon := strings.LastIndex(host, ":"); colon != -1 && !strings.HasSuffix(host, "]") {
+		return strings.Trim(host[:colon], "[]")
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,234 @@
+package firewall
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBodyInspectionRule(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    BodyInspectionRule
+		wantErr bool
+	}{
+		{entry: "www.example.com/login", want: BodyInspectionRule{Host: "www.example.com", PathPrefix: "/login"}},
+		{entry: "WWW.Example.com/Login", want: BodyInspectionRule{Host: "www.example.com", PathPrefix: "/Login"}},
+		{entry: "*/api/", want: BodyInspectionRule{Host: "*", PathPrefix: "/api/"}},
+		{entry: "/login", wantErr: true},
+		{entry: "www.example.com", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.entry, func(t *testing.T) {
+			got, err := ParseBodyInspectionRule(test.entry)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseBodyInspectionRule() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("ParseBodyInspectionRule() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInspectsBody(t *testing.T) {
+	configuration := &Configuration{BodyInspection: []BodyInspectionRule{
+		{Host: "www.example.com", PathPrefix: "/login"},
+		{Host: "*", PathPrefix: "/api/"},
+	}}
+
+	tests := []struct {
+		host string
+		path string
+		want bool
+	}{
+		{host: "www.example.com", path: "/login", want: true},
+		{host: "WWW.EXAMPLE.COM:8080", path: "/login/sso", want: true},
+		{host: "www.example.com", path: "/", want: false},
+		{host: "shop.example.com", path: "/login", want: false},
+		{host: "shop.example.com", path: "/api/orders", want: true},
+		{host: "[2001:db8::1]:8080", path: "/api/orders", want: true},
+	}
+
+	for _, test := range tests {
+		if got := configuration.InspectsBody(test.host, test.path); got != test.want {
+			t.Errorf("InspectsBody(%s, %s) = %v, want %v", test.host, test.path, got, test.want)
+		}
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	configuration := &Configuration{BodyMaxSize: 8}
+
+	tests := []struct {
+		name          string
+		body          string
+		wantBody      string
+		wantTruncated bool
+	}{
+		{name: "empty", body: "", wantBody: ""},
+		{name: "smaller", body: "user=bob", wantBody: "user=bob"},
+		{name: "larger", body: "user=alice", wantBody: "user=ali", wantTruncated: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "http://www.example.com/login", strings.NewReader(test.body))
+
+			body, truncated, err := configuration.bufferBody(request)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != test.wantBody || truncated != test.wantTruncated {
+				t.Errorf("bufferBody() = %q, truncated %v, want %q, truncated %v", body, truncated, test.wantBody, test.wantTruncated)
+			}
+
+			// the body is put back in full for the upstream.
+			restored, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(restored) != test.body {
+				t.Errorf("restored body = %q, want %q", restored, test.body)
+			}
+		})
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "http://www.example.com/login", nil)
+	if body, truncated, err := configuration.bufferBody(request); body != nil || truncated || err != nil {
+		t.Errorf("bufferBody() = %q, %v, %v without body", body, truncated, err)
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		truncated   bool
+		want        interface{}
+	}{
+		{
+			name:        "json",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"username": "bob", "remember": true}`,
+			want:        map[string]interface{}{"username": "bob", "remember": true},
+		},
+		{
+			name:        "json suffix",
+			contentType: "application/vnd.api+json",
+			body:        `["bob"]`,
+			want:        []interface{}{"bob"},
+		},
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "username=bob&role=admin&role=user",
+			want:        map[string][]string{"username": {"bob"}, "role": {"admin", "user"}},
+		},
+		{
+			name:        "malformed json",
+			contentType: "application/json",
+			body:        `{"username": `,
+			want:        nil,
+		},
+		{
+			name:        "malformed form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "username=%zz",
+			want:        nil,
+		},
+		{
+			name:        "truncated",
+			contentType: "application/json",
+			body:        `{"username": "bob"}`,
+			truncated:   true,
+			want:        nil,
+		},
+		{
+			name:        "other content type",
+			contentType: "text/plain",
+			body:        "username=bob",
+			want:        nil,
+		},
+		{
+			name: "missing content type",
+			body: `{"username": "bob"}`,
+			want: nil,
+		},
+		{
+			name:        "empty",
+			contentType: "application/json",
+			want:        nil,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := parseBody(test.contentType, []byte(test.body), test.truncated); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseBody() = %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRequestInputInspectsBody(t *testing.T) {
+	firewall := newTestFirewall()
+	firewall.Configuration.BodyInspection = []BodyInspectionRule{{Host: "www.example.com", PathPrefix: "/login"}}
+	firewall.Configuration.BodyMaxSize = 16
+
+	tests := []struct {
+		name          string
+		path          string
+		body          string
+		wantBody      interface{}
+		wantTruncated interface{}
+	}{
+		{
+			name:          "inspected",
+			path:          "/login",
+			body:          `{"user": "bob"}`,
+			wantBody:      map[string]interface{}{"user": "bob"},
+			wantTruncated: false,
+		},
+		{
+			name:          "larger than the limit",
+			path:          "/login",
+			body:          `{"user": "mallory"}`,
+			wantBody:      nil,
+			wantTruncated: true,
+		},
+		{
+			name: "not inspected",
+			path: "/search",
+			body: `{"user": "bob"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "http://www.example.com"+test.path, strings.NewReader(test.body))
+			request.Header.Set("Content-Type", "application/json")
+
+			input := firewall.RequestInput(request)
+			if body := input["body"]; !reflect.DeepEqual(body, test.wantBody) {
+				t.Errorf("body = %#v, want %#v", body, test.wantBody)
+			}
+			if truncated := input["body_truncated"]; truncated != test.wantTruncated {
+				t.Errorf("body_truncated = %v, want %v", truncated, test.wantTruncated)
+			}
+
+			forwarded, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(forwarded) != test.body {
+				t.Errorf("forwarded body = %q, want %q", forwarded, test.body)
+			}
+		})
+	}
+}
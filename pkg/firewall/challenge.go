@@ -0,0 +1,209 @@
+package firewall
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ClearanceCookieName holds the clearance of the clients which solved the challenge.
+const ClearanceCookieName = "firewall_clearance"
+
+// ProofOfWork is a Challenger serving a page whose script looks for a nonce such that the
+// sha256 of the clearance token and the nonce starts with Difficulty zero bits. The token is
+// signed with Secret and bound to the client ip and an expiration, the client stores it with
+// the nonce in the clearance cookie. Verifying a clearance is an hmac and a sha256, no state
+// is shared between the enforcers besides the secret.
+type ProofOfWork struct {
+	Secret []byte
+	// Difficulty is the number of leading zero bits, each one doubles the expected work.
+	Difficulty int
+	// TTL is how long a clearance is valid.
+	TTL time.Duration
+}
+
+// ChallengeData is available to the challenge page template.
+type ChallengeData struct {
+	Token      string
+	Difficulty int
+	CookieName string
+	MaxAge     int
+}
+
+// NewProofOfWork initializes the proof of work challenger. Difficulty must be between 0 and 32.
+func NewProofOfWork(secret []byte, difficulty int, ttl time.Duration) (*ProofOfWork, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("missing challenge secret")
+	}
+	if difficulty < 0 || difficulty > 32 {
+		return nil, fmt.Errorf("challenge difficulty must be between 0 and 32, got %d", difficulty)
+	}
+	return &ProofOfWork{Secret: secret, Difficulty: difficulty, TTL: ttl}, nil
+}
+
+// Challenge serves the challenge page. Status defaults to 403, the action headers are added.
+func (pow *ProofOfWork) Challenge(input map[string]interface{}, action Action) Response {
+	response := Response{Status: http.StatusForbidden, Header: make(http.Header)}
+	if action.Status != 0 {
+		response.Status = action.Status
+	}
+	response.Header.Set("Content-Type", "text/html; charset=utf-8")
+	response.Header.Set("Cache-Control", "no-store")
+	for key, value := range action.Headers {
+		response.Header.Set(key, value)
+	}
+
+	ip, _ := input["ip"].(string)
+	token, err := pow.token(ip, time.Now().Add(pow.TTL))
+	if err != nil {
+		// without a token the page can't be solved, the client is just blocked.
+		return response
+	}
+
+	body := &bytes.Buffer{}
+	_ = challengeTemplate.Execute(body, ChallengeData{
+		Token:      token,
+		Difficulty: pow.Difficulty,
+		CookieName: ClearanceCookieName,
+		MaxAge:     int(pow.TTL.Seconds()),
+	})
+	response.Body = body.Bytes()
+
+	return response
+}
+
+// Passed tells whether the input carries a valid clearance for its ip.
+func (pow *ProofOfWork) Passed(input map[string]interface{}) bool {
+	// the input is either the one built by BuildInput or its json form when read by rego.
+	var clearance string
+	switch cookies := input["cookies"].(type) {
+	case map[string]string:
+		clearance = cookies[ClearanceCookieName]
+	case map[string]interface{}:
+		clearance, _ = cookies[ClearanceCookieName].(string)
+	}
+	ip, _ := input["ip"].(string)
+
+	return pow.verify(clearance, ip, time.Now())
+}
+
+// token returns expiration.random.signature, the signature covers the ip and the difficulty.
+func (pow *ProofOfWork) token(ip string, expireAt time.Time) (string, error) {
+	random := make([]byte, 12)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+
+	payload := fmt.Sprintf("%d.%s", expireAt.Unix(), hex.EncodeToString(random))
+	return payload + "." + pow.sign(payload, ip), nil
+}
+
+func (pow *ProofOfWork) sign(payload, ip string) string {
+	mac := hmac.New(sha256.New, pow.Secret)
+	_, _ = fmt.Fprintf(mac, "%s|%s|%d", payload, ip, pow.Difficulty)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify checks a token.nonce clearance.
+func (pow *ProofOfWork) verify(clearance, ip string, now time.Time) bool {
+	parts := strings.Split(clearance, ".")
+	if len(parts) != 4 {
+		return false
+	}
+
+	expireAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || now.Unix() > expireAt {
+		return false
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(pow.sign(payload, ip))) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(clearance))
+	return binary.BigEndian.Uint32(sum[:4])>>uint(32-pow.Difficulty) == 0
+}
+
+// challengeTemplate solves the challenge with a plain javascript sha256, crypto.subtle is only
+// available to https pages.
+var challengeTemplate = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Checking your browser</title></head>
+<body>
+<h1>Checking your browser</h1>
+<p>This page reloads automatically in a few seconds.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(function () {
+  var K = [
+    0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+    0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+    0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+    0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+    0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+    0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+    0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+    0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+  ];
+
+  function ror(x, n) { return (x >>> n) | (x << (32 - n)); }
+
+  // firstWord returns the first 32 bits of the sha256 of an ascii string.
+  function firstWord(message) {
+    var bytes = [], i;
+    for (i = 0; i < message.length; i++) { bytes.push(message.charCodeAt(i) & 0xff); }
+    var bitLength = bytes.length * 8;
+    bytes.push(0x80);
+    while (bytes.length % 64 !== 56) { bytes.push(0); }
+    bytes.push(0, 0, 0, 0);
+    for (i = 3; i >= 0; i--) { bytes.push((bitLength >>> (i * 8)) & 0xff); }
+
+    var H = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+    var W = new Array(64);
+    for (var offset = 0; offset < bytes.length; offset += 64) {
+      for (i = 0; i < 16; i++) {
+        var j = offset + i * 4;
+        W[i] = (bytes[j] << 24) | (bytes[j + 1] << 16) | (bytes[j + 2] << 8) | bytes[j + 3];
+      }
+      for (i = 16; i < 64; i++) {
+        var s0 = ror(W[i - 15], 7) ^ ror(W[i - 15], 18) ^ (W[i - 15] >>> 3);
+        var s1 = ror(W[i - 2], 17) ^ ror(W[i - 2], 19) ^ (W[i - 2] >>> 10);
+        W[i] = (W[i - 16] + s0 + W[i - 7] + s1) | 0;
+      }
+      var a = H[0], b = H[1], c = H[2], d = H[3], e = H[4], f = H[5], g = H[6], h = H[7];
+      for (i = 0; i < 64; i++) {
+        var t1 = (h + (ror(e, 6) ^ ror(e, 11) ^ ror(e, 25)) + ((e & f) ^ (~e & g)) + K[i] + W[i]) | 0;
+        var t2 = ((ror(a, 2) ^ ror(a, 13) ^ ror(a, 22)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+        h = g; g = f; f = e; e = (d + t1) | 0; d = c; c = b; b = a; a = (t1 + t2) | 0;
+      }
+      H[0] = (H[0] + a) | 0; H[1] = (H[1] + b) | 0; H[2] = (H[2] + c) | 0; H[3] = (H[3] + d) | 0;
+      H[4] = (H[4] + e) | 0; H[5] = (H[5] + f) | 0; H[6] = (H[6] + g) | 0; H[7] = (H[7] + h) | 0;
+    }
+    return H[0] >>> 0;
+  }
+
+  var token = {{.Token}};
+  var difficulty = {{.Difficulty}};
+  var nonce = 0;
+  while (difficulty > 0 && (firstWord(token + "." + nonce) >>> (32 - difficulty)) !== 0) { nonce++; }
+
+  var cookie = {{.CookieName}} + "=" + token + "." + nonce + "; Path=/; Max-Age=" + {{.MaxAge}} + "; SameSite=Lax";
+  if (location.protocol === "https:") { cookie += "; Secure"; }
+  document.cookie = cookie;
+  location.reload();
+})();
+</script>
+</body>
+</html>
+`))
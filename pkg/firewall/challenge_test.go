@@ -0,0 +1,227 @@
+package firewall
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// solve finds the nonce the challenge page script would find for the token.
+func solve(token string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		clearance := fmt.Sprintf("%s.%d", token, nonce)
+		sum := sha256.Sum256([]byte(clearance))
+		if binary.BigEndian.Uint32(sum[:4])>>uint(32-difficulty) == 0 {
+			return clearance
+		}
+	}
+}
+
+// unsolved returns a clearance for the token whose work doesn't meet the difficulty.
+func unsolved(token string, difficulty int) string {
+	for nonce := 0; ; nonce++ {
+		clearance := fmt.Sprintf("%s.%d", token, nonce)
+		sum := sha256.Sum256([]byte(clearance))
+		if binary.BigEndian.Uint32(sum[:4])>>uint(32-difficulty) != 0 {
+			return clearance
+		}
+	}
+}
+
+func TestNewProofOfWork(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		difficulty int
+		wantErr    bool
+	}{
+		{name: "valid", secret: "secret", difficulty: 16},
+		{name: "no work", secret: "secret", difficulty: 0},
+		{name: "missing secret", difficulty: 16, wantErr: true},
+		{name: "negative difficulty", secret: "secret", difficulty: -1, wantErr: true},
+		{name: "difficulty too high", secret: "secret", difficulty: 33, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewProofOfWork([]byte(test.secret), test.difficulty, time.Hour)
+			if (err != nil) != test.wantErr {
+				t.Errorf("NewProofOfWork() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestProofOfWorkVerify(t *testing.T) {
+	const ip = "203.0.113.7"
+	now := time.Now()
+	pow, err := NewProofOfWork([]byte("secret"), 8, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := pow.token(ip, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := pow.token(ip, now.Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forger := &ProofOfWork{Secret: []byte("guessed"), Difficulty: pow.Difficulty, TTL: pow.TTL}
+	forged, err := forger.token(ip, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	easier := &ProofOfWork{Secret: pow.Secret, Difficulty: 0, TTL: pow.TTL}
+	easy, err := easier.token(ip, now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(token, ".")
+	extended := fmt.Sprintf("%d.%s.%s", now.Add(24*time.Hour).Unix(), parts[1], parts[2])
+
+	tests := []struct {
+		name      string
+		clearance string
+		ip        string
+		want      bool
+	}{
+		{name: "solved", clearance: solve(token, pow.Difficulty), ip: ip, want: true},
+		{name: "insufficient work", clearance: unsolved(token, pow.Difficulty), ip: ip, want: false},
+		{name: "other ip", clearance: solve(token, pow.Difficulty), ip: "198.51.100.1", want: false},
+		{name: "expired", clearance: solve(expired, pow.Difficulty), ip: ip, want: false},
+		{name: "forged signature", clearance: solve(forged, pow.Difficulty), ip: ip, want: false},
+		{name: "signed for a lower difficulty", clearance: solve(easy, pow.Difficulty), ip: ip, want: false},
+		{name: "extended expiration", clearance: solve(extended, pow.Difficulty), ip: ip, want: false},
+		{name: "missing nonce", clearance: token, ip: ip, want: false},
+		{name: "empty", clearance: "", ip: ip, want: false},
+		{name: "invalid expiration", clearance: "soon.abc.def.1", ip: ip, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pow.verify(test.clearance, test.ip, now); got != test.want {
+				t.Errorf("verify(%q, %s) = %v, want %v", test.clearance, test.ip, got, test.want)
+			}
+		})
+	}
+}
+
+func TestProofOfWorkPassed(t *testing.T) {
+	const ip = "203.0.113.7"
+	pow, err := NewProofOfWork([]byte("secret"), 4, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := pow.token(ip, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clearance := solve(token, pow.Difficulty)
+
+	tests := []struct {
+		name  string
+		input map[string]interface{}
+		want  bool
+	}{
+		{
+			name:  "built input",
+			input: map[string]interface{}{"ip": ip, "cookies": map[string]string{ClearanceCookieName: clearance}},
+			want:  true,
+		},
+		{
+			name:  "rego input",
+			input: map[string]interface{}{"ip": ip, "cookies": map[string]interface{}{ClearanceCookieName: clearance}},
+			want:  true,
+		},
+		{
+			name:  "without clearance",
+			input: map[string]interface{}{"ip": ip, "cookies": map[string]string{"session": "abc"}},
+			want:  false,
+		},
+		{
+			name:  "without cookies",
+			input: map[string]interface{}{"ip": ip},
+			want:  false,
+		},
+		{
+			name:  "without ip",
+			input: map[string]interface{}{"cookies": map[string]string{ClearanceCookieName: clearance}},
+			want:  false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := pow.Passed(test.input); got != test.want {
+				t.Errorf("Passed() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProofOfWorkChallenge(t *testing.T) {
+	const ip = "203.0.113.7"
+	pow, err := NewProofOfWork([]byte("secret"), 4, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := map[string]interface{}{"ip": ip}
+
+	response := pow.Challenge(input, Action{Type: ActionChallenge})
+	if response.Status != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", response.Status, http.StatusForbidden)
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("content type = %q, want html", contentType)
+	}
+	if cacheControl := response.Header.Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("cache control = %q, want no-store", cacheControl)
+	}
+
+	// the page embeds a token for the client ip, solving it as the script does must pass.
+	match := regexp.MustCompile(`var token = "([^"]+)";`).FindSubmatch(response.Body)
+	if match == nil {
+		t.Fatalf("no token in the challenge page:\n%s", response.Body)
+	}
+	clearance := solve(string(match[1]), pow.Difficulty)
+	if !pow.Passed(map[string]interface{}{"ip": ip, "cookies": map[string]string{ClearanceCookieName: clearance}}) {
+		t.Error("the solved token of the page didn't pass")
+	}
+	// html/template pads the values it writes into scripts with spaces.
+	if !regexp.MustCompile(`var difficulty = \s*4\s*;`).Match(response.Body) {
+		t.Error("the page doesn't carry the difficulty")
+	}
+
+	response = pow.Challenge(input, Action{Type: ActionChallenge, Status: http.StatusServiceUnavailable, Headers: map[string]string{"Retry-After": "5"}})
+	if response.Status != http.StatusServiceUnavailable || response.Header.Get("Retry-After") != "5" {
+		t.Errorf("status = %d, headers = %v, want the action status and headers", response.Status, response.Header)
+	}
+}
+
+func TestChallengeTemplateEscapes(t *testing.T) {
+	body := &bytes.Buffer{}
+	err := challengeTemplate.Execute(body, ChallengeData{
+		Token:      `"</script><script>alert(1)</script>`,
+		Difficulty: 1,
+		CookieName: `x"; document.location="https://attacker.example`,
+		MaxAge:     60,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, injected := range []string{"</script><script>", `x"; document.location=`} {
+		if strings.Contains(body.String(), injected) {
+			t.Errorf("the page carries %q unescaped", injected)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package firewall
+
+import (
+	"net"
+	"strings"
+)
+
+// defaultClientIPHeader is the forwarding header honoured unless configured otherwise.
+const defaultClientIPHeader = "x-forwarded-for"
+
+// ResolveClientIP returns the client ip and the full chain of addresses the request went
+// through, from the client to the peer connected to us. Only the configured ClientIPHeader is
+// read and it is only honoured when the peer is a trusted proxy: the chain is walked
+// right-to-left and the first address which is not a trusted proxy is the client. Other
+// forwarding headers are ignored, clients could set them to anything. Headers must be lower cased.
+func (configuration *Configuration) ResolveClientIP(remoteAddr string, headers map[string][]string) (string, []string) {
+	chain := configuration.forwardedChain(headers)
+	if remoteAddr = normalizeAddress(remoteAddr); remoteAddr != "" {
+		chain = append(chain, remoteAddr)
+	}
+	if len(chain) == 0 {
+		return "", chain
+	}
+
+	client := chain[len(chain)-1]
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := net.ParseIP(chain[i])
+		if ip == nil {
+			// obfuscated or unknown hops can't be trusted, the last known proxy is the client.
+			break
+		}
+		client = chain[i]
+
+		if !configuration.isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return client, chain
+}
+
+// IsTrustedPeer tells whether the peer connected to us is a trusted proxy.
+func (configuration *Configuration) IsTrustedPeer(remoteAddr string) bool {
+	ip := net.ParseIP(normalizeAddress(remoteAddr))
+	return ip != nil && configuration.isTrustedProxy(ip)
+}
+
+func (configuration *Configuration) isTrustedProxy(ip net.IP) bool {
+	for _, network := range configuration.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedChain returns the addresses of the client ip header, left to right. Forwarded
+// (RFC 7239) is read from its for parameters, any other header as a comma separated list.
+func (configuration *Configuration) forwardedChain(headers map[string][]string) []string {
+	header := configuration.ClientIPHeader
+	if header == "" {
+		header = defaultClientIPHeader
+	}
+
+	values, ok := headers[header]
+	if !ok {
+		return nil
+	}
+
+	var chain []string
+	for _, element := range strings.Split(strings.Join(values, ","), ",") {
+		if header != "forwarded" {
+			if address := normalizeAddress(element); address != "" {
+				chain = append(chain, address)
+			}
+			continue
+		}
+
+		for _, pair := range strings.Split(element, ";") {
+			keyValue := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(keyValue) == 2 && strings.EqualFold(keyValue[0], "for") {
+				chain = append(chain, normalizeAddress(keyValue[1]))
+			}
+		}
+	}
+
+	return chain
+}
+
+// normalizeAddress strips quotes, ports and ipv6 brackets: `"[2001:db8::1]:4711"` becomes 2001:db8::1.
+func normalizeAddress(address string) string {
+	address = strings.Trim(strings.TrimSpace(address), `"`)
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+
+	if ip := net.ParseIP(address); ip != nil {
+		return ip.String()
+	}
+	return address
+}
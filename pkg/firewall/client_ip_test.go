@@ -0,0 +1,115 @@
+package firewall
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		headers    map[string][]string
+		wantIP     string
+		wantChain  []string
+	}{
+		{
+			name:       "untrusted peer",
+			remoteAddr: "198.51.100.1:4711",
+			headers:    map[string][]string{"x-forwarded-for": {"203.0.113.7"}},
+			wantIP:     "198.51.100.1",
+			wantChain:  []string{"203.0.113.7", "198.51.100.1"},
+		},
+		{
+			name:       "trusted peer",
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"x-forwarded-for": {"203.0.113.7, 10.0.0.2"}},
+			wantIP:     "203.0.113.7",
+			wantChain:  []string{"203.0.113.7", "10.0.0.2", "10.0.0.1"},
+		},
+		{
+			name:       "spoofed x-forwarded-for",
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"x-forwarded-for": {"192.0.2.1", "203.0.113.7"}},
+			wantIP:     "203.0.113.7",
+			wantChain:  []string{"192.0.2.1", "203.0.113.7", "10.0.0.1"},
+		},
+		{
+			name:       "spoofed forwarded",
+			remoteAddr: "10.0.0.1:4711",
+			headers: map[string][]string{
+				"forwarded":       {"for=192.0.2.1"},
+				"x-forwarded-for": {"203.0.113.7"},
+			},
+			wantIP:    "203.0.113.7",
+			wantChain: []string{"203.0.113.7", "10.0.0.1"},
+		},
+		{
+			name:       "spoofed x-real-ip",
+			remoteAddr: "10.0.0.1:4711",
+			headers: map[string][]string{
+				"x-real-ip":       {"192.0.2.1"},
+				"x-forwarded-for": {"203.0.113.7"},
+			},
+			wantIP:    "203.0.113.7",
+			wantChain: []string{"203.0.113.7", "10.0.0.1"},
+		},
+		{
+			name:       "spoofed x-real-ip without x-forwarded-for",
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"x-real-ip": {"192.0.2.1"}},
+			wantIP:     "10.0.0.1",
+			wantChain:  []string{"10.0.0.1"},
+		},
+		{
+			name:       "forwarded",
+			header:     "forwarded",
+			remoteAddr: "10.0.0.1:4711",
+			headers: map[string][]string{
+				"forwarded":       {`for=192.0.2.1, for="[2001:db8::1]:4711";proto=https`},
+				"x-forwarded-for": {"192.0.2.2"},
+			},
+			wantIP:    "2001:db8::1",
+			wantChain: []string{"192.0.2.1", "2001:db8::1", "10.0.0.1"},
+		},
+		{
+			name:       "x-real-ip",
+			header:     "x-real-ip",
+			remoteAddr: "10.0.0.1:4711",
+			headers: map[string][]string{
+				"x-real-ip":       {"203.0.113.7"},
+				"x-forwarded-for": {"192.0.2.1"},
+			},
+			wantIP:    "203.0.113.7",
+			wantChain: []string{"203.0.113.7", "10.0.0.1"},
+		},
+		{
+			name:       "obfuscated hop",
+			remoteAddr: "10.0.0.1:4711",
+			headers:    map[string][]string{"x-forwarded-for": {"203.0.113.7, unknown, 10.0.0.2"}},
+			wantIP:     "10.0.0.2",
+			wantChain:  []string{"203.0.113.7", "unknown", "10.0.0.2", "10.0.0.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := &Configuration{
+				TrustedProxies: []*net.IPNet{trusted},
+				ClientIPHeader: test.header,
+			}
+
+			ip, chain := configuration.ResolveClientIP(test.remoteAddr, test.headers)
+			if ip != test.wantIP {
+				t.Errorf("ip = %s, want %s", ip, test.wantIP)
+			}
+			if !reflect.DeepEqual(chain, test.wantChain) {
+				t.Errorf("chain = %q, want %q", chain, test.wantChain)
+			}
+		})
+	}
+}
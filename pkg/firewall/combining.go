@@ -0,0 +1,159 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	// CombiningAllowOverrides allows the request when any policy allows it, even if others deny.
+	CombiningAllowOverrides = "allow-overrides"
+	// CombiningDenyOverrides denies the request when any policy denies it, even if others allow.
+	CombiningDenyOverrides = "deny-overrides"
+	// CombiningFirstApplicable takes the decision of the first policy, in order, whose allow or
+	// deny rule matched. A policy matching both allows the request.
+	CombiningFirstApplicable = "first-applicable"
+)
+
+// isValidCombiningAlgorithm tells whether the algorithm is known, empty means the configured default.
+func isValidCombiningAlgorithm(algorithm string) bool {
+	switch algorithm {
+	case "", CombiningAllowOverrides, CombiningDenyOverrides, CombiningFirstApplicable:
+		return true
+	}
+	return false
+}
+
+// policyTier holds the policies sharing a priority. Tiers are evaluated from the highest
+// priority down and the first tier with a matching (not dry run) policy decides, lower tiers
+// are not evaluated. Within a tier the policies are combined with Algorithm.
+type policyTier struct {
+	Priority  int
+	Algorithm string
+	Queries   []*policyQuery
+}
+
+// buildPolicyTiers groups the queries by priority. The algorithm of a tier is declared by its
+// policies, the first one by name wins when they disagree. Tiers without a declaration use the
+// default algorithm.
+func (firewall *Firewall) buildPolicyTiers(queries []*policyQuery, policies map[string]PolicyEvent, defaultAlgorithm string) []*policyTier {
+	sortPolicyQueries(queries)
+
+	var tiers []*policyTier
+	for _, query := range queries {
+		if len(tiers) == 0 || tiers[len(tiers)-1].Priority != query.Priority {
+			tiers = append(tiers, &policyTier{Priority: query.Priority})
+		}
+		tier := tiers[len(tiers)-1]
+		tier.Queries = append(tier.Queries, query)
+
+		algorithm := policies[query.Name].Combining
+		switch {
+		case algorithm == "":
+		case !isValidCombiningAlgorithm(algorithm):
+			firewall.Logger.Warnf("policy %s declares unknown combining algorithm %s, ignoring", query.Name, algorithm)
+		case tier.Algorithm == "":
+			tier.Algorithm = algorithm
+		case tier.Algorithm != algorithm:
+			firewall.Logger.Warnf("policy %s declares %s but priority %d already combines with %s, ignoring", query.Name, algorithm, tier.Priority, tier.Algorithm)
+		}
+	}
+
+	for _, tier := range tiers {
+		if tier.Algorithm == "" {
+			tier.Algorithm = defaultAlgorithm
+		}
+	}
+
+	return tiers
+}
+
+// evalTier evaluates the policies of the tier, recording matches, timings and errors in the
+// decision. It returns whether the tier is applicable and, if so, whether it allows the request.
+func (firewall *Firewall) evalTier(ctx context.Context, tier *policyTier, input map[string]interface{}, decision *Decision) (applicable, allowed bool, failures []string) {
+	var allows int
+	var denyActions []*Action
+
+	for _, query := range tier.Queries {
+		result, duration, err := firewall.evalPolicy(ctx, query, input)
+		if decision.PolicyDurations == nil {
+			decision.PolicyDurations = make(map[string]time.Duration)
+		}
+		decision.PolicyDurations[query.Name] = duration
+
+		if err != nil {
+			if decision.Errors == nil {
+				decision.Errors = make(map[string]string)
+			}
+			decision.Errors[query.Name] = err.Error()
+			failures = append(failures, fmt.Sprintf("%s: %v", query.Name, err))
+		}
+
+		if result.Allow {
+			decision.AllowingPackages = append(decision.AllowingPackages, query.Name)
+			allows++
+		}
+		if result.Deny {
+			// policies in dry run only report what they would have denied.
+			if query.DryRun {
+				decision.DryRunPackages = append(decision.DryRunPackages, query.Name)
+			} else {
+				decision.DenyingPackages = append(decision.DenyingPackages, query.Name)
+				denyActions = append(denyActions, result.Action)
+			}
+		}
+
+		if result.Allow || result.Deny && !query.DryRun {
+			decision.addHeaderChanges(result.Action)
+		}
+
+		if result.Reason != nil && (result.Allow || result.Deny) {
+			if decision.Reasons == nil {
+				decision.Reasons = make(map[string]interface{})
+			}
+			decision.Reasons[query.Name] = result.Reason
+		}
+
+		if tier.Algorithm == CombiningFirstApplicable && (result.Allow || result.Deny && !query.DryRun) {
+			if !result.Allow {
+				decision.Action = result.Action
+			}
+			return true, result.Allow, failures
+		}
+	}
+
+	switch tier.Algorithm {
+	case CombiningDenyOverrides:
+		allowed = len(denyActions) == 0
+	default:
+		allowed = allows > 0 || len(denyActions) == 0
+	}
+	decision.Overridden = allows > 0 && len(denyActions) > 0
+	if !allowed {
+		decision.Action = denyAction(denyActions)
+	}
+
+	return allows > 0 || len(denyActions) > 0, allowed, failures
+}
+
+// denyAction picks the action of a denied request from the actions of the denying policies, in
+// order: the first blocking action wins, then the default block response of policies without
+// an action. The request is only let through when every denying policy asks for it.
+func denyAction(actions []*Action) *Action {
+	defaultBlock := false
+	for _, action := range actions {
+		if action == nil {
+			defaultBlock = true
+			continue
+		}
+		if action.blocks() {
+			return action
+		}
+	}
+
+	if defaultBlock || len(actions) == 0 {
+		return nil
+	}
+	return actions[0]
+}
@@ -0,0 +1,258 @@
+package firewall
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// matchingPolicy is a policy whose rules, allow and/or deny, always match.
+func matchingPolicy(name string, priority int, combining string, rules ...string) PolicyEvent {
+	rego := fmt.Sprintf("package %s\n", name)
+	for _, rule := range rules {
+		rego += fmt.Sprintf("%s = true\n", rule)
+	}
+	return PolicyEvent{Name: name, Type: EventTypeFull, Rego: rego, Priority: priority, Combining: combining}
+}
+
+func TestEvaluateCombinesPolicies(t *testing.T) {
+	dryRun := matchingPolicy("a_dryrun", 10, "", "deny")
+	dryRun.DryRun = true
+
+	tests := []struct {
+		name          string
+		policies      []PolicyEvent
+		wantAllowed   bool
+		wantAlgorithm string
+		wantPriority  int
+		wantDenying   []string
+		wantAllowing  []string
+		wantEvaluated []string
+		wantOverride  bool
+	}{
+		{
+			name:          "no policy matches",
+			policies:      []PolicyEvent{matchingPolicy("idle", 0, "")},
+			wantAllowed:   true,
+			wantEvaluated: []string{"idle"},
+		},
+		{
+			name:          "allow-overrides lets an allowed request through",
+			policies:      []PolicyEvent{matchingPolicy("allower", 0, CombiningAllowOverrides, "allow"), matchingPolicy("denier", 0, "", "deny")},
+			wantAllowed:   true,
+			wantAlgorithm: CombiningAllowOverrides,
+			wantDenying:   []string{"denier"},
+			wantAllowing:  []string{"allower"},
+			wantEvaluated: []string{"allower", "denier"},
+			wantOverride:  true,
+		},
+		{
+			name:          "deny-overrides blocks a denied request",
+			policies:      []PolicyEvent{matchingPolicy("allower", 0, CombiningDenyOverrides, "allow"), matchingPolicy("denier", 0, "", "deny")},
+			wantAllowed:   false,
+			wantAlgorithm: CombiningDenyOverrides,
+			wantDenying:   []string{"denier"},
+			wantAllowing:  []string{"allower"},
+			wantEvaluated: []string{"allower", "denier"},
+			wantOverride:  true,
+		},
+		{
+			name:          "the configured algorithm combines tiers without a declaration",
+			policies:      []PolicyEvent{matchingPolicy("allower", 0, "", "allow"), matchingPolicy("denier", 0, "", "deny")},
+			wantAllowed:   true,
+			wantAlgorithm: CombiningAllowOverrides,
+			wantDenying:   []string{"denier"},
+			wantAllowing:  []string{"allower"},
+			wantEvaluated: []string{"allower", "denier"},
+			wantOverride:  true,
+		},
+		{
+			name:          "first-applicable takes the first allowing policy by name",
+			policies:      []PolicyEvent{matchingPolicy("b_denier", 0, "", "deny"), matchingPolicy("a_allower", 0, CombiningFirstApplicable, "allow")},
+			wantAllowed:   true,
+			wantAlgorithm: CombiningFirstApplicable,
+			wantAllowing:  []string{"a_allower"},
+			wantEvaluated: []string{"a_allower"},
+		},
+		{
+			name:          "first-applicable takes the first denying policy by name",
+			policies:      []PolicyEvent{matchingPolicy("a_denier", 0, "", "deny"), matchingPolicy("b_allower", 0, CombiningFirstApplicable, "allow")},
+			wantAllowed:   false,
+			wantAlgorithm: CombiningFirstApplicable,
+			wantDenying:   []string{"a_denier"},
+			wantEvaluated: []string{"a_denier"},
+		},
+		{
+			name:          "first-applicable allows a policy matching both rules",
+			policies:      []PolicyEvent{matchingPolicy("both", 0, CombiningFirstApplicable, "allow", "deny"), matchingPolicy("denier", 0, "", "deny")},
+			wantAllowed:   true,
+			wantAlgorithm: CombiningFirstApplicable,
+			wantDenying:   []string{"both"},
+			wantAllowing:  []string{"both"},
+			wantEvaluated: []string{"both"},
+		},
+		{
+			name:          "the highest priority tier decides and lower tiers are not evaluated",
+			policies:      []PolicyEvent{matchingPolicy("allower", 0, "", "allow"), matchingPolicy("denier", 10, "", "deny")},
+			wantAllowed:   false,
+			wantAlgorithm: CombiningAllowOverrides,
+			wantPriority:  10,
+			wantDenying:   []string{"denier"},
+			wantEvaluated: []string{"denier"},
+		},
+		{
+			name:          "a tier without matches falls through to the next one",
+			policies:      []PolicyEvent{matchingPolicy("denier", -5, CombiningDenyOverrides, "deny"), matchingPolicy("idle", 10, "")},
+			wantAllowed:   false,
+			wantAlgorithm: CombiningDenyOverrides,
+			wantPriority:  -5,
+			wantDenying:   []string{"denier"},
+			wantEvaluated: []string{"denier", "idle"},
+		},
+		{
+			name:          "policies in dry run don't make their tier applicable",
+			policies:      []PolicyEvent{dryRun, matchingPolicy("allower", 0, "", "allow")},
+			wantAllowed:   true,
+			wantAlgorithm: CombiningAllowOverrides,
+			wantAllowing:  []string{"allower"},
+			wantEvaluated: []string{"a_dryrun", "allower"},
+		},
+		{
+			name:          "the first policy by name declares the algorithm of the tier",
+			policies:      []PolicyEvent{matchingPolicy("b_allower", 0, CombiningAllowOverrides, "allow"), matchingPolicy("a_denier", 0, CombiningDenyOverrides, "deny")},
+			wantAllowed:   false,
+			wantAlgorithm: CombiningDenyOverrides,
+			wantDenying:   []string{"a_denier"},
+			wantAllowing:  []string{"b_allower"},
+			wantEvaluated: []string{"a_denier", "b_allower"},
+			wantOverride:  true,
+		},
+		{
+			name:          "unknown algorithms are ignored",
+			policies:      []PolicyEvent{matchingPolicy("a_allower", 0, "deny-unless-permit", "allow"), matchingPolicy("b_denier", 0, CombiningDenyOverrides, "deny")},
+			wantAllowed:   false,
+			wantAlgorithm: CombiningDenyOverrides,
+			wantDenying:   []string{"b_denier"},
+			wantAllowing:  []string{"a_allower"},
+			wantEvaluated: []string{"a_allower", "b_denier"},
+			wantOverride:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			firewall := newTestFirewall(test.policies...)
+			if prepared := firewall.Compile(); prepared != len(test.policies) {
+				t.Fatalf("Compile() = %d, want %d", prepared, len(test.policies))
+			}
+
+			decision, err := firewall.Evaluate(map[string]interface{}{"ip": "203.0.113.7"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if decision.Allowed != test.wantAllowed {
+				t.Errorf("allowed = %v, want %v", decision.Allowed, test.wantAllowed)
+			}
+			if decision.Algorithm != test.wantAlgorithm || decision.Priority != test.wantPriority {
+				t.Errorf("decided by %q at priority %d, want %q at %d", decision.Algorithm, decision.Priority, test.wantAlgorithm, test.wantPriority)
+			}
+			if !reflect.DeepEqual(decision.DenyingPackages, test.wantDenying) {
+				t.Errorf("denying packages = %v, want %v", decision.DenyingPackages, test.wantDenying)
+			}
+			if !reflect.DeepEqual(decision.AllowingPackages, test.wantAllowing) {
+				t.Errorf("allowing packages = %v, want %v", decision.AllowingPackages, test.wantAllowing)
+			}
+			if decision.Overridden != test.wantOverride {
+				t.Errorf("overridden = %v, want %v", decision.Overridden, test.wantOverride)
+			}
+
+			var evaluated []string
+			for name := range decision.PolicyDurations {
+				evaluated = append(evaluated, name)
+			}
+			if !sameNames(evaluated, test.wantEvaluated) {
+				t.Errorf("evaluated %v, want %v", evaluated, test.wantEvaluated)
+			}
+		})
+	}
+}
+
+func TestBuildPolicyTiers(t *testing.T) {
+	queries := []*policyQuery{
+		{Name: "c", Priority: 0},
+		{Name: "b", Priority: 10},
+		{Name: "a", Priority: 0},
+		{Name: "d", Priority: 10},
+	}
+	policies := map[string]PolicyEvent{
+		"b": {Combining: CombiningFirstApplicable},
+		"d": {Combining: CombiningDenyOverrides},
+	}
+
+	tiers := newTestFirewall().buildPolicyTiers(queries, policies, CombiningAllowOverrides)
+
+	var got []string
+	for _, tier := range tiers {
+		var names []string
+		for _, query := range tier.Queries {
+			names = append(names, query.Name)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s", tier.Priority, tier.Algorithm, strings.Join(names, ",")))
+	}
+
+	want := []string{
+		"10 first-applicable b,d",
+		"0 allow-overrides a,c",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tiers = %q, want %q", got, want)
+	}
+}
+
+func TestDenyAction(t *testing.T) {
+	block := &Action{Type: ActionBlock, Status: 403}
+	redirect := &Action{Type: ActionRedirect, Location: "https://www.example.com/blocked"}
+	log := &Action{Type: ActionLog}
+	headers := &Action{Type: ActionHeaders, Add: map[string]string{"X-Suspicious": "1"}}
+
+	tests := []struct {
+		name    string
+		actions []*Action
+		want    *Action
+	}{
+		{name: "no action", actions: nil, want: nil},
+		{name: "default block", actions: []*Action{nil}, want: nil},
+		{name: "first blocking action", actions: []*Action{log, redirect, block}, want: redirect},
+		{name: "blocking action over the default block", actions: []*Action{nil, block}, want: block},
+		{name: "default block over letting through", actions: []*Action{log, nil}, want: nil},
+		{name: "every policy lets through", actions: []*Action{headers, log}, want: headers},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := denyAction(test.actions); got != test.want {
+				t.Errorf("denyAction() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// sameNames tells whether both lists hold the same names in any order.
+func sameNames(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]int)
+	for _, name := range got {
+		seen[name]++
+	}
+	for _, name := range want {
+		if seen[name] == 0 {
+			return false
+		}
+		seen[name]--
+	}
+	return true
+}
@@ -0,0 +1,162 @@
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/iptree"
+)
+
+// NewConfiguration reads the firewall configuration from the FIREWALL_ environment variables,
+// see Configuration for the defaults.
+func NewConfiguration() (*Configuration, error) {
+	isEnabled, err := boolEnvironmentOrDefault("FIREWALL_ENABLED", true)
+	if err != nil {
+		return nil, err
+	}
+
+	dryRun, err := boolEnvironmentOrDefault("FIREWALL_DRY_RUN", false)
+	if err != nil {
+		return nil, err
+	}
+
+	decisionHeaders, err := boolEnvironmentOrDefault("FIREWALL_DECISION_HEADERS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	decisionLog, err := boolEnvironmentOrDefault("FIREWALL_DECISION_LOG", true)
+	if err != nil {
+		return nil, err
+	}
+
+	decisionLogSampleRate, err := floatEnvironmentOrDefault("FIREWALL_DECISION_LOG_SAMPLE_RATE", 0.01)
+	if err != nil {
+		return nil, err
+	}
+
+	redactedHeaders := defaultRedactedHeaders
+	if headers := os.Getenv("FIREWALL_DECISION_LOG_REDACTED_HEADERS"); headers != "" {
+		redactedHeaders = nil
+		for _, header := range strings.Split(headers, ",") {
+			redactedHeaders = append(redactedHeaders, strings.ToLower(strings.TrimSpace(header)))
+		}
+	}
+
+	var trustedProxies []*net.IPNet
+	if proxies := os.Getenv("FIREWALL_TRUSTED_PROXIES"); proxies != "" {
+		for _, proxy := range strings.Split(proxies, ",") {
+			network, err := iptree.ParseNetwork(strings.TrimSpace(proxy))
+			if err != nil {
+				return nil, err
+			}
+			trustedProxies = append(trustedProxies, network)
+		}
+	}
+
+	clientIPHeader := defaultClientIPHeader
+	if header := os.Getenv("FIREWALL_CLIENT_IP_HEADER"); header != "" {
+		clientIPHeader = strings.ToLower(strings.TrimSpace(header))
+	}
+
+	var bodyInspection []BodyInspectionRule
+	if rules := os.Getenv("FIREWALL_BODY_INSPECTION"); rules != "" {
+		for _, entry := range strings.Split(rules, ",") {
+			rule, err := ParseBodyInspectionRule(strings.TrimSpace(entry))
+			if err != nil {
+				return nil, err
+			}
+			bodyInspection = append(bodyInspection, rule)
+		}
+	}
+
+	bodyMaxSize := int64(DefaultBodyMaxSize)
+	if size := os.Getenv("FIREWALL_BODY_MAX_SIZE"); size != "" {
+		bodyMaxSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	policyTimeout, err := durationEnvironmentOrDefault("FIREWALL_POLICY_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	combiningAlgorithm := CombiningAllowOverrides
+	if algorithm := os.Getenv("FIREWALL_COMBINING_ALGORITHM"); algorithm != "" {
+		if !isValidCombiningAlgorithm(algorithm) {
+			return nil, fmt.Errorf("unknown combining algorithm %s", algorithm)
+		}
+		combiningAlgorithm = algorithm
+	}
+
+	challengeDifficulty := 16
+	if difficulty := os.Getenv("FIREWALL_CHALLENGE_DIFFICULTY"); difficulty != "" {
+		challengeDifficulty, err = strconv.Atoi(difficulty)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	challengeTTL, err := durationEnvironmentOrDefault("FIREWALL_CHALLENGE_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	gcInterval, err := durationEnvironmentOrDefault("FIREWALL_GC_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	compileInterval, err := durationEnvironmentOrDefault("FIREWALL_COMPILE_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Configuration{
+		IsEnabled:                  isEnabled,
+		DryRun:                     dryRun,
+		DecisionHeaders:            decisionHeaders,
+		DecisionLog:                decisionLog,
+		DecisionLogSampleRate:      decisionLogSampleRate,
+		DecisionLogRedactedHeaders: redactedHeaders,
+		TrustedProxies:             trustedProxies,
+		ClientIPHeader:             clientIPHeader,
+		JA3Header:                  strings.ToLower(os.Getenv("FIREWALL_JA3_HEADER")),
+		BodyInspection:             bodyInspection,
+		BodyMaxSize:                bodyMaxSize,
+		PolicyTimeout:              policyTimeout,
+		CombiningAlgorithm:         combiningAlgorithm,
+		ChallengeSecret:            os.Getenv("FIREWALL_CHALLENGE_SECRET"),
+		ChallengeDifficulty:        challengeDifficulty,
+		ChallengeTTL:               challengeTTL,
+		GCInterval:                 gcInterval,
+		CompileInterval:            compileInterval,
+	}, nil
+}
+
+func boolEnvironmentOrDefault(environmentName string, defaultValue bool) (bool, error) {
+	if os.Getenv(environmentName) == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseBool(os.Getenv(environmentName))
+}
+
+func floatEnvironmentOrDefault(environmentName string, defaultValue float64) (float64, error) {
+	if os.Getenv(environmentName) == "" {
+		return defaultValue, nil
+	}
+	return strconv.ParseFloat(os.Getenv(environmentName), 64)
+}
+
+func durationEnvironmentOrDefault(environmentName string, defaultValue time.Duration) (time.Duration, error) {
+	if os.Getenv(environmentName) == "" {
+		return defaultValue, nil
+	}
+	return time.ParseDuration(os.Getenv(environmentName))
+}
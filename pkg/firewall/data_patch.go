@@ -0,0 +1,38 @@
+package firewall
+
+import (
+	"github.com/cainelli/opa-firewall/pkg/jsonpatch"
+)
+
+// patchData returns the policy data with the patches of the event applied: its Data as a
+// JSON Merge Patch first, then its DataPatch operations.
+func patchData(data interface{}, policyEvent *PolicyEvent) (interface{}, error) {
+	patched, err := jsonpatch.Normalize(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if policyEvent.Data != nil {
+		mergePatch, err := jsonpatch.Normalize(policyEvent.Data)
+		if err != nil {
+			return nil, err
+		}
+		patched = jsonpatch.MergePatch(patched, mergePatch)
+	}
+
+	if len(policyEvent.DataPatch) > 0 {
+		operations := make([]jsonpatch.Operation, len(policyEvent.DataPatch))
+		for i, operation := range policyEvent.DataPatch {
+			// values decoded from yaml may not be json types yet.
+			if operation.Value, err = jsonpatch.Normalize(operation.Value); err != nil {
+				return nil, err
+			}
+			operations[i] = operation
+		}
+		if patched, err = jsonpatch.Apply(patched, operations); err != nil {
+			return nil, err
+		}
+	}
+
+	return patched, nil
+}
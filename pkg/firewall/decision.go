@@ -0,0 +1,62 @@
+package firewall
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DecisionAllow ...
+	DecisionAllow = "allow"
+	// DecisionDeny ...
+	DecisionDeny = "deny"
+	// DecisionDryRunDeny is a deny which is only reported.
+	DecisionDryRunDeny = "dryrun-deny"
+)
+
+const (
+	// HeaderDecision holds allow, deny or dryrun-deny.
+	HeaderDecision = "X-Firewall-Decision"
+	// HeaderDeniedBy holds the comma separated packages denying the request.
+	HeaderDeniedBy = "X-Firewall-Denied-By"
+	// HeaderAllowedBy holds the comma separated packages allowing the request.
+	HeaderAllowedBy = "X-Firewall-Allowed-By"
+)
+
+// String returns allow, deny or dryrun-deny.
+func (decision Decision) String() string {
+	switch {
+	case !decision.Allowed && !decision.DryRun:
+		return DecisionDeny
+	case !decision.Allowed, len(decision.DryRunPackages) > 0 && len(decision.AllowingPackages) == 0:
+		return DecisionDryRunDeny
+	default:
+		return DecisionAllow
+	}
+}
+
+// LogFields returns the decision as logrus fields.
+func (decision Decision) LogFields() logrus.Fields {
+	return logrus.Fields{
+		"decision":          decision.String(),
+		"overridden":        decision.Overridden,
+		"denying_packages":  decision.DenyingPackages,
+		"allowing_packages": decision.AllowingPackages,
+		"dryrun_packages":   decision.DryRunPackages,
+		"reasons":           interfaceToString(decision.Reasons),
+		"duration":          decision.Duration.String(),
+	}
+}
+
+// SetHeaders adds the decision to the given headers.
+func (decision Decision) SetHeaders(header http.Header) {
+	header.Set(HeaderDecision, decision.String())
+	if len(decision.DenyingPackages) > 0 {
+		header.Set(HeaderDeniedBy, strings.Join(decision.DenyingPackages, ","))
+	}
+	if len(decision.AllowingPackages) > 0 {
+		header.Set(HeaderAllowedBy, strings.Join(decision.AllowingPackages, ","))
+	}
+}
@@ -0,0 +1,135 @@
+package firewall
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestEvaluateDecision(t *testing.T) {
+	firewall := newTestFirewall(
+		PolicyEvent{
+			Name: "nouseragent",
+			Type: EventTypeFull,
+			Rego: "package nouseragent\n\ndeny {\n  not input.headers[\"user-agent\"]\n}\n\nreason = \"missing user agent\" {\n  deny\n}\n",
+		},
+		PolicyEvent{
+			Name: "scanners",
+			Type: EventTypeFull,
+			Rego: "package scanners\n\ndeny[msg] {\n  input.path == \"/wp-login.php\"\n  msg := sprintf(\"scanned %s\", [input.path])\n}\n",
+		},
+		PolicyEvent{
+			Name: "office",
+			Type: EventTypeFull,
+			Rego: "package office\n\nallow {\n  input.ip == \"192.0.2.1\"\n}\n",
+		},
+	)
+	firewall.Compile()
+
+	decision, err := firewall.Evaluate(map[string]interface{}{"ip": "203.0.113.7", "path": "/wp-login.php", "headers": map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decision.Allowed || decision.String() != DecisionDeny || decision.Overridden {
+		t.Errorf("decision = %s, overridden = %v, want a deny", decision, decision.Overridden)
+	}
+	if want := []string{"nouseragent", "scanners"}; !reflect.DeepEqual(decision.DenyingPackages, want) {
+		t.Errorf("denying packages = %v, want %v", decision.DenyingPackages, want)
+	}
+	if len(decision.AllowingPackages) != 0 {
+		t.Errorf("allowing packages = %v, want none", decision.AllowingPackages)
+	}
+	wantReasons := map[string]interface{}{
+		"nouseragent": "missing user agent",
+		"scanners":    []interface{}{"scanned /wp-login.php"},
+	}
+	if !reflect.DeepEqual(decision.Reasons, wantReasons) {
+		t.Errorf("reasons = %v, want %v", decision.Reasons, wantReasons)
+	}
+	if decision.Duration <= 0 || len(decision.PolicyDurations) != 3 {
+		t.Errorf("duration = %s, policy durations = %v, want the time spent on each policy", decision.Duration, decision.PolicyDurations)
+	}
+	if decision.Revision != firewall.currentSnapshot().Revision {
+		t.Errorf("revision = %d, want %d", decision.Revision, firewall.currentSnapshot().Revision)
+	}
+
+	decision, err = firewall.Evaluate(map[string]interface{}{"ip": "192.0.2.1", "path": "/", "headers": map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allowed || !decision.Overridden || decision.String() != DecisionAllow {
+		t.Errorf("decision = %s, overridden = %v, want an allow overriding the deny", decision, decision.Overridden)
+	}
+	if want := []string{"office"}; !reflect.DeepEqual(decision.AllowingPackages, want) {
+		t.Errorf("allowing packages = %v, want %v", decision.AllowingPackages, want)
+	}
+	if _, ok := decision.Reasons["office"]; ok {
+		t.Errorf("reasons = %v, want none for a package without a reason rule", decision.Reasons)
+	}
+}
+
+func TestEvaluateReportsFailingPolicies(t *testing.T) {
+	firewall := newTestFirewall(
+		PolicyEvent{Name: "broken", Type: EventTypeFull, Rego: "package broken\n\ndeny = input.headers\n"},
+		PolicyEvent{Name: "blocker", Type: EventTypeFull, Rego: "package blocker\n\ndeny = true\n"},
+	)
+	firewall.Compile()
+
+	decision, err := firewall.Evaluate(map[string]interface{}{"headers": map[string]interface{}{}})
+	if err == nil {
+		t.Error("Evaluate() didn't report the failing policy")
+	}
+	if _, ok := decision.Errors["broken"]; !ok || len(decision.Errors) != 1 {
+		t.Errorf("errors = %v, want the one of broken", decision.Errors)
+	}
+	if decision.Allowed || !reflect.DeepEqual(decision.DenyingPackages, []string{"blocker"}) {
+		t.Errorf("decision = %s by %v, the other policies must still decide", decision, decision.DenyingPackages)
+	}
+}
+
+func TestDecisionString(t *testing.T) {
+	tests := []struct {
+		name     string
+		decision Decision
+		want     string
+	}{
+		{name: "allowed", decision: Decision{Allowed: true}, want: DecisionAllow},
+		{name: "denied", decision: Decision{}, want: DecisionDeny},
+		{name: "denied in dry run", decision: Decision{DryRun: true}, want: DecisionDryRunDeny},
+		{name: "policy in dry run", decision: Decision{Allowed: true, DryRunPackages: []string{"blocker"}}, want: DecisionDryRunDeny},
+		{
+			name:     "policy in dry run allowed by another",
+			decision: Decision{Allowed: true, DryRunPackages: []string{"blocker"}, AllowingPackages: []string{"office"}},
+			want:     DecisionAllow,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.decision.String(); got != test.want {
+				t.Errorf("String() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecisionSetHeaders(t *testing.T) {
+	header := http.Header{}
+	Decision{DenyingPackages: []string{"nouseragent", "scanners"}, AllowingPackages: []string{"office"}}.SetHeaders(header)
+
+	want := http.Header{
+		HeaderDecision:  {DecisionDeny},
+		HeaderDeniedBy:  {"nouseragent,scanners"},
+		HeaderAllowedBy: {"office"},
+	}
+	if !reflect.DeepEqual(header, want) {
+		t.Errorf("headers = %v, want %v", header, want)
+	}
+
+	header = http.Header{}
+	Decision{Allowed: true}.SetHeaders(header)
+	if want := (http.Header{HeaderDecision: {DecisionAllow}}); !reflect.DeepEqual(header, want) {
+		t.Errorf("headers = %v, want %v", header, want)
+	}
+}
@@ -0,0 +1,107 @@
+package firewall
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/stream"
+)
+
+const (
+	// decisionLogBufferSize is the number of decision events waiting to be produced
+	// before new ones are dropped.
+	decisionLogBufferSize = 10000
+	decisionLogLingerMs   = 500
+	// redactedValue replaces the values left out of the decision log.
+	redactedValue = "[redacted]"
+)
+
+// defaultRedactedHeaders carry credentials.
+var defaultRedactedHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key"}
+
+// decisionProducer ships the encoded decision events, it is a stream.BatchProducer outside
+// of the tests.
+type decisionProducer interface {
+	Produce(key, value []byte) error
+}
+
+// startDecisionLog creates the producer and the goroutine shipping decision events.
+func (firewall *Firewall) startDecisionLog() error {
+	producer, err := stream.NewBatchProducer(EventsTopicName, decisionLogLingerMs, func(err error) {
+		firewall.Logger.Errorf("decision log: %v", err)
+	})
+	if err != nil {
+		return err
+	}
+
+	firewall.decisionEvents = make(chan DecisionEvent, decisionLogBufferSize)
+	go firewall.produceDecisionsForever(producer)
+
+	return nil
+}
+
+// logDecision queues the decision to be sent to the events topic. Denies are always
+// logged, allowed requests are sampled. It never blocks the request.
+func (firewall *Firewall) logDecision(input map[string]interface{}, decision Decision) {
+	if firewall.decisionEvents == nil {
+		return
+	}
+
+	if decision.String() == DecisionAllow && rand.Float64() >= firewall.Configuration.DecisionLogSampleRate {
+		return
+	}
+
+	select {
+	case firewall.decisionEvents <- DecisionEvent{Time: time.Now(), Input: firewall.Configuration.redactInput(input), Decision: decision}:
+	default:
+		firewall.Logger.Warn("decision log buffer is full, dropping decision event")
+	}
+}
+
+// redactInput returns a copy of the input without the body, with the cookie values and the
+// values of the redacted headers replaced. The input itself is left untouched.
+func (configuration *Configuration) redactInput(input map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(input))
+	for key, value := range input {
+		redacted[key] = value
+	}
+	delete(redacted, "body")
+
+	if cookies, ok := input["cookies"].(map[string]string); ok {
+		redactedCookies := make(map[string]string, len(cookies))
+		for name := range cookies {
+			redactedCookies[name] = redactedValue
+		}
+		redacted["cookies"] = redactedCookies
+	}
+
+	if headers, ok := input["headers"].(map[string][]string); ok {
+		redactedHeaders := make(map[string][]string, len(headers))
+		for name, values := range headers {
+			redactedHeaders[name] = values
+		}
+		for _, name := range configuration.DecisionLogRedactedHeaders {
+			if _, ok := redactedHeaders[name]; ok {
+				redactedHeaders[name] = []string{redactedValue}
+			}
+		}
+		redacted["headers"] = redactedHeaders
+	}
+
+	return redacted
+}
+
+func (firewall *Firewall) produceDecisionsForever(producer decisionProducer) {
+	for decisionEvent := range firewall.decisionEvents {
+		decisionEventBytes, err := json.Marshal(decisionEvent)
+		if err != nil {
+			firewall.Logger.Error(err)
+			continue
+		}
+
+		if err := producer.Produce(nil, decisionEventBytes); err != nil {
+			firewall.Logger.Errorf("decision log: %v", err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package firewall
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingProducer keeps the produced values.
+type recordingProducer struct {
+	values [][]byte
+}
+
+func (producer *recordingProducer) Produce(key, value []byte) error {
+	producer.values = append(producer.values, value)
+	return nil
+}
+
+func TestLogDecisionSampling(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate float64
+		decision   Decision
+		want       int
+	}{
+		{name: "allow never sampled", sampleRate: 0, decision: Decision{Allowed: true}, want: 0},
+		{name: "allow always sampled", sampleRate: 1, decision: Decision{Allowed: true}, want: 1},
+		{name: "deny", sampleRate: 0, decision: Decision{DenyingPackages: []string{"blocker"}}, want: 1},
+		{name: "dry run deny", sampleRate: 0, decision: Decision{DryRun: true, DenyingPackages: []string{"blocker"}}, want: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			firewall := newTestFirewall()
+			firewall.Configuration.DecisionLogSampleRate = test.sampleRate
+			firewall.decisionEvents = make(chan DecisionEvent, 10)
+
+			for i := 0; i < 5; i++ {
+				firewall.logDecision(map[string]interface{}{"ip": "203.0.113.7"}, test.decision)
+			}
+
+			if got := len(firewall.decisionEvents); got != test.want*5 {
+				t.Errorf("logged %d decisions out of 5, want %d", got, test.want*5)
+			}
+		})
+	}
+}
+
+func TestLogDecisionWithoutDecisionLog(t *testing.T) {
+	firewall := newTestFirewall()
+	firewall.Configuration.DecisionLogSampleRate = 1
+
+	// the decision log is disabled, logging must neither block nor panic.
+	firewall.logDecision(map[string]interface{}{"ip": "203.0.113.7"}, Decision{})
+}
+
+func TestRedactInput(t *testing.T) {
+	configuration := &Configuration{DecisionLogRedactedHeaders: []string{"authorization", "cookie"}}
+	input := map[string]interface{}{
+		"ip":   "203.0.113.7",
+		"body": map[string]interface{}{"password": "hunter2"},
+		"headers": map[string][]string{
+			"authorization": {"Bearer a1b2c3"},
+			"cookie":        {"session=d4e5f6"},
+			"user-agent":    {"curl/7.64.1"},
+		},
+		"cookies": map[string]string{"session": "d4e5f6"},
+	}
+
+	redacted := configuration.redactInput(input)
+
+	want := map[string]interface{}{
+		"ip": "203.0.113.7",
+		"headers": map[string][]string{
+			"authorization": {redactedValue},
+			"cookie":        {redactedValue},
+			"user-agent":    {"curl/7.64.1"},
+		},
+		"cookies": map[string]string{"session": redactedValue},
+	}
+	if !reflect.DeepEqual(redacted, want) {
+		t.Errorf("redactInput() = %v, want %v", redacted, want)
+	}
+
+	// policies and the block response still read the original input.
+	if input["headers"].(map[string][]string)["authorization"][0] != "Bearer a1b2c3" ||
+		input["cookies"].(map[string]string)["session"] != "d4e5f6" || input["body"] == nil {
+		t.Errorf("redactInput() changed the input: %v", input)
+	}
+}
+
+func TestDecisionLogLeavesOutSecrets(t *testing.T) {
+	firewall := newTestFirewall(PolicyEvent{Name: "blocker", Type: EventTypeFull, Rego: "package blocker\ndeny = true\n"})
+	firewall.Configuration.DecisionLogRedactedHeaders = defaultRedactedHeaders
+	firewall.Configuration.BodyInspection = []BodyInspectionRule{{Host: "*", PathPrefix: "/login"}}
+	firewall.Configuration.BodyMaxSize = 1024
+	firewall.decisionEvents = make(chan DecisionEvent, 1)
+	firewall.Compile()
+
+	request := httptest.NewRequest(http.MethodPost, "http://www.example.com/login", strings.NewReader(`{"password": "secret-password"}`))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer secret-token")
+	request.Header.Set("X-Api-Key", "secret-api-key")
+	request.Header.Set("Cookie", "session=secret-session")
+	request.Header.Set("User-Agent", "curl/7.64.1")
+
+	firewall.Decide(firewall.RequestInput(request))
+	close(firewall.decisionEvents)
+
+	producer := &recordingProducer{}
+	firewall.produceDecisionsForever(producer)
+
+	if len(producer.values) != 1 {
+		t.Fatalf("produced %d decision events, want 1", len(producer.values))
+	}
+	value := producer.values[0]
+	if bytes.Contains(value, []byte("secret")) {
+		t.Errorf("decision event leaks a secret: %s", value)
+	}
+
+	var decisionEvent struct {
+		Input map[string]interface{}
+	}
+	if err := json.Unmarshal(value, &decisionEvent); err != nil {
+		t.Fatal(err)
+	}
+	if decisionEvent.Input["path"] != "/login" || !bytes.Contains(value, []byte("curl/7.64.1")) {
+		t.Errorf("decision event = %s, want the rest of the input", value)
+	}
+}
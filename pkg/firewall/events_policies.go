@@ -3,12 +3,13 @@ package firewall
 import (
 	"encoding/json"
 	"fmt"
-	"net"
+	"sync/atomic"
 	"time"
 
+	"github.com/cainelli/opa-firewall/pkg/iptree"
+	"github.com/cainelli/opa-firewall/pkg/jsonpatch"
 	"github.com/cainelli/opa-firewall/pkg/stream"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/open-policy-agent/opa/ast"
 )
 
 // ConsumePolicies ...
@@ -26,72 +27,314 @@ func (firewall *Firewall) consumePoliciesForever() {
 		msg, err := consumer.ReadMessage(-1)
 
 		if err == nil {
-			policyEvent, err := unmarshalPolicyEvent(msg)
+			firewall.handlePolicyEvent(msg)
+		} else {
+			firewall.Logger.Error(err)
+		}
+
+		lag, err := consumerLag(consumer)
+		if err != nil {
+			firewall.Logger.Error(err)
+			continue
+		}
+		atomic.StoreInt64(&firewall.PoliciesBacklog, int64(lag))
+		atomic.StoreInt32(&firewall.startedConsuming, 1)
+
+		firewall.Logger.Infof("finished consuming policies (current lag %d) (took %s)", lag, time.Since(start))
+	}
+
+}
+
+// handlePolicyEvent applies a policy event, invalid events are logged and skipped.
+func (firewall *Firewall) handlePolicyEvent(msg *kafka.Message) {
+	policyEvent, err := unmarshalPolicyEvent(msg)
+	if err != nil {
+		firewall.Logger.Error(err)
+		return
+	}
+	firewall.Logger.Infof("policy event %s type %s", policyEvent.Name, policyEvent.Type)
+
+	if err := isValidPolicy(policyEvent, policyEvent.Type); err != nil {
+		firewall.Logger.Error(err)
+		return
+	}
+
+	switch policyEvent.Type {
+	case EventTypeFull:
+		firewall.replacePolicy(policyEvent)
+	case EventTypePatch:
+		firewall.patchPolicy(policyEvent)
+	case EventTypeDelete:
+		firewall.deletePolicy(policyEvent)
+	}
+}
+
+// replacePolicy publishes a snapshot with the policy, its ip trees and its data replaced. A
+// compile is requested when the policy changed what is compiled, the new rego takes effect then.
+// Policies whose rego doesn't compile are quarantined and the current version is kept, see
+// Compile for the rego failing only once prepared.
+func (firewall *Firewall) replacePolicy(policyEvent *PolicyEvent) {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	current := firewall.currentSnapshot()
+	next := current.clone()
+
+	if err := validateRego(policyEvent.Name, policyEvent.Rego); err != nil {
+		firewall.Logger.Errorf("(quarantined) invalid rego for policy %s, the last known good version keeps serving: %v", policyEvent.Name, err)
+		next.Quarantined[policyEvent.Name] = QuarantinedPolicy{Policy: *policyEvent, Error: err.Error(), Time: time.Now()}
+		firewall.publish(next)
+		return
+	}
+
+	// the version serving is kept until the new rego is compiled, in case it fails to.
+	if previous, ok := current.Policies[policyEvent.Name]; ok && previous.Rego != policyEvent.Rego {
+		if _, pending := next.Replaced[policyEvent.Name]; !pending {
+			next.Replaced[policyEvent.Name] = previous
+		}
+	}
+
+	if err := firewall.applyPolicy(next, *policyEvent, PolicySourceStream); err != nil {
+		firewall.Logger.Errorf("(skipping) could not replace policy %s: %v", policyEvent.Name, err)
+		return
+	}
+	// the rego serving must not read the data of the new version, it is published with its query.
+	if replaced, pending := next.Replaced[policyEvent.Name]; pending {
+		next.setData(policyEvent.Name, replaced.Data)
+	}
+	delete(next.Quarantined, policyEvent.Name)
+	firewall.publish(next)
+
+	if compilationChanged(current.Policies[policyEvent.Name], *policyEvent) {
+		firewall.requestCompile()
+	}
+}
+
+// applyPolicy places the policy, its ip trees and its data in the snapshot.
+func (firewall *Firewall) applyPolicy(state *snapshot, policy PolicyEvent, source string) error {
+	// the store reads json documents only.
+	data, err := jsonpatch.Normalize(policy.Data)
+	if err != nil {
+		return err
+	}
+	policy.Data = data
+	state.setData(policy.Name, data)
+
+	policy.IPBuckets = firewall.canonicalIPBuckets(policy, state.Policies[policy.Name].IPBuckets, state.Tombstones[policy.Name])
+	state.Policies[policy.Name] = policy
+	state.IPTrees[policy.Name] = firewall.buildIPTrees(policy)
+	state.Metadata[policy.Name] = firewall.nextMetadata(source)
+	return nil
+}
+
+// canonicalIPBuckets returns the ip buckets of the policy keyed by the canonical form of their
+// networks, so patches find every entry by a single key. Invalid networks are dropped and of
+// the entries sharing a network the one expiring last is kept. Entries removed by a tombstone
+// are dropped as well unless they expire after the removed one, which makes them a new entry.
+// The entries are merged with the previous ones, see mergeIPEntry, so the hits tracked by the
+// patches survive the FULL events.
+func (firewall *Firewall) canonicalIPBuckets(policy PolicyEvent, previous, tombstones IPBuckets) IPBuckets {
+	if policy.IPBuckets == nil {
+		return nil
+	}
+
+	ipBuckets := make(IPBuckets, len(policy.IPBuckets))
+	for bucketName, bucket := range policy.IPBuckets {
+		ipBucket := make(IPBucket, len(bucket))
+		for ipString, entry := range bucket {
+			network, err := iptree.ParseNetwork(ipString)
+			if err != nil {
+				firewall.Logger.Errorf("(skipping) ip bucket entry of %s[%s]: %v", policy.Name, bucketName, err)
+				continue
+			}
+
+			key := network.String()
+			if tombstone, ok := tombstones[bucketName][key]; ok && !entry.ExpireAt.After(tombstone.ExpireAt) {
+				firewall.Logger.Infof("(tombstone) skipping network %s of %s[%s]", key, policy.Name, bucketName)
+				continue
+			}
+			if previous, ok := ipBucket[key]; ok && previous.ExpireAt.After(entry.ExpireAt) {
+				continue
+			}
+			ipBucket[key] = entry
+		}
+
+		for key, entry := range ipBucket {
+			ipBucket[key] = mergeIPEntry(previous[bucketName][key], entry)
+		}
+		ipBuckets[bucketName] = ipBucket
+	}
+	return ipBuckets
+}
+
+// compilationChanged tells whether the query or the tier of the policy must be compiled again.
+func compilationChanged(previous, policy PolicyEvent) bool {
+	return previous.Rego != policy.Rego ||
+		previous.Priority != policy.Priority ||
+		previous.DryRun != policy.DryRun ||
+		previous.Combining != policy.Combining
+}
+
+// patchPolicy publishes a snapshot with the ip bucket entries of the event added to
+// both the policy and its ip trees, and the data patches applied to both the policy and
+// the snapshot data. Patches don't need a recompilation.
+func (firewall *Firewall) patchPolicy(policyEvent *PolicyEvent) {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	current := firewall.currentSnapshot()
+	policy, ok := current.Policies[policyEvent.Name]
+	if !ok {
+		firewall.Logger.Infof("(skipping) no policy found for patch of %s", policyEvent.Name)
+		return
+	}
+
+	if policyEvent.Data != nil || len(policyEvent.DataPatch) > 0 {
+		data, err := patchData(policy.Data, policyEvent)
+		if err != nil {
+			firewall.Logger.Errorf("(skipping) could not patch data of %s: %v", policyEvent.Name, err)
+			return
+		}
+
+		firewall.Logger.Infof("(patching) data of %s", policyEvent.Name)
+		policy.Data = data
+	}
+
+	next := current.clone()
+	// the data of a version waiting to be compiled is published with its query.
+	if _, pending := current.Replaced[policyEvent.Name]; !pending {
+		next.setData(policyEvent.Name, policy.Data)
+	}
+	ipBuckets := make(IPBuckets, len(policy.IPBuckets))
+	for bucketName, bucket := range policy.IPBuckets {
+		ipBuckets[bucketName] = bucket
+	}
+
+	// updates iptree
+	for bucketName, bucket := range policyEvent.IPBuckets {
+		ipTree := next.getIPTreeCopyOrNew(policyEvent.Name, bucketName)
+
+		ipBucket := make(IPBucket, len(ipBuckets[bucketName])+len(bucket))
+		for ipString, entry := range ipBuckets[bucketName] {
+			ipBucket[ipString] = entry
+		}
+		ipBuckets[bucketName] = ipBucket
+
+		for ipString, entry := range bucket {
+			network, err := iptree.ParseNetwork(ipString)
 			if err != nil {
 				firewall.Logger.Error(err)
-				return
+				continue
 			}
-			firewall.Logger.Infof("policy event %s type %s", policyEvent.Name, policyEvent.Type)
+			// buckets are keyed by the canonical network, "10.0.0.1" and "10.0.0.1/32" are the same entry.
+			key := network.String()
 
-			switch policyEvent.Type {
-			case EventTypeFull:
-				if err := isValidPolicy(policyEvent, EventTypeFull); err != nil {
-					firewall.Logger.Error(err)
-					return
+			// an entry without expiration is a tombstone, the network is removed right away and
+			// the removed entry is remembered until it expires, see canonicalIPBuckets.
+			if entry.ExpireAt.IsZero() {
+				if removed, ok := ipBucket[key]; ok {
+					next.addTombstone(policyEvent.Name, bucketName, key, removed)
 				}
-				// TODO: mutex to avoid race conditions
-				firewall.Policies[policyEvent.Name] = *policyEvent
-			case EventTypePatch:
-				if err := isValidPolicy(policyEvent, EventTypePatch); err != nil {
+				delete(ipBucket, key)
+				if _, err := ipTree.Delete(network); err != nil {
 					firewall.Logger.Error(err)
-					return
 				}
+				firewall.Logger.Infof("(patching) removing network %s from iptree[%s][%s]", network, policyEvent.Name, bucketName)
+				continue
+			}
+			if time.Now().After(entry.ExpireAt) {
+				firewall.Logger.Infof("(expired entry) network %s to iptree[%s][%s] expiring at: %v", network, policyEvent.Name, bucketName, entry.ExpireAt)
+				continue
+			}
 
-				// TODO: patch store if data policy.Data changes
-				if _, ok := firewall.Policies[policyEvent.Name]; !ok {
-					firewall.Logger.Infof("(skipping) no policy found for patch of %s", policyEvent.Name)
-					return
-				}
-				// updates iptree
-				for bucketName, bucket := range policyEvent.IPBuckets {
-					ipTree := firewall.getIPTreeOrNew(policyEvent.Name, bucketName)
-
-					for ipString, expireAt := range bucket {
-						ip := net.ParseIP(ipString)
-						if time.Now().After(expireAt) {
-							firewall.Logger.Infof("(expired entry) ip %s to iptree[%s][%s] expiring at: %v", ip, policyEvent.Name, bucketName, expireAt)
-							continue
-						}
-
-						// TODO: safe add this entry
-						firewall.Policies[policyEvent.Name].IPBuckets[bucketName][ipString] = expireAt
-
-						firewall.Logger.Infof("(patching) adding ip %s to iptree[%s][%s] expiring at: %v", ip, policyEvent.Name, bucketName, expireAt)
-						err := ipTree.AddIP(ip, expireAt)
-						if err != nil {
-							firewall.Logger.Error(err)
-							continue
-						}
-					}
-				}
-			default:
-				firewall.Logger.Errorf("%s event type not implemented", policyEvent.Type)
+			entry = mergeIPEntry(ipBucket[key], entry)
+			ipBucket[key] = entry
+
+			firewall.Logger.Infof("(patching) adding network %s to iptree[%s][%s] expiring at: %v", network, policyEvent.Name, bucketName, entry.ExpireAt)
+			err = ipTree.AddCIDR(network, entry)
+			if err != nil {
+				firewall.Logger.Error(err)
+				continue
 			}
-		} else {
-			firewall.Logger.Error(err)
 		}
+	}
 
-		lag, err := consumerLag(consumer)
-		if err != nil {
-			firewall.Logger.Error(err)
-			continue
+	policy.IPBuckets = ipBuckets
+	next.Policies[policyEvent.Name] = policy
+	next.Metadata[policyEvent.Name] = firewall.nextMetadata(current.Metadata[policyEvent.Name].Source)
+
+	firewall.publish(next)
+}
+
+// mergeIPEntry returns the patched entry of a network. Entries carrying metadata are tracked
+// here: the first patch creates them with one hit, every patch adding them again keeps their
+// creation time and counts one more hit. The same entry sent again, with the same expiration,
+// is not a new offence and keeps its hits, FULL events repeat the entries of the buckets.
+// Sources should leave created_at and hits out of their patches unless they count the hits
+// themselves.
+func mergeIPEntry(previous, patched IPEntry) IPEntry {
+	if !patched.HasMetadata() {
+		return patched
+	}
+
+	if patched.CreatedAt.IsZero() {
+		patched.CreatedAt = previous.CreatedAt
+		if patched.CreatedAt.IsZero() {
+			patched.CreatedAt = time.Now()
 		}
-		firewall.PoliciesBacklog = lag
-		firewall.startedConsuming = true
+	}
 
-		firewall.Logger.Infof("finished consuming policies (current lag %d) (took %s)", lag, time.Since(start))
+	if patched.Hits == 0 {
+		patched.Hits = 1
+		if !previous.ExpireAt.IsZero() {
+			// entries added before their hits were tracked offended at least once.
+			hits := previous.Hits
+			if hits == 0 {
+				hits = 1
+			}
+			patched.Hits = hits
+			if !patched.ExpireAt.Equal(previous.ExpireAt) {
+				patched.Hits++
+			}
+		}
+	}
+	return patched
+}
+
+// deletePolicy publishes a snapshot without the policy, its ip trees and its data. Its
+// compiled query is left out of the tiers so it stops serving without a recompilation.
+func (firewall *Firewall) deletePolicy(policyEvent *PolicyEvent) {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	current := firewall.currentSnapshot()
+	_, found := current.Policies[policyEvent.Name]
+	if _, quarantined := current.Quarantined[policyEvent.Name]; !found && !quarantined {
+		firewall.Logger.Infof("(skipping) no policy found for delete of %s", policyEvent.Name)
+		return
 	}
 
+	next := current.clone()
+	delete(next.Policies, policyEvent.Name)
+	delete(next.Data, policyEvent.Name)
+	delete(next.IPTrees, policyEvent.Name)
+	delete(next.Quarantined, policyEvent.Name)
+	delete(next.Replaced, policyEvent.Name)
+	delete(next.Metadata, policyEvent.Name)
+	delete(next.Tombstones, policyEvent.Name)
+
+	var queries []*policyQuery
+	for _, tier := range current.Tiers {
+		for _, query := range tier.Queries {
+			if query.Name != policyEvent.Name {
+				queries = append(queries, query)
+			}
+		}
+	}
+	next.Tiers = firewall.buildPolicyTiers(queries, next.Policies, firewall.Configuration.CombiningAlgorithm)
+
+	firewall.Logger.Infof("deleted policy %s", policyEvent.Name)
+	firewall.publish(next)
 }
 
 func unmarshalPolicyEvent(event *kafka.Message) (*PolicyEvent, error) {
@@ -101,14 +344,6 @@ func unmarshalPolicyEvent(event *kafka.Message) (*PolicyEvent, error) {
 	return policyEvent, err
 }
 
-// testRego validates if the rego string from event is valid
-// TODO: fix custom built in function errors
-func testRego(rego string) error {
-	_, err := ast.CompileModules(map[string]string{"firewall": rego})
-
-	return err
-}
-
 func isValidPolicy(policyEvent *PolicyEvent, policyType string) error {
 	if policyEvent.Name == "" {
 		return fmt.Errorf("missing policy name")
@@ -123,11 +358,15 @@ func isValidPolicy(policyEvent *PolicyEvent, policyType string) error {
 		if policyEvent.Rego == "" {
 			return fmt.Errorf("rego is missing for policy %s", policyEvent.Name)
 		}
+		if !isValidCombiningAlgorithm(policyEvent.Combining) {
+			return fmt.Errorf("unknown combining algorithm %s for policy %s", policyEvent.Combining, policyEvent.Name)
+		}
 
 	case EventTypePatch:
-		if policyEvent.Data == nil && policyEvent.IPBuckets == nil {
-			return fmt.Errorf("data or ipbuckets missing for policy %s", policyEvent.Name)
+		if policyEvent.Data == nil && policyEvent.DataPatch == nil && policyEvent.IPBuckets == nil {
+			return fmt.Errorf("data, data_patch or ipbuckets missing for policy %s", policyEvent.Name)
 		}
+	case EventTypeDelete:
 	default:
 		return fmt.Errorf("unknown policy type %s", policyType)
 	}
@@ -0,0 +1,292 @@
+package firewall
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestFirewall(policies ...PolicyEvent) *Firewall {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	firewall := &Firewall{
+		Configuration:   &Configuration{IsEnabled: true, CombiningAlgorithm: CombiningAllowOverrides},
+		Logger:          logger,
+		context:         context.Background(),
+		compileRequests: make(chan struct{}, 1),
+	}
+	firewall.store = newSnapshotStore(firewall)
+
+	state := &snapshot{
+		Data:        make(map[string]interface{}),
+		IPTrees:     make(IPTrees),
+		Policies:    make(map[string]PolicyEvent),
+		Quarantined: make(map[string]QuarantinedPolicy),
+		Metadata:    make(map[string]policyMetadata),
+		Tombstones:  make(map[string]IPBuckets),
+	}
+	for _, policy := range policies {
+		if err := firewall.applyPolicy(state, policy, PolicySourceStatic); err != nil {
+			panic(err)
+		}
+	}
+	firewall.publish(state)
+
+	return firewall
+}
+
+func TestMergeIPEntry(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour)
+	later := expireAt.Add(time.Hour)
+	createdAt := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name          string
+		previous      IPEntry
+		patched       IPEntry
+		wantHits      int
+		wantCreatedAt time.Time
+	}{
+		{
+			name:     "new entry",
+			patched:  IPEntry{ExpireAt: expireAt, Reason: "no user agent"},
+			wantHits: 1,
+		},
+		{
+			name:          "repeat offender",
+			previous:      IPEntry{ExpireAt: expireAt, Reason: "no user agent", CreatedAt: createdAt, Hits: 3},
+			patched:       IPEntry{ExpireAt: later, Reason: "no user agent"},
+			wantHits:      4,
+			wantCreatedAt: createdAt,
+		},
+		{
+			name:          "same entry sent again",
+			previous:      IPEntry{ExpireAt: expireAt, Reason: "no user agent", CreatedAt: createdAt, Hits: 3},
+			patched:       IPEntry{ExpireAt: expireAt, Reason: "no user agent"},
+			wantHits:      3,
+			wantCreatedAt: createdAt,
+		},
+		{
+			name:     "entry added before the hits were tracked",
+			previous: IPEntry{ExpireAt: expireAt},
+			patched:  IPEntry{ExpireAt: later, Reason: "no user agent"},
+			wantHits: 2,
+		},
+		{
+			name:          "source counting the hits",
+			previous:      IPEntry{ExpireAt: expireAt, Reason: "no user agent", CreatedAt: createdAt, Hits: 3},
+			patched:       IPEntry{ExpireAt: expireAt, Reason: "no user agent", Hits: 10},
+			wantHits:      10,
+			wantCreatedAt: createdAt,
+		},
+		{
+			name:     "entry without metadata",
+			previous: IPEntry{ExpireAt: expireAt, Reason: "no user agent", CreatedAt: createdAt, Hits: 3},
+			patched:  IPEntry{ExpireAt: expireAt},
+			wantHits: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := mergeIPEntry(test.previous, test.patched)
+			if merged.Hits != test.wantHits {
+				t.Errorf("hits = %d, want %d", merged.Hits, test.wantHits)
+			}
+			if !merged.ExpireAt.Equal(test.patched.ExpireAt) {
+				t.Errorf("expire_at = %v, want %v", merged.ExpireAt, test.patched.ExpireAt)
+			}
+
+			switch {
+			case !test.wantCreatedAt.IsZero() && !merged.CreatedAt.Equal(test.wantCreatedAt):
+				t.Errorf("created_at = %v, want %v", merged.CreatedAt, test.wantCreatedAt)
+			case test.wantCreatedAt.IsZero() && merged.HasMetadata() && merged.CreatedAt.IsZero():
+				t.Error("created_at should be set on entries carrying metadata")
+			case !test.patched.HasMetadata() && merged.HasMetadata():
+				t.Error("entries without metadata should be kept as they are")
+			}
+		})
+	}
+}
+
+func TestPatchPolicyRepeatOffender(t *testing.T) {
+	firewall := newTestFirewall(PolicyEvent{Name: "nouseragent", Type: EventTypeFull})
+
+	patch := func() IPEntry {
+		firewall.patchPolicy(&PolicyEvent{
+			Name: "nouseragent",
+			Type: EventTypePatch,
+			IPBuckets: IPBuckets{"blacklist": {
+				"192.0.2.1": {ExpireAt: time.Now().Add(time.Hour), Reason: "no user agent", Source: "nouseragent"},
+			}},
+		})
+
+		state := firewall.currentSnapshot()
+		entry, ok := state.IPTrees["nouseragent"]["blacklist"].GetIP(net.ParseIP("192.0.2.1"))
+		if !ok {
+			t.Fatal("192.0.2.1 is not in the tree")
+		}
+		if bucketEntry := state.Policies["nouseragent"].IPBuckets["blacklist"]["192.0.2.1/32"]; bucketEntry != entry {
+			t.Fatalf("bucket entry %+v differs from the tree entry %+v", bucketEntry, entry)
+		}
+		return entry
+	}
+
+	first := patch()
+	if first.Hits != 1 || first.CreatedAt.IsZero() {
+		t.Fatalf("first offence = %+v, want 1 hit and a creation time", first)
+	}
+
+	for hits := 2; hits <= 3; hits++ {
+		entry := patch()
+		if entry.Hits != hits {
+			t.Errorf("hits = %d, want %d", entry.Hits, hits)
+		}
+		if !entry.CreatedAt.Equal(first.CreatedAt) {
+			t.Errorf("created_at = %v, want the first offence %v", entry.CreatedAt, first.CreatedAt)
+		}
+	}
+}
+
+func TestIPBucketKeysAreCanonical(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour)
+	firewall := newTestFirewall(PolicyEvent{
+		Name: "nouseragent",
+		Type: EventTypeFull,
+		IPBuckets: IPBuckets{"blacklist": {
+			"10.0.0.1":         {ExpireAt: expireAt},
+			"10.0.0.0/8":       {ExpireAt: expireAt},
+			"10.1.2.3/8":       {ExpireAt: expireAt.Add(time.Hour)},
+			"::ffff:192.0.2.1": {ExpireAt: expireAt},
+			"2001:db8::1":      {ExpireAt: expireAt},
+			"not an ip":        {ExpireAt: expireAt},
+		}},
+	})
+
+	bucket := firewall.currentSnapshot().Policies["nouseragent"].IPBuckets["blacklist"]
+	want := map[string]time.Time{
+		"10.0.0.1/32":     expireAt,
+		"10.0.0.0/8":      expireAt.Add(time.Hour),
+		"192.0.2.1/32":    expireAt,
+		"2001:db8::1/128": expireAt,
+	}
+	if len(bucket) != len(want) {
+		t.Fatalf("bucket = %v, want the keys of %v", bucket, want)
+	}
+	for key, wantExpireAt := range want {
+		if entry, ok := bucket[key]; !ok || !entry.ExpireAt.Equal(wantExpireAt) {
+			t.Errorf("bucket[%s] = %v, %v, want %v", key, entry.ExpireAt, ok, wantExpireAt)
+		}
+	}
+
+	// the tombstones remove the entries whatever form they were added with.
+	firewall.patchPolicy(&PolicyEvent{
+		Name: "nouseragent",
+		Type: EventTypePatch,
+		IPBuckets: IPBuckets{"blacklist": {
+			"10.0.0.1/32":     {},
+			"192.0.2.1":       {},
+			"2001:db8::1/128": {},
+		}},
+	})
+
+	state := firewall.currentSnapshot()
+	bucket = state.Policies["nouseragent"].IPBuckets["blacklist"]
+	if _, ok := bucket["10.0.0.0/8"]; !ok || len(bucket) != 1 {
+		t.Errorf("bucket = %v, want only 10.0.0.0/8", bucket)
+	}
+	if ipTree := state.IPTrees["nouseragent"]["blacklist"]; ipTree.Len() != 1 {
+		flatJSON, _ := ipTree.ToFlatJSON()
+		t.Errorf("tree = %v, want only 10.0.0.0/8", flatJSON)
+	}
+}
+
+func TestTombstonesSurviveFullEvents(t *testing.T) {
+	firewall := newTestFirewall()
+	expireAt := time.Now().Add(time.Hour)
+
+	// the generator keeps sending the entries of its cache in every FULL event.
+	full := func(expireAt time.Time) bool {
+		firewall.replacePolicy(&PolicyEvent{
+			Name: "nouseragent",
+			Type: EventTypeFull,
+			Rego: "package nouseragent\n\ndefault deny = false",
+			IPBuckets: IPBuckets{"blacklist": {
+				"192.0.2.1": {ExpireAt: expireAt, Reason: "no user agent", Source: "nouseragent"},
+			}},
+		})
+
+		state := firewall.currentSnapshot()
+		_, inBucket := state.Policies["nouseragent"].IPBuckets["blacklist"]["192.0.2.1/32"]
+		_, inTree := state.IPTrees["nouseragent"]["blacklist"].GetIP(net.ParseIP("192.0.2.1"))
+		if inBucket != inTree {
+			t.Fatalf("192.0.2.1 in the bucket = %v, in the tree = %v", inBucket, inTree)
+		}
+		return inTree
+	}
+
+	if !full(expireAt) {
+		t.Fatal("192.0.2.1 should be blocked")
+	}
+
+	firewall.patchPolicy(&PolicyEvent{
+		Name:      "nouseragent",
+		Type:      EventTypePatch,
+		IPBuckets: IPBuckets{"blacklist": {"192.0.2.1": {}}},
+	})
+	if full(expireAt) {
+		t.Error("a FULL event added back the entry removed by the tombstone")
+	}
+
+	// a new offence expires later than the removed entry.
+	if !full(expireAt.Add(time.Minute)) {
+		t.Error("a FULL event with a new entry should block 192.0.2.1 again")
+	}
+
+	firewall.collectGarbage(expireAt.Add(time.Second))
+	if tombstones := firewall.currentSnapshot().Tombstones; len(tombstones) != 0 {
+		t.Errorf("tombstones = %v, want them collected once expired", tombstones)
+	}
+}
+
+func TestFullEventsKeepTheTrackedHits(t *testing.T) {
+	firewall := newTestFirewall(PolicyEvent{Name: "nouseragent", Type: EventTypeFull})
+	expireAt := time.Now().Add(time.Hour)
+
+	for i := 0; i < 2; i++ {
+		firewall.patchPolicy(&PolicyEvent{
+			Name: "nouseragent",
+			Type: EventTypePatch,
+			IPBuckets: IPBuckets{"blacklist": {
+				"192.0.2.1": {ExpireAt: expireAt.Add(time.Duration(i) * time.Minute), Reason: "no user agent", Source: "nouseragent"},
+			}},
+		})
+	}
+	patched := firewall.currentSnapshot().Policies["nouseragent"].IPBuckets["blacklist"]["192.0.2.1/32"]
+
+	// the generator syncs the entries of its cache, without the hits, every few seconds.
+	for i := 0; i < 2; i++ {
+		firewall.replacePolicy(&PolicyEvent{
+			Name: "nouseragent",
+			Type: EventTypeFull,
+			Rego: "package nouseragent\n\ndefault deny = false",
+			IPBuckets: IPBuckets{"blacklist": {
+				"192.0.2.1": {ExpireAt: patched.ExpireAt, Reason: "no user agent", Source: "nouseragent"},
+			}},
+		})
+
+		state := firewall.currentSnapshot()
+		entry := state.Policies["nouseragent"].IPBuckets["blacklist"]["192.0.2.1/32"]
+		if entry.Hits != 2 || !entry.CreatedAt.Equal(patched.CreatedAt) {
+			t.Errorf("FULL #%d: entry = %+v, want the 2 hits and creation time of the patches", i+1, entry)
+		}
+		if treeEntry, _ := state.IPTrees["nouseragent"]["blacklist"].GetIP(net.ParseIP("192.0.2.1")); treeEntry != entry {
+			t.Errorf("FULL #%d: tree entry %+v differs from the bucket entry %+v", i+1, treeEntry, entry)
+		}
+	}
+}
@@ -6,29 +6,26 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/cainelli/opa-firewall/pkg/iptree"
-	"github.com/open-policy-agent/opa/rego"
 	"github.com/sirupsen/logrus"
 )
 
 // New initialized the firewall handler
-func New(logger *logrus.Logger) *Firewall {
+func New(logger *logrus.Logger, configuration *Configuration) *Firewall {
 	policies, err := GetStaticPolicies()
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	firewall := &Firewall{
-		Logger:          logger,
-		Policies:        policies,
-		IPTrees:         make(IPTrees),
-		CompileInterval: 5 * time.Second, // TODO: make it configurable and fix interval before production
-		context:         context.Background(),
-		warmedUp:        make(chan bool),
+	firewall := newFirewall(logger, configuration, policies)
+
+	if configuration.DecisionLog {
+		if err := firewall.startDecisionLog(); err != nil {
+			firewall.Logger.Errorf("could not start decision log: %v", err)
+		}
 	}
 
 	go firewall.consumePoliciesForever()
@@ -42,7 +39,65 @@ func New(logger *logrus.Logger) *Firewall {
 	firewall.Logger.Info("compiling policies")
 	firewall.Compile()
 
-	go firewall.periodicallyCompile()
+	go firewall.compileOnRequest()
+	go firewall.periodicallyCollectGarbage()
+
+	return firewall
+}
+
+// NewStatic initializes a firewall evaluating the given policies only. The policy stream is
+// not consumed and decisions are not logged, Ex.: to test the enforcers.
+func NewStatic(logger *logrus.Logger, configuration *Configuration, policies ...PolicyEvent) *Firewall {
+	byName := make(map[string]PolicyEvent, len(policies))
+	for _, policy := range policies {
+		byName[policy.Name] = policy
+	}
+
+	firewall := newFirewall(logger, configuration, byName)
+	firewall.Compile()
+	return firewall
+}
+
+// newFirewall loads the static policies and the challenger, the policies are not compiled yet.
+func newFirewall(logger *logrus.Logger, configuration *Configuration, policies map[string]PolicyEvent) *Firewall {
+	firewall := &Firewall{
+		Configuration:   configuration,
+		Logger:          logger,
+		context:         context.Background(),
+		warmedUp:        make(chan bool),
+		compileRequests: make(chan struct{}, 1),
+	}
+	firewall.store = newSnapshotStore(firewall)
+
+	state := &snapshot{
+		Data:        make(map[string]interface{}),
+		IPTrees:     make(IPTrees),
+		Policies:    make(map[string]PolicyEvent, len(policies)),
+		Quarantined: make(map[string]QuarantinedPolicy),
+		Replaced:    make(map[string]PolicyEvent),
+		Metadata:    make(map[string]policyMetadata, len(policies)),
+		Tombstones:  make(map[string]IPBuckets),
+	}
+	for _, policy := range policies {
+		if err := validateRego(policy.Name, policy.Rego); err != nil {
+			firewall.Logger.Errorf("(quarantined) invalid rego for static policy %s: %v", policy.Name, err)
+			state.Quarantined[policy.Name] = QuarantinedPolicy{Policy: policy, Error: err.Error(), Time: time.Now()}
+			continue
+		}
+		if err := firewall.applyPolicy(state, policy, PolicySourceStatic); err != nil {
+			firewall.Logger.Errorf("could not load static policy %s: %v", policy.Name, err)
+		}
+	}
+	firewall.publish(state)
+
+	if configuration.ChallengeSecret != "" {
+		challenger, err := NewProofOfWork([]byte(configuration.ChallengeSecret), configuration.ChallengeDifficulty, configuration.ChallengeTTL)
+		if err != nil {
+			firewall.Logger.Errorf("could not start challenger: %v", err)
+		} else {
+			firewall.Challenger = challenger
+		}
+	}
 
 	return firewall
 }
@@ -52,12 +107,14 @@ func (firewall *Firewall) warmUp() {
 	const minBacklogToBeReady = 10
 
 	for {
-		if firewall.startedConsuming && firewall.PoliciesBacklog < minBacklogToBeReady {
+		startedConsuming := atomic.LoadInt32(&firewall.startedConsuming) == 1
+		backlog := atomic.LoadInt64(&firewall.PoliciesBacklog)
+		if startedConsuming && backlog < minBacklogToBeReady {
 			firewall.warmedUp <- true
 			return
 		}
-		if firewall.startedConsuming {
-			firewall.Logger.Infof("lag too high (%d) waiting for lag decrease to %d before startup", firewall.PoliciesBacklog, minBacklogToBeReady)
+		if startedConsuming {
+			firewall.Logger.Infof("lag too high (%d) waiting for lag decrease to %d before startup", backlog, minBacklogToBeReady)
 		} else {
 			firewall.Logger.Infof("didn't started consuming yet")
 		}
@@ -70,110 +127,116 @@ func (firewall *Firewall) warmUp() {
 func (firewall *Firewall) OnRequest(writer http.ResponseWriter, request *http.Request) {
 	status := http.StatusOK
 
-	normalizedHeaders := make(map[string][]string)
-	for header, values := range request.Header {
-		normalizedHeaders[strings.ToLower(header)] = values
-	}
+	input := firewall.RequestInput(request)
 
-	input := map[string]interface{}{
-		"host":    request.Host,
-		"method":  request.Method,
-		"path":    request.URL.Path,
-		"headers": normalizedHeaders,
-		"ip":      request.Header.Get("x-forwarded-for"),
-	}
+	decision := firewall.Decide(input)
 
-	allow, err := firewall.Evaluate(input)
-	if err != nil {
-		firewall.Logger.Error(err)
+	if firewall.Configuration.DecisionHeaders {
+		decision.SetHeaders(writer.Header())
 	}
-	if !allow {
+
+	if decision.Blocks() {
 		status = http.StatusTooManyRequests
+		// the input carries cookies, credentials and bodies, it is never echoed back.
+		firewall.BlockResponse(input, decision, Response{
+			Status: status,
+			Body:   []byte(fmt.Sprintf("response:%d\n", status)),
+		}).Write(writer, request)
+		return
 	}
 
 	writer.WriteHeader(status)
 
-	_, _ = fmt.Fprintln(writer, input)
 	_, _ = fmt.Fprintln(writer, fmt.Sprintf("response:%d", status))
 }
 
-// Evaluate ...
-func (firewall *Firewall) Evaluate(input map[string]interface{}) (bool, error) {
-	start := time.Now()
+// Decide evaluates the input honouring the kill switch and dry run configuration, then logs
+// and ships the decision. It is the entrypoint for every enforcement front-end which should
+// block the request when the decision is DecisionDeny.
+func (firewall *Firewall) Decide(input map[string]interface{}) Decision {
+	// kill switch: skip evaluation entirely when the firewall is disabled.
+	if !firewall.Configuration.IsEnabled {
+		return Decision{Allowed: true, Disabled: true}
+	}
 
-	// Run evaluation.
-	resultSet, err := firewall.PreparedEval.Eval(firewall.context, rego.EvalInput(input))
+	decision, err := firewall.Evaluate(input)
 	if err != nil {
 		firewall.Logger.Error(err)
 	}
+	if firewall.Configuration.DryRun {
+		decision.DryRun = true
+	}
 
-	// no result allows traffic
-	if len(resultSet) == 0 {
-		return true, nil
-	}
-
-	// Semantics: Lookup for allow and deny expressions to assing them to allow/deny variables.
-	// If allow=true we will honour this decision even if deny=true and move to the next module
-	var allow, deny bool
-
-	for _, set := range resultSet {
-		for _, expression := range set.Expressions {
-			switch result := expression.Value.(type) {
-			case map[string]interface{}:
-				for moduleName, dataInterface := range result {
-					switch data := dataInterface.(type) {
-					case map[string]interface{}:
-						if found, ok := data["allow"]; ok {
-							switch value := found.(type) {
-							case bool:
-								allow = value
-							default:
-								log.Printf("%s result type (%v) not supported for %v", moduleName, reflect.TypeOf(value), value)
-							}
-						}
-
-						if found, ok := data["deny"]; ok {
-							switch value := found.(type) {
-							case bool:
-								deny = value
-								if deny {
-									firewall.Logger.Infof("request blocked by module %s", moduleName)
-								}
-							default:
-								log.Printf("%s result type (%v) not supported for %v", moduleName, reflect.TypeOf(value), value)
-							}
-						}
-					default:
-						log.Printf("%s data type (%v) not supported: %v", moduleName, reflect.TypeOf(data), interfaceToString(data))
-					}
-				}
-			default:
-				log.Printf("expression value type (%v) not supported: %v", reflect.TypeOf(result), interfaceToString(result))
-			}
+	switch decision.String() {
+	case DecisionDeny:
+		if !decision.Blocks() {
+			firewall.Logger.WithFields(decision.LogFields()).Infof("(%s action) request denied but let through: %s", decision.Action.Type, requestSummary(input))
+			break
 		}
+		firewall.Logger.WithFields(decision.LogFields()).Infof("request blocked: %s", requestSummary(input))
+	case DecisionDryRunDeny:
+		firewall.Logger.WithFields(decision.LogFields()).Infof("(dry run) request would have been blocked: %s", requestSummary(input))
 	}
 
-	log.Printf("total took %s", time.Since(start))
+	firewall.logDecision(input, decision)
+
+	return decision
+}
 
-	if deny == true && allow == false {
-		return false, nil
+// Evaluate runs the input against the compiled policies, tier by tier in priority order, and
+// returns the decision of the first applicable tier. The request is allowed when no policy
+// matched. Policies failing to evaluate don't match and are reported in the error.
+func (firewall *Firewall) Evaluate(input map[string]interface{}) (Decision, error) {
+	start := time.Now()
+	// the snapshot travels in the context so the store and the builtins read the data and ip trees
+	// published along with the queries.
+	state := firewall.currentSnapshot()
+	decision := Decision{Allowed: true, Revision: state.Revision}
+	ctx := context.WithValue(firewall.context, snapshotContextKey{}, state)
+	ctx = context.WithValue(ctx, inputContextKey{}, input)
+
+	var failures []string
+	for _, tier := range state.Tiers {
+		applicable, allowed, tierFailures := firewall.evalTier(ctx, tier, input, &decision)
+		failures = append(failures, tierFailures...)
+		if applicable {
+			decision.Allowed = allowed
+			decision.Algorithm = tier.Algorithm
+			decision.Priority = tier.Priority
+			break
+		}
 	}
+	decision.Duration = time.Since(start)
 
-	// no deny rule allows traffic
-	return true, nil
+	if len(failures) > 0 {
+		return decision, fmt.Errorf("could not evaluate policies: %s", strings.Join(failures, "; "))
+	}
+	return decision, nil
 }
 
-func (firewall *Firewall) getIPTreeOrNew(policyName, bucketName string) *iptree.IPTree {
-	if _, ok := firewall.IPTrees[policyName]; !ok {
-		firewall.IPTrees[policyName] = map[string]*iptree.IPTree{}
+// evalPolicy evaluates a single policy, bounded by the configured policy timeout.
+func (firewall *Firewall) evalPolicy(ctx context.Context, query *policyQuery, input map[string]interface{}) (policyResult, time.Duration, error) {
+	start := time.Now()
+	if firewall.Configuration.PolicyTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, firewall.Configuration.PolicyTimeout)
+		defer cancel()
 	}
 
-	if _, ok := firewall.IPTrees[policyName][bucketName]; !ok {
-		firewall.Logger.Infof("initializing iptree[%s][%s]", policyName, bucketName)
-		firewall.IPTrees[policyName][bucketName] = iptree.New()
-	}
+	result, err := query.eval(ctx, input)
+	duration := time.Since(start)
+	query.Stats.record(result, duration, err)
+	return result, duration, err
+}
 
-	return firewall.IPTrees[policyName][bucketName]
+// requestSummary describes the request of the input without its headers, cookies and body,
+// which may carry credentials. Ex.: GET www.example.com/login from 203.0.113.7
+func requestSummary(input map[string]interface{}) string {
+	field := func(key string) string {
+		value, _ := input[key].(string)
+		return value
+	}
+	return fmt.Sprintf("%s %s%s from %s", field("method"), field("host"), field("path"), field("ip"))
 }
 
 // interfaceToString ...
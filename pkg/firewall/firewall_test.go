@@ -0,0 +1,83 @@
+package firewall
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name            string
+		isEnabled       bool
+		dryRun          bool
+		wantDecision    string
+		wantBlocks      bool
+		wantDisabled    bool
+		wantEvaluations uint64
+		wantStatus      int
+	}{
+		{
+			name:            "enforced",
+			isEnabled:       true,
+			wantDecision:    DecisionDeny,
+			wantBlocks:      true,
+			wantEvaluations: 2,
+			wantStatus:      http.StatusTooManyRequests,
+		},
+		{
+			name:            "dry run",
+			isEnabled:       true,
+			dryRun:          true,
+			wantDecision:    DecisionDryRunDeny,
+			wantEvaluations: 2,
+			wantStatus:      http.StatusOK,
+		},
+		{
+			name:         "kill switch",
+			isEnabled:    false,
+			wantDecision: DecisionAllow,
+			wantDisabled: true,
+			wantStatus:   http.StatusOK,
+		},
+		{
+			name:         "kill switch wins over dry run",
+			isEnabled:    false,
+			dryRun:       true,
+			wantDecision: DecisionAllow,
+			wantDisabled: true,
+			wantStatus:   http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			firewall := newTestFirewall(PolicyEvent{Name: "blocker", Type: EventTypeFull, Rego: "package blocker\ndeny = true\n"})
+			firewall.Configuration.IsEnabled = test.isEnabled
+			firewall.Configuration.DryRun = test.dryRun
+			firewall.Compile()
+
+			decision := firewall.Decide(map[string]interface{}{"ip": "203.0.113.7"})
+			if decision.String() != test.wantDecision || decision.Blocks() != test.wantBlocks {
+				t.Errorf("decision = %s, blocks = %v, want %s, blocks = %v", decision, decision.Blocks(), test.wantDecision, test.wantBlocks)
+			}
+			if decision.Disabled != test.wantDisabled {
+				t.Errorf("disabled = %v, want %v", decision.Disabled, test.wantDisabled)
+			}
+
+			recorder := httptest.NewRecorder()
+			request := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+			request.RemoteAddr = "203.0.113.7:41234"
+			firewall.OnRequest(recorder, request)
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+
+			// Decide and OnRequest evaluate the policy once each, unless the kill switch skips it.
+			stats := firewall.currentSnapshot().Tiers[0].Queries[0].Stats.read()
+			if stats.Evaluations != test.wantEvaluations {
+				t.Errorf("evaluations = %d, want %d", stats.Evaluations, test.wantEvaluations)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package firewall
+
+import (
+	"expvar"
+	"time"
+)
+
+var (
+	// gcRuns counts the sweeps.
+	gcRuns = expvar.NewInt("firewall_gc_runs")
+	// gcEvictedBucketEntries and gcEvictedTreeEntries count the evicted entries by policy/bucket.
+	gcEvictedBucketEntries = expvar.NewMap("firewall_gc_evicted_bucket_entries")
+	gcEvictedTreeEntries   = expvar.NewMap("firewall_gc_evicted_tree_entries")
+)
+
+func (firewall *Firewall) periodicallyCollectGarbage() {
+	if firewall.Configuration.GCInterval <= 0 {
+		firewall.Logger.Info("ip bucket garbage collection disabled")
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(firewall.Configuration.GCInterval):
+			start := time.Now()
+			evicted := firewall.collectGarbage(start)
+			firewall.Logger.Infof("evicted %d expired ip bucket entries (took %s)", evicted, time.Since(start))
+		}
+	}
+}
+
+// collectGarbage publishes a snapshot without the entries expired at the given time, both from
+// the persisted ip buckets and from the ip trees, and returns how many bucket entries were evicted.
+func (firewall *Firewall) collectGarbage(now time.Time) int {
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	gcRuns.Add(1)
+
+	current := firewall.currentSnapshot()
+	var next *snapshot
+	evicted := 0
+
+	for policyName, policy := range current.Policies {
+		var ipBuckets IPBuckets
+		for bucketName, bucket := range policy.IPBuckets {
+			expired := 0
+			for _, entry := range bucket {
+				if now.After(entry.ExpireAt) {
+					expired++
+				}
+			}
+			if expired == 0 {
+				continue
+			}
+
+			// buckets are shared with the previous snapshots, the kept entries go to a copy.
+			if ipBuckets == nil {
+				ipBuckets = make(IPBuckets, len(policy.IPBuckets))
+				for name, bucket := range policy.IPBuckets {
+					ipBuckets[name] = bucket
+				}
+			}
+			ipBucket := make(IPBucket, len(bucket)-expired)
+			for ipString, entry := range bucket {
+				if !now.After(entry.ExpireAt) {
+					ipBucket[ipString] = entry
+				}
+			}
+			ipBuckets[bucketName] = ipBucket
+
+			evicted += expired
+			gcEvictedBucketEntries.Add(policyName+"/"+bucketName, int64(expired))
+		}
+
+		if ipBuckets != nil {
+			if next == nil {
+				next = current.clone()
+			}
+			policy.IPBuckets = ipBuckets
+			next.Policies[policyName] = policy
+		}
+	}
+
+	for policyName, buckets := range current.IPTrees {
+		for bucketName, ipTree := range buckets {
+			treeCopy := *ipTree
+			removed := treeCopy.DeleteExpired(now)
+			if removed == 0 {
+				continue
+			}
+
+			if next == nil {
+				next = current.clone()
+			}
+			next.IPTrees[policyName][bucketName] = &treeCopy
+			gcEvictedTreeEntries.Add(policyName+"/"+bucketName, int64(removed))
+		}
+	}
+
+	// tombstones are only needed until the entry they removed would have expired.
+	for policyName, tombstones := range current.Tombstones {
+		kept := make(IPBuckets, len(tombstones))
+		changed := false
+		for bucketName, bucket := range tombstones {
+			ipBucket := make(IPBucket, len(bucket))
+			for ipString, tombstone := range bucket {
+				if !now.After(tombstone.ExpireAt) {
+					ipBucket[ipString] = tombstone
+				}
+			}
+			changed = changed || len(ipBucket) != len(bucket)
+			if len(ipBucket) > 0 {
+				kept[bucketName] = ipBucket
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if next == nil {
+			next = current.clone()
+		}
+		if len(kept) == 0 {
+			delete(next.Tombstones, policyName)
+		} else {
+			next.Tombstones[policyName] = kept
+		}
+	}
+
+	if next != nil {
+		firewall.publish(next)
+	}
+
+	return evicted
+}
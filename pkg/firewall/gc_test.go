@@ -0,0 +1,100 @@
+package firewall
+
+import (
+	"expvar"
+	"testing"
+	"time"
+)
+
+func expvarInt(value expvar.Var) int64 {
+	if value == nil {
+		return 0
+	}
+	return value.(*expvar.Int).Value()
+}
+
+func TestCollectGarbage(t *testing.T) {
+	now := time.Now()
+	firewall := newTestFirewall(PolicyEvent{
+		Name: "nouseragent",
+		Type: EventTypeFull,
+		IPBuckets: IPBuckets{"blacklist": {
+			"192.0.2.1":     {ExpireAt: now.Add(time.Minute)},
+			"192.0.2.2":     {ExpireAt: now.Add(2 * time.Hour)},
+			"2001:db8::/32": {ExpireAt: now.Add(time.Minute)},
+		}},
+	})
+
+	runs := expvarInt(gcRuns)
+	evictedBucketEntries := expvarInt(gcEvictedBucketEntries.Get("nouseragent/blacklist"))
+	evictedTreeEntries := expvarInt(gcEvictedTreeEntries.Get("nouseragent/blacklist"))
+
+	if evicted := firewall.collectGarbage(now.Add(time.Hour)); evicted != 2 {
+		t.Errorf("collectGarbage() = %d, want 2", evicted)
+	}
+
+	state := firewall.currentSnapshot()
+	bucket := state.Policies["nouseragent"].IPBuckets["blacklist"]
+	if _, ok := bucket["192.0.2.2/32"]; !ok || len(bucket) != 1 {
+		t.Errorf("bucket = %v, want only 192.0.2.2/32", bucket)
+	}
+	flatJSON, _ := state.IPTrees["nouseragent"]["blacklist"].ToFlatJSON()
+	if _, ok := flatJSON.IPv4["192.0.2.2"]; !ok || len(flatJSON.IPv4)+len(flatJSON.IPv6) != 1 {
+		t.Errorf("tree = %v, want only 192.0.2.2", flatJSON)
+	}
+
+	if got := expvarInt(gcRuns) - runs; got != 1 {
+		t.Errorf("runs = %d, want 1", got)
+	}
+	if got := expvarInt(gcEvictedBucketEntries.Get("nouseragent/blacklist")) - evictedBucketEntries; got != 2 {
+		t.Errorf("evicted bucket entries = %d, want 2", got)
+	}
+	if got := expvarInt(gcEvictedTreeEntries.Get("nouseragent/blacklist")) - evictedTreeEntries; got != 2 {
+		t.Errorf("evicted tree entries = %d, want 2", got)
+	}
+
+	// nothing expired, the snapshot is kept.
+	revision := state.Revision
+	if evicted := firewall.collectGarbage(now.Add(time.Hour)); evicted != 0 {
+		t.Errorf("collectGarbage() = %d, want 0", evicted)
+	}
+	if current := firewall.currentSnapshot(); current.Revision != revision {
+		t.Errorf("revision = %d, want %d when nothing expired", current.Revision, revision)
+	}
+	if got := expvarInt(gcRuns) - runs; got != 2 {
+		t.Errorf("runs = %d, want 2", got)
+	}
+}
+
+func TestCollectGarbageKeepsThePreviousSnapshot(t *testing.T) {
+	now := time.Now()
+	firewall := newTestFirewall(PolicyEvent{
+		Name:      "nouseragent",
+		Type:      EventTypeFull,
+		IPBuckets: IPBuckets{"blacklist": {"192.0.2.1": {ExpireAt: now.Add(time.Minute)}}},
+	})
+	previous := firewall.currentSnapshot()
+
+	firewall.collectGarbage(now.Add(time.Hour))
+
+	if len(previous.Policies["nouseragent"].IPBuckets["blacklist"]) != 1 || previous.IPTrees["nouseragent"]["blacklist"].Len() != 1 {
+		t.Error("collectGarbage() modified the previous snapshot")
+	}
+}
+
+func TestPeriodicallyCollectGarbageDisabled(t *testing.T) {
+	firewall := newTestFirewall()
+	firewall.Configuration.GCInterval = 0
+
+	done := make(chan struct{})
+	go func() {
+		firewall.periodicallyCollectGarbage()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("periodicallyCollectGarbage() should return when GCInterval is 0")
+	}
+}
@@ -0,0 +1,233 @@
+package firewall
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// InputVersion is the version of the input document handed to the rego policies. It must be
+// bumped on any change which is not backwards compatible.
+const InputVersion = 1
+
+// InputRequest holds the request attributes every enforcement front-end extracts before
+// building the input document with BuildInput.
+type InputRequest struct {
+	Host     string
+	Method   string
+	Path     string
+	RawQuery string
+	// Scheme is http or https as seen by the client.
+	Scheme string
+	// Protocol is the http version, Ex.: HTTP/1.1, HTTP/2.
+	Protocol string
+	// Headers must have lower cased names.
+	Headers map[string][]string
+	// RemoteAddr is the address of the peer connected to the front-end.
+	RemoteAddr string
+	// ContentLength is -1 when unknown.
+	ContentLength int64
+	// TLS is nil unless the connection was terminated with TLS.
+	TLS  *InputTLS
+	Time time.Time
+	// Inspected is set when the body was buffered, see Configuration.InspectsBody.
+	Inspected bool
+	// Body holds at most Configuration.BodyMaxSize bytes, BodyTruncated is set when it is larger.
+	Body          []byte
+	BodyTruncated bool
+}
+
+// InputTLS describes the TLS session of the client connection.
+type InputTLS struct {
+	Version            string
+	ServerName         string
+	NegotiatedProtocol string
+	CipherSuite        string
+	JA3                string
+}
+
+// BuildInput builds the input document for the rego policies. Version 1 of the schema:
+//
+//	{
+//	  "version": 1,
+//	  "time": "2020-03-19T15:50:16.3114833Z",  // RFC3339 with nanoseconds
+//	  "time_ns": 1584633016311483300,          // compatible with the rego time.* builtins
+//	  "host": "www.example.com",
+//	  "method": "GET",
+//	  "path": "/login",
+//	  "raw_query": "user=bob&user=alice",
+//	  "query": {"user": ["bob", "alice"]},
+//	  "scheme": "https",
+//	  "protocol": "HTTP/1.1",
+//	  "content_length": 42,                    // -1 when unknown
+//	  "headers": {"user-agent": ["curl/7.64.1"]},
+//	  "cookies": {"session": "a1b2c3"},
+//	  "body": {"username": "bob"},             // only when inspected, the decoded JSON document
+//	                                           // or form values, null for other content types
+//	  "body_truncated": false,                 // only when inspected, the body is not parsed if set
+//	  "ip": "203.0.113.7",                     // see Configuration.ResolveClientIP
+//	  "ip_chain": ["203.0.113.7", "10.0.0.1"],
+//	  "tls": {                                 // only when the connection used TLS
+//	    "version": "1.3",
+//	    "sni": "www.example.com",
+//	    "alpn": "h2",
+//	    "cipher_suite": "0x1301",
+//	    "ja3": "e7d705a3286e19ea42f587b344ee6865" // only when Configuration.JA3Header is set
+//	  }
+//	}
+func (firewall *Firewall) BuildInput(request InputRequest) map[string]interface{} {
+	if request.Headers == nil {
+		request.Headers = make(map[string][]string)
+	}
+
+	ip, chain := firewall.Configuration.ResolveClientIP(request.RemoteAddr, request.Headers)
+
+	// the scheme and ja3 are reported by the proxy terminating TLS, only trusted peers are honoured.
+	scheme := request.Scheme
+	trustedPeer := firewall.Configuration.IsTrustedPeer(request.RemoteAddr)
+	if forwardedProto, ok := request.Headers["x-forwarded-proto"]; ok && trustedPeer && len(forwardedProto) > 0 {
+		scheme = strings.ToLower(forwardedProto[0])
+	}
+
+	input := map[string]interface{}{
+		"version":        InputVersion,
+		"time":           request.Time.UTC().Format(time.RFC3339Nano),
+		"time_ns":        request.Time.UnixNano(),
+		"host":           request.Host,
+		"method":         request.Method,
+		"path":           request.Path,
+		"raw_query":      request.RawQuery,
+		"query":          parseQuery(request.RawQuery),
+		"scheme":         scheme,
+		"protocol":       request.Protocol,
+		"content_length": request.ContentLength,
+		"headers":        request.Headers,
+		"cookies":        parseCookies(request.Headers["cookie"]),
+		"ip":             ip,
+		"ip_chain":       chain,
+	}
+
+	if request.Inspected {
+		contentType := ""
+		if value, ok := request.Headers["content-type"]; ok && len(value) > 0 {
+			contentType = value[0]
+		}
+		input["body"] = parseBody(contentType, request.Body, request.BodyTruncated)
+		input["body_truncated"] = request.BodyTruncated
+	}
+
+	var tlsInput *InputTLS
+	if request.TLS != nil {
+		copied := *request.TLS
+		tlsInput = &copied
+	}
+	if ja3Header := firewall.Configuration.JA3Header; ja3Header != "" && trustedPeer && len(request.Headers[ja3Header]) > 0 {
+		if tlsInput == nil {
+			tlsInput = &InputTLS{}
+		}
+		tlsInput.JA3 = request.Headers[ja3Header][0]
+	}
+	if tlsInput != nil {
+		input["tls"] = map[string]interface{}{
+			"version":      tlsInput.Version,
+			"sni":          tlsInput.ServerName,
+			"alpn":         tlsInput.NegotiatedProtocol,
+			"cipher_suite": tlsInput.CipherSuite,
+			"ja3":          tlsInput.JA3,
+		}
+	}
+
+	return input
+}
+
+// RequestInput builds the input document from an http request received by the enforcer.
+// Inspected bodies are buffered and put back so the request can still be forwarded.
+func (firewall *Firewall) RequestInput(request *http.Request) map[string]interface{} {
+	normalizedHeaders := make(map[string][]string)
+	for header, values := range request.Header {
+		normalizedHeaders[strings.ToLower(header)] = values
+	}
+
+	inputRequest := InputRequest{
+		Host:          request.Host,
+		Method:        request.Method,
+		Path:          request.URL.Path,
+		RawQuery:      request.URL.RawQuery,
+		Scheme:        "http",
+		Protocol:      request.Proto,
+		Headers:       normalizedHeaders,
+		RemoteAddr:    request.RemoteAddr,
+		ContentLength: request.ContentLength,
+		Time:          time.Now(),
+	}
+
+	if request.TLS != nil {
+		inputRequest.Scheme = "https"
+		inputRequest.TLS = &InputTLS{
+			Version:            tlsVersionName(request.TLS.Version),
+			ServerName:         request.TLS.ServerName,
+			NegotiatedProtocol: request.TLS.NegotiatedProtocol,
+			CipherSuite:        fmt.Sprintf("0x%04x", request.TLS.CipherSuite),
+		}
+	}
+
+	if firewall.Configuration.InspectsBody(request.Host, request.URL.Path) {
+		body, truncated, err := firewall.Configuration.bufferBody(request)
+		if err != nil {
+			firewall.Logger.Warnf("could not read body of %s%s: %v", request.Host, request.URL.Path, err)
+		}
+		inputRequest.Inspected = true
+		inputRequest.Body = body
+		inputRequest.BodyTruncated = truncated
+	}
+
+	return firewall.BuildInput(inputRequest)
+}
+
+func parseQuery(rawQuery string) map[string][]string {
+	query := make(map[string][]string)
+	if rawQuery == "" {
+		return query
+	}
+
+	// malformed pairs are skipped, the raw query is still available to the policies.
+	values, _ := url.ParseQuery(rawQuery)
+	for key, value := range values {
+		query[key] = value
+	}
+	return query
+}
+
+// parseCookies returns the cookies by name, the first one wins when a name is repeated.
+func parseCookies(cookieHeaders []string) map[string]string {
+	cookies := make(map[string]string)
+	if len(cookieHeaders) == 0 {
+		return cookies
+	}
+
+	request := &http.Request{Header: http.Header{"Cookie": cookieHeaders}}
+	for _, cookie := range request.Cookies() {
+		if _, ok := cookies[cookie.Name]; !ok {
+			cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return cookies
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	default:
+		return fmt.Sprintf("0x%04x", version)
+	}
+}
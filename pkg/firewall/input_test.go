@@ -0,0 +1,164 @@
+package firewall
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBuildInput(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	firewall := newTestFirewall()
+	firewall.Configuration.TrustedProxies = []*net.IPNet{trusted}
+	firewall.Configuration.JA3Header = "x-ja3"
+
+	requestTime := time.Date(2020, 3, 19, 15, 50, 16, 311483300, time.UTC)
+	input := firewall.BuildInput(InputRequest{
+		Host:     "www.example.com",
+		Method:   http.MethodGet,
+		Path:     "/login",
+		RawQuery: "user=bob&user=alice&broken=%zz",
+		Scheme:   "http",
+		Protocol: "HTTP/1.1",
+		Headers: map[string][]string{
+			"user-agent":        {"curl/7.64.1"},
+			"cookie":            {"session=a1b2c3; theme=dark", "session=d4e5f6"},
+			"x-forwarded-for":   {"203.0.113.7"},
+			"x-forwarded-proto": {"HTTPS"},
+			"x-ja3":             {"e7d705a3286e19ea42f587b344ee6865"},
+		},
+		RemoteAddr:    "10.0.0.1:41234",
+		ContentLength: 42,
+		Time:          requestTime,
+	})
+
+	// policies read the json form of the input, compare what they see.
+	bytes, err := json.Marshal(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal(bytes, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"version":        float64(InputVersion),
+		"time":           "2020-03-19T15:50:16.3114833Z",
+		"time_ns":        float64(1584633016311483300),
+		"host":           "www.example.com",
+		"method":         "GET",
+		"path":           "/login",
+		"raw_query":      "user=bob&user=alice&broken=%zz",
+		"query":          map[string]interface{}{"user": []interface{}{"bob", "alice"}},
+		"scheme":         "https",
+		"protocol":       "HTTP/1.1",
+		"content_length": float64(42),
+		"headers": map[string]interface{}{
+			"user-agent":        []interface{}{"curl/7.64.1"},
+			"cookie":            []interface{}{"session=a1b2c3; theme=dark", "session=d4e5f6"},
+			"x-forwarded-for":   []interface{}{"203.0.113.7"},
+			"x-forwarded-proto": []interface{}{"HTTPS"},
+			"x-ja3":             []interface{}{"e7d705a3286e19ea42f587b344ee6865"},
+		},
+		"cookies":  map[string]interface{}{"session": "a1b2c3", "theme": "dark"},
+		"ip":       "203.0.113.7",
+		"ip_chain": []interface{}{"203.0.113.7", "10.0.0.1"},
+		"tls": map[string]interface{}{
+			"version":      "",
+			"sni":          "",
+			"alpn":         "",
+			"cipher_suite": "",
+			"ja3":          "e7d705a3286e19ea42f587b344ee6865",
+		},
+	}
+
+	for key, value := range want {
+		if !reflect.DeepEqual(got[key], value) {
+			t.Errorf("input[%s] = %#v, want %#v", key, got[key], value)
+		}
+	}
+	for key := range got {
+		if _, ok := want[key]; !ok {
+			t.Errorf("unexpected input[%s] = %#v", key, got[key])
+		}
+	}
+}
+
+func TestBuildInputUntrustedPeer(t *testing.T) {
+	firewall := newTestFirewall()
+	firewall.Configuration.JA3Header = "x-ja3"
+
+	// the scheme and the ja3 of untrusted peers are made up by the client.
+	input := firewall.BuildInput(InputRequest{
+		Scheme: "http",
+		Headers: map[string][]string{
+			"x-forwarded-proto": {"https"},
+			"x-ja3":             {"e7d705a3286e19ea42f587b344ee6865"},
+		},
+		RemoteAddr: "198.51.100.1:41234",
+	})
+
+	if input["scheme"] != "http" {
+		t.Errorf("scheme = %v, want http", input["scheme"])
+	}
+	if _, ok := input["tls"]; ok {
+		t.Errorf("tls = %v, want none", input["tls"])
+	}
+	for _, key := range []string{"body", "body_truncated"} {
+		if _, ok := input[key]; ok {
+			t.Errorf("input[%s] = %v, want it only when the body is inspected", key, input[key])
+		}
+	}
+}
+
+func TestRequestInput(t *testing.T) {
+	firewall := newTestFirewall()
+
+	request := httptest.NewRequest(http.MethodGet, "https://www.example.com/search?q=firewall", nil)
+	request.RemoteAddr = "203.0.113.7:41234"
+	request.Proto = "HTTP/2.0"
+	request.Header.Set("User-Agent", "curl/7.64.1")
+	request.TLS = &tls.ConnectionState{
+		Version:            tls.VersionTLS13,
+		ServerName:         "www.example.com",
+		NegotiatedProtocol: "h2",
+		CipherSuite:        tls.TLS_AES_128_GCM_SHA256,
+	}
+
+	input := firewall.RequestInput(request)
+
+	want := map[string]interface{}{
+		"host":      "www.example.com",
+		"path":      "/search",
+		"raw_query": "q=firewall",
+		"scheme":    "https",
+		"protocol":  "HTTP/2.0",
+		"ip":        "203.0.113.7",
+	}
+	for key, value := range want {
+		if input[key] != value {
+			t.Errorf("input[%s] = %v, want %v", key, input[key], value)
+		}
+	}
+
+	if headers := input["headers"].(map[string][]string); !reflect.DeepEqual(headers["user-agent"], []string{"curl/7.64.1"}) {
+		t.Errorf("headers = %v, want them lower cased", headers)
+	}
+
+	wantTLS := map[string]interface{}{
+		"version":      "1.3",
+		"sni":          "www.example.com",
+		"alpn":         "h2",
+		"cipher_suite": "0x1301",
+		"ja3":          "",
+	}
+	if !reflect.DeepEqual(input["tls"], wantTLS) {
+		t.Errorf("tls = %v, want %v", input["tls"], wantTLS)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/cainelli/opa-firewall/pkg/iptree"
 )
@@ -13,7 +15,7 @@ func (firewall *Firewall) DumpIPTrees(writer http.ResponseWriter, request *http.
 
 	res := make(map[string]map[string]iptree.FlatJSON)
 
-	for policyName, buckets := range firewall.IPTrees {
+	for policyName, buckets := range firewall.currentSnapshot().IPTrees {
 		res[policyName] = map[string]iptree.FlatJSON{}
 		for bucketName, tree := range buckets {
 			treeFormatted, err := tree.ToFlatJSON()
@@ -33,13 +35,73 @@ func (firewall *Firewall) DumpIPTrees(writer http.ResponseWriter, request *http.
 	fmt.Fprintf(writer, string(jsonBytes))
 }
 
-// DumpPolicies ..
+// DumpPolicies lists the status of every policy with the revision serving requests. Ex.:
+// GET /policies?ipbuckets=true
+// {"revision": 42, "policies": [{"name": "nouseragent", "status": "compiled", ...}]}
+// The ip buckets of the policies, which may hold millions of entries, are only included when
+// ipbuckets is true.
 func (firewall *Firewall) DumpPolicies(writer http.ResponseWriter, request *http.Request) {
-	jsonBytes, err := json.Marshal(firewall.Policies)
+	if request.Method != http.MethodGet {
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	withIPBuckets, err := ipBucketsParameter(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	statuses, revision := firewall.PolicyStatuses(withIPBuckets)
+	firewall.writeJSON(writer, map[string]interface{}{
+		"revision": revision,
+		"policies": statuses,
+	})
+}
+
+// DumpPolicy returns the status of the policy named in the path, GET /policies/{name}.
+func (firewall *Firewall) DumpPolicy(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		http.Error(writer, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	withIPBuckets, err := ipBucketsParameter(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimPrefix(request.URL.Path, "/policies/")
+	status, ok := firewall.PolicyStatus(name, withIPBuckets)
+	if !ok {
+		http.Error(writer, fmt.Sprintf("policy %s not found", name), http.StatusNotFound)
+		return
+	}
+
+	firewall.writeJSON(writer, status)
+}
+
+func ipBucketsParameter(request *http.Request) (bool, error) {
+	value := request.URL.Query().Get("ipbuckets")
+	if value == "" {
+		return false, nil
+	}
+	withIPBuckets, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid ipbuckets parameter %q", value)
+	}
+	return withIPBuckets, nil
+}
+
+func (firewall *Firewall) writeJSON(writer http.ResponseWriter, value interface{}) {
+	jsonBytes, err := json.Marshal(value)
 	if err != nil {
 		firewall.Logger.Error(err)
+		http.Error(writer, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 
-	fmt.Fprintf(writer, string(jsonBytes))
+	writer.Header().Set("Content-Type", "application/json")
+	_, _ = writer.Write(jsonBytes)
 }
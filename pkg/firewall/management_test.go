@@ -0,0 +1,176 @@
+package firewall
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newStatusFirewall serves a compiled, a pending, a data-only and a quarantined policy.
+func newStatusFirewall(t *testing.T) *Firewall {
+	expireAt := time.Now().Add(time.Hour)
+	firewall := newTestFirewall(
+		PolicyEvent{
+			Name:      "blocker",
+			Type:      EventTypeFull,
+			Rego:      "package blocker\ndeny { in_tree(\"blocker\", \"blacklist\", input.ip) }\n",
+			IPBuckets: IPBuckets{"blacklist": {"192.0.2.1": {ExpireAt: expireAt}, "198.51.100.0/24": {ExpireAt: expireAt}}},
+		},
+		PolicyEvent{Name: "changing", Type: EventTypeFull, Rego: "package changing\ndeny { false }\n"},
+		PolicyEvent{Name: "shared", Type: EventTypeFull, Data: map[string]interface{}{"paths": []interface{}{"/login"}}},
+	)
+	if prepared := firewall.Compile(); prepared != 2 {
+		t.Fatalf("Compile() = %d, want 2", prepared)
+	}
+	if _, err := firewall.Evaluate(map[string]interface{}{"ip": "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	firewall.replacePolicy(&PolicyEvent{Name: "changing", Type: EventTypeFull, Rego: "package changing\ndeny { true }\n"})
+	firewall.replacePolicy(&PolicyEvent{Name: "broken", Type: EventTypeFull, Rego: "package broken\ndeny {"})
+
+	return firewall
+}
+
+func TestPolicyStatuses(t *testing.T) {
+	firewall := newStatusFirewall(t)
+
+	statuses, revision := firewall.PolicyStatuses(false)
+	if revision != firewall.currentSnapshot().Revision {
+		t.Errorf("revision = %d, want %d", revision, firewall.currentSnapshot().Revision)
+	}
+
+	tests := []struct {
+		name        string
+		wantStatus  string
+		wantServing bool
+	}{
+		{name: "blocker", wantStatus: PolicyCompiled, wantServing: true},
+		{name: "broken", wantStatus: PolicyQuarantined},
+		{name: "changing", wantStatus: PolicyPending, wantServing: true},
+		{name: "shared", wantStatus: PolicyDataOnly},
+	}
+	if len(statuses) != len(tests) {
+		t.Fatalf("got %d statuses, want %d", len(statuses), len(tests))
+	}
+
+	for i, test := range tests {
+		status := statuses[i]
+		if status.Name != test.name {
+			t.Fatalf("status %d is %s, want %s, sorted by name", i, status.Name, test.name)
+		}
+		if status.Status != test.wantStatus || status.Serving != test.wantServing {
+			t.Errorf("%s: status = %s, serving = %v, want %s, serving = %v", test.name, status.Status, status.Serving, test.wantStatus, test.wantServing)
+		}
+	}
+
+	blocker := statuses[0]
+	if blocker.Source != PolicySourceStatic || blocker.UpdatedAt.IsZero() {
+		t.Errorf("blocker: source = %q, updated at %s, want a static policy with its update time", blocker.Source, blocker.UpdatedAt)
+	}
+	if blocker.IPEntries["blacklist"] != 2 {
+		t.Errorf("blocker: ip entries = %v, want 2 in blacklist", blocker.IPEntries)
+	}
+	if blocker.Stats == nil || blocker.Stats.Evaluations != 1 || blocker.Stats.Denies != 1 {
+		t.Errorf("blocker: stats = %+v, want a single deny", blocker.Stats)
+	}
+	if blocker.Policy == nil || blocker.Policy.IPBuckets != nil {
+		t.Errorf("blocker: policy = %+v, want it without its ip buckets", blocker.Policy)
+	}
+
+	broken := statuses[1]
+	if broken.LastError == "" || broken.QuarantinedAt == nil || broken.Policy != nil {
+		t.Errorf("broken: last error = %q, quarantined at %v, policy = %+v, want the error of a policy never accepted", broken.LastError, broken.QuarantinedAt, broken.Policy)
+	}
+
+	changing := statuses[2]
+	if changing.Source != PolicySourceStream || changing.Revision <= changing.CompiledRevision {
+		t.Errorf("changing: source = %q, revision = %d, compiled revision = %d, want a stream change after the compiled version", changing.Source, changing.Revision, changing.CompiledRevision)
+	}
+
+	statuses, _ = firewall.PolicyStatuses(true)
+	if len(statuses[0].Policy.IPBuckets["blacklist"]) != 2 {
+		t.Errorf("blocker: ip buckets = %v, want them when requested", statuses[0].Policy.IPBuckets)
+	}
+}
+
+func TestDumpPolicies(t *testing.T) {
+	firewall := newStatusFirewall(t)
+
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		wantStatus     int
+		wantPolicies   int
+		wantIPBuckets  bool
+		wantPolicyName string
+	}{
+		{name: "list", method: http.MethodGet, target: "/policies", wantStatus: http.StatusOK, wantPolicies: 4},
+		{name: "list with ip buckets", method: http.MethodGet, target: "/policies?ipbuckets=true", wantStatus: http.StatusOK, wantPolicies: 4, wantIPBuckets: true},
+		{name: "list without ip buckets", method: http.MethodGet, target: "/policies?ipbuckets=false", wantStatus: http.StatusOK, wantPolicies: 4},
+		{name: "invalid ipbuckets", method: http.MethodGet, target: "/policies?ipbuckets=maybe", wantStatus: http.StatusBadRequest},
+		{name: "list method not allowed", method: http.MethodPost, target: "/policies", wantStatus: http.StatusMethodNotAllowed},
+		{name: "policy", method: http.MethodGet, target: "/policies/blocker", wantStatus: http.StatusOK, wantPolicyName: "blocker"},
+		{name: "policy with ip buckets", method: http.MethodGet, target: "/policies/blocker?ipbuckets=1", wantStatus: http.StatusOK, wantPolicyName: "blocker", wantIPBuckets: true},
+		{name: "quarantined policy", method: http.MethodGet, target: "/policies/broken", wantStatus: http.StatusOK, wantPolicyName: "broken"},
+		{name: "unknown policy", method: http.MethodGet, target: "/policies/unknown", wantStatus: http.StatusNotFound},
+		{name: "policy method not allowed", method: http.MethodDelete, target: "/policies/blocker", wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/policies", firewall.DumpPolicies)
+	mux.HandleFunc("/policies/", firewall.DumpPolicy)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(test.method, test.target, nil))
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body)
+			}
+			if recorder.Code != http.StatusOK {
+				return
+			}
+			if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("content type = %q, want json", contentType)
+			}
+
+			var statuses []PolicyStatus
+			if test.wantPolicyName != "" {
+				var status PolicyStatus
+				if err := json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+					t.Fatal(err)
+				}
+				if status.Name != test.wantPolicyName {
+					t.Errorf("policy = %s, want %s", status.Name, test.wantPolicyName)
+				}
+				statuses = append(statuses, status)
+			} else {
+				var response struct {
+					Revision uint64         `json:"revision"`
+					Policies []PolicyStatus `json:"policies"`
+				}
+				if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+					t.Fatal(err)
+				}
+				if response.Revision != firewall.currentSnapshot().Revision || len(response.Policies) != test.wantPolicies {
+					t.Errorf("revision = %d with %d policies, want %d with %d", response.Revision, len(response.Policies), firewall.currentSnapshot().Revision, test.wantPolicies)
+				}
+				statuses = response.Policies
+			}
+
+			for _, status := range statuses {
+				if status.Name != "blocker" {
+					continue
+				}
+				if withIPBuckets := status.Policy.IPBuckets != nil; withIPBuckets != test.wantIPBuckets {
+					t.Errorf("blocker carries its ip buckets = %v, want %v", withIPBuckets, test.wantIPBuckets)
+				}
+			}
+		})
+	}
+}
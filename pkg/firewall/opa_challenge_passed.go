@@ -0,0 +1,44 @@
+package firewall
+
+import (
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// registerChallengePassed registers challenge_passed(input), true when the request carries
+// a valid clearance from the challenge action. Ex.:
+//
+//	deny {
+//	  not input.headers["user-agent"]
+//	  not challenge_passed(input)
+//	}
+//
+// action = {"type": "challenge"}
+func (firewall *Firewall) registerChallengePassed() func(r *rego.Rego) {
+	return rego.Function1(challengePassedFunction, firewall.builtinChallengePassed)
+}
+
+// challengePassedFunction declares challenge_passed(input).
+var challengePassedFunction = &rego.Function{
+	Name: "challenge_passed",
+	Decl: types.NewFunction(types.Args(types.A), types.B),
+}
+
+func (firewall *Firewall) builtinChallengePassed(bctx rego.BuiltinContext, input *ast.Term) (*ast.Term, error) {
+	if firewall.Challenger == nil {
+		return ast.BooleanTerm(false), nil
+	}
+
+	value, err := ast.JSON(input.Value)
+	if err != nil {
+		// opa hands a bare input argument over unresolved, the request input travels in the context.
+		value = bctx.Context.Value(inputContextKey{})
+	}
+	document, ok := value.(map[string]interface{})
+	if !ok {
+		return ast.BooleanTerm(false), nil
+	}
+
+	return ast.BooleanTerm(firewall.Challenger.Passed(document)), nil
+}
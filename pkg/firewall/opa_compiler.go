@@ -1,103 +1,164 @@
 package firewall
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"net"
+	"crypto/sha256"
+	"encoding/hex"
 	"time"
 
 	"github.com/cainelli/opa-firewall/pkg/iptree"
-	"github.com/open-policy-agent/opa/rego"
-	"github.com/open-policy-agent/opa/storage/inmem"
 )
 
-func (firewall *Firewall) periodicallyCompile() {
+// requestCompile schedules a Compile, requests arriving before it starts are compiled together.
+func (firewall *Firewall) requestCompile() {
+	select {
+	case firewall.compileRequests <- struct{}{}:
+	default:
+	}
+}
+
+// compileOnRequest compiles once the compile requests stop arriving for the compile interval,
+// every request restarts the wait so a burst of FULL events is compiled once.
+func (firewall *Firewall) compileOnRequest() {
+	timer := time.NewTimer(firewall.Configuration.CompileInterval)
+	timer.Stop()
+
 	for {
 		select {
-		case <-time.After(1 * time.Minute):
+		case <-firewall.compileRequests:
+			if !timer.Stop() {
+				// the timer fired but the compilation didn't start yet, it is postponed as well.
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(firewall.Configuration.CompileInterval)
+		case <-timer.C:
 			start := time.Now()
 			firewall.Logger.Info("starting recompiling rules")
-			firewall.Compile()
-			firewall.Logger.Infof("finished recompiling rules (took %s)", time.Since(start))
+			prepared := firewall.Compile()
+			firewall.Logger.Infof("finished recompiling rules, %d prepared (took %s)", prepared, time.Since(start))
 		}
 	}
 }
 
-// Compile ...
-// TODO:
-//   * gracefully handle errors
-func (firewall *Firewall) Compile() {
-	regoFunctions := []func(r *rego.Rego){
-		rego.Query(fmt.Sprintf("data")),
-		firewall.registerCustomBultin(),
+// Compile prepares a query for every policy package whose rego changed since it was last
+// compiled and rebuilds the tiers, it returns the number of queries prepared. The ip trees
+// and the data are kept up to date by the policy events and are not rebuilt, only the data
+// held back for the new rego is published along with its query.
+// Policies failing to compile are quarantined and their last known good query keeps serving,
+// along with the data and ip trees of the version it was compiled for.
+func (firewall *Firewall) Compile() int {
+	// holding the writer lock keeps patches consumed while compiling from being lost
+	// when the new snapshot is published. Requests keep using the current snapshot.
+	firewall.mutex.Lock()
+	defer firewall.mutex.Unlock()
+
+	current := firewall.currentSnapshot()
+
+	compiledQueries := make(map[string]*policyQuery)
+	for _, tier := range current.Tiers {
+		for _, query := range tier.Queries {
+			compiledQueries[query.Name] = query
+		}
 	}
-	stores := make(map[string]interface{})
-	ipTrees := make(IPTrees)
-
-	// TODO: implement mutex to avoid race conditions
-	for _, policy := range firewall.Policies {
-		// test module before adding it to the map.
-		if err := testRego(policy.Rego); err != nil {
-			// TODO: fix testRego and skip on error.
-			// continue
+
+	next := current.clone()
+	prepared := 0
+	queries := make([]*policyQuery, 0, len(current.Policies))
+	for _, policy := range current.Policies {
+		replaced, isReplacing := current.Replaced[policy.Name]
+		delete(next.Replaced, policy.Name)
+		if isReplacing {
+			next.setData(policy.Name, policy.Data)
 		}
 
-		// test if data is json compatible.
-		_, err := json.Marshal(policy.Data)
-		if err != nil {
-			firewall.Logger.Error(err)
+		if policy.Rego == "" {
 			continue
-		} else if policy.Data != nil {
-			stores[policy.Name] = policy.Data
 		}
 
-		if policy.IPBuckets != nil {
-			for bucketName, bucket := range policy.IPBuckets {
-				ipTree := iptree.New()
-				for ipString, expireAt := range bucket {
-					ip := net.ParseIP(ipString)
-
-					firewall.Logger.Infof("adding ip %s to iptree[%s][%s] expiring at: %v", ip, policy.Name, bucketName, expireAt)
-					err := ipTree.AddIP(ip, expireAt)
-					if err != nil {
-						firewall.Logger.Error(err)
-						continue
-					}
-				}
+		if query, ok := compiledQueries[policy.Name]; ok && query.Hash == regoHash(policy.Rego) {
+			// priority and dry run don't need the module to be compiled again.
+			reused := *query
+			reused.Priority = policy.Priority
+			reused.DryRun = policy.DryRun
+			queries = append(queries, &reused)
+			continue
+		}
 
-				if _, ok := ipTrees[policy.Name]; !ok {
-					ipTrees[policy.Name] = map[string]*iptree.IPTree{}
-				}
-				ipTrees[policy.Name][bucketName] = ipTree
+		// the rego is validated when the policy arrives but preparing it may still fail, the
+		// last known good query keeps serving until the policy is replaced.
+		if quarantined, ok := current.Quarantined[policy.Name]; ok && quarantined.Policy.Rego == policy.Rego {
+			if isReplacing {
+				firewall.restorePolicy(next, replaced, current.Metadata[policy.Name].Source)
 			}
-
+			if previous, ok := compiledQueries[policy.Name]; ok {
+				queries = append(queries, previous)
+			}
+			continue
 		}
 
-		regoFunctions = append(regoFunctions, rego.Package(policy.Name))
-		regoFunctions = append(regoFunctions, rego.Module(policy.Name, policy.Rego))
+		query, err := firewall.preparePolicyQuery(policy)
+		if err != nil {
+			firewall.Logger.Errorf("(quarantined) could not compile policy %s, the last known good version keeps serving: %v", policy.Name, err)
+			next.Quarantined[policy.Name] = QuarantinedPolicy{Policy: policy, Error: err.Error(), Time: time.Now()}
+
+			if isReplacing {
+				firewall.restorePolicy(next, replaced, current.Metadata[policy.Name].Source)
+			}
+			if previous, ok := compiledQueries[policy.Name]; ok {
+				queries = append(queries, previous)
+			}
+			continue
+		}
+		queries = append(queries, query)
+		prepared++
 	}
 
-	dataJSON, err := json.Marshal(stores)
-	if err != nil {
-		firewall.Logger.Error(err)
-		return
+	next.Tiers = firewall.buildPolicyTiers(queries, next.Policies, firewall.Configuration.CombiningAlgorithm)
+	firewall.publish(next)
+
+	return prepared
+}
+
+// restorePolicy places back the version the last known good query was compiled for.
+func (firewall *Firewall) restorePolicy(state *snapshot, policy PolicyEvent, source string) {
+	if err := firewall.applyPolicy(state, policy, source); err != nil {
+		firewall.Logger.Errorf("could not restore the data of policy %s: %v", policy.Name, err)
 	}
+}
 
-	store := inmem.NewFromReader(bytes.NewBuffer(dataJSON))
-	regoFunctions = append(regoFunctions, rego.Store(store))
+// buildIPTrees builds the ip trees of the policy buckets.
+func (firewall *Firewall) buildIPTrees(policy PolicyEvent) map[string]*iptree.IPTree {
+	ipTrees := make(map[string]*iptree.IPTree, len(policy.IPBuckets))
+	for bucketName, bucket := range policy.IPBuckets {
+		ipTree := iptree.New()
+		for ipString, entry := range bucket {
+			// expired entries are left for the garbage collector to evict from the bucket.
+			if time.Now().After(entry.ExpireAt) {
+				continue
+			}
 
-	regoFunctions = append(regoFunctions)
-	r := rego.New(
-		regoFunctions...,
-	)
+			network, err := iptree.ParseNetwork(ipString)
+			if err != nil {
+				firewall.Logger.Error(err)
+				continue
+			}
 
-	preparedEval, err := r.PrepareForEval(firewall.context)
-	if err != nil {
-		firewall.Logger.Error(err)
-		return
+			firewall.Logger.Infof("adding network %s to iptree[%s][%s] expiring at: %v", network, policy.Name, bucketName, entry.ExpireAt)
+			err = ipTree.AddCIDR(network, entry)
+			if err != nil {
+				firewall.Logger.Error(err)
+				continue
+			}
+		}
+		ipTrees[bucketName] = ipTree
 	}
+	return ipTrees
+}
 
-	firewall.PreparedEval = preparedEval
-	firewall.IPTrees = ipTrees
+// regoHash identifies the rego a query was prepared from.
+func regoHash(rego string) string {
+	sum := sha256.Sum256([]byte(rego))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,144 @@
+package firewall
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompileRestoresTheReplacedVersion(t *testing.T) {
+	expireAt := time.Now().Add(time.Hour)
+	firewall := newTestFirewall(PolicyEvent{
+		Name:      "blocker",
+		Type:      EventTypeFull,
+		Rego:      "package blocker\ndeny { data.blocker.enabled }\n",
+		Data:      map[string]interface{}{"enabled": true},
+		IPBuckets: IPBuckets{"blacklist": {"192.0.2.1": {ExpireAt: expireAt}}},
+	})
+	if prepared := firewall.Compile(); prepared != 1 {
+		t.Fatalf("Compile() = %d, want 1", prepared)
+	}
+
+	// deny is a function, the rego is valid on its own but the query can't be prepared.
+	firewall.replacePolicy(&PolicyEvent{
+		Name:      "blocker",
+		Type:      EventTypeFull,
+		Rego:      "package blocker\ndeny(x) { x }\n",
+		Data:      map[string]interface{}{"enabled": false},
+		IPBuckets: IPBuckets{"blacklist": {"198.51.100.1": {ExpireAt: expireAt}}},
+	})
+	if prepared := firewall.Compile(); prepared != 0 {
+		t.Fatalf("Compile() = %d, want 0", prepared)
+	}
+
+	state := firewall.currentSnapshot()
+	if len(state.Replaced) != 0 {
+		t.Errorf("replaced = %v, want none once compiled", state.Replaced)
+	}
+
+	if data, want := state.Data["blocker"], map[string]interface{}{"enabled": true}; !reflect.DeepEqual(data, want) {
+		t.Errorf("data = %v, want %v", data, want)
+	}
+
+	ipTree := state.IPTrees["blocker"]["blacklist"]
+	if _, ok := ipTree.GetIP(net.ParseIP("192.0.2.1")); !ok {
+		t.Error("192.0.2.1 of the serving version is not in the tree")
+	}
+	if _, ok := ipTree.GetIP(net.ParseIP("198.51.100.1")); ok {
+		t.Error("198.51.100.1 of the quarantined version is in the tree")
+	}
+
+	status, ok := firewall.PolicyStatus("blocker", false)
+	if !ok {
+		t.Fatal("PolicyStatus() didn't find the policy")
+	}
+	if status.Status != PolicyQuarantined || !status.Serving || status.LastError == "" {
+		t.Errorf("status = %s, serving = %v, last error = %q, want a quarantined policy still serving", status.Status, status.Serving, status.LastError)
+	}
+	if status.Policy.Rego != "package blocker\ndeny { data.blocker.enabled }\n" {
+		t.Errorf("policy rego = %q, want the serving version", status.Policy.Rego)
+	}
+
+	decision, err := firewall.Evaluate(map[string]interface{}{"ip": "203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed {
+		t.Error("the serving version should deny with its own data")
+	}
+}
+
+func TestFullDataIsPublishedWithItsRego(t *testing.T) {
+	firewall := newTestFirewall(PolicyEvent{
+		Name: "blocker",
+		Type: EventTypeFull,
+		Rego: "package blocker\ndeny { data.blocker.enabled }\n",
+		Data: map[string]interface{}{"enabled": true},
+	})
+	firewall.Compile()
+
+	denied := func() bool {
+		decision, err := firewall.Evaluate(map[string]interface{}{"ip": "203.0.113.7"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return !decision.Allowed
+	}
+
+	// the new rego reads another document, the serving one must keep reading its own until then.
+	firewall.replacePolicy(&PolicyEvent{
+		Name: "blocker",
+		Type: EventTypeFull,
+		Rego: "package blocker\ndeny { data.blocker.mode == \"block\" }\n",
+		Data: map[string]interface{}{"mode": "block"},
+	})
+	if !denied() {
+		t.Error("the serving rego read the data of the version waiting to be compiled")
+	}
+	firewall.patchPolicy(&PolicyEvent{Name: "blocker", Type: EventTypePatch, Data: map[string]interface{}{"mode": "log"}})
+	if !denied() {
+		t.Error("the serving rego read the data patched into the version waiting to be compiled")
+	}
+
+	firewall.Compile()
+	if denied() {
+		t.Error("the new rego should read the patched data once compiled")
+	}
+
+	// without a new rego the data is published right away.
+	firewall.replacePolicy(&PolicyEvent{
+		Name: "blocker",
+		Type: EventTypeFull,
+		Rego: "package blocker\ndeny { data.blocker.mode == \"block\" }\n",
+		Data: map[string]interface{}{"mode": "block"},
+	})
+	if !denied() {
+		t.Error("the data of a FULL event keeping the rego should be read right away")
+	}
+}
+
+func TestCompileOnRequestDebounces(t *testing.T) {
+	firewall := newTestFirewall(PolicyEvent{Name: "blocker", Type: EventTypeFull, Rego: "package blocker\ndeny { false }\n"})
+	firewall.Configuration.CompileInterval = 100 * time.Millisecond
+	go firewall.compileOnRequest()
+
+	revision := firewall.currentSnapshot().Revision
+	for i := 0; i < 5; i++ {
+		firewall.requestCompile()
+		time.Sleep(firewall.Configuration.CompileInterval / 5)
+	}
+	if compiled := firewall.currentSnapshot().Revision; compiled != revision {
+		t.Fatalf("compiled during the burst, revision %d, want %d", compiled, revision)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for firewall.currentSnapshot().Revision == revision && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(2 * firewall.Configuration.CompileInterval)
+
+	if compiled := firewall.currentSnapshot().Revision; compiled != revision+1 {
+		t.Errorf("revision = %d, want %d after a single compilation", compiled, revision+1)
+	}
+}
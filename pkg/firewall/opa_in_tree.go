@@ -9,18 +9,19 @@ import (
 	"github.com/open-policy-agent/opa/types"
 )
 
+// inTreeFunction declares in_tree(policy, bucket, ip).
+var inTreeFunction = &rego.Function{
+	Name: "in_tree",
+	Decl: types.NewFunction(types.Args(types.S, types.S, types.S), types.B),
+}
+
 // RegisterCustomBultin ...
 func (firewall *Firewall) registerCustomBultin() func(r *rego.Rego) {
-	return rego.Function3(
-		&rego.Function{
-			Name: "in_tree",
-			Decl: types.NewFunction(types.Args(types.S, types.S, types.S), types.B),
-		}, firewall.builtinInTree,
-	)
+	return rego.Function3(inTreeFunction, firewall.builtinInTree)
 }
 
-func (firewall *Firewall) builtinInTree(_ rego.BuiltinContext, policyName, treeName, ip *ast.Term) (*ast.Term, error) {
-	firewall.Logger.Info("built_in_tree called")
+func (firewall *Firewall) builtinInTree(bctx rego.BuiltinContext, policyName, treeName, ip *ast.Term) (*ast.Term, error) {
+	firewall.Logger.Debug("built_in_tree called")
 	if _, ok := policyName.Value.(ast.String); !ok {
 		return nil, nil
 	}
@@ -36,19 +37,25 @@ func (firewall *Firewall) builtinInTree(_ rego.BuiltinContext, policyName, treeN
 	policyNameString := string(policyName.Value.(ast.String))
 	treeNameString := string(treeName.Value.(ast.String))
 
-	if _, ok := firewall.IPTrees[policyNameString]; !ok {
+	state, ok := bctx.Context.Value(snapshotContextKey{}).(*snapshot)
+	if !ok {
+		firewall.Logger.Info("no snapshot found in evaluation context")
+		return nil, nil
+	}
+
+	if _, ok := state.IPTrees[policyNameString]; !ok {
 		firewall.Logger.Infof("couldn't find ip tree for policy %s", policyNameString)
 		return nil, nil
 	}
 
-	if _, ok := firewall.IPTrees[policyNameString][treeNameString]; !ok {
+	if _, ok := state.IPTrees[policyNameString][treeNameString]; !ok {
 		firewall.Logger.Infof("couldn't find ip tree for policy %s and bucket %s", policyNameString, treeNameString)
 		return nil, nil
 	}
 
-	ipTree := firewall.IPTrees[policyNameString][treeNameString]
-	if expireAt, exist := ipTree.GetIP(net.ParseIP(ipString)); exist {
-		if time.Now().After(expireAt) {
+	ipTree := state.IPTrees[policyNameString][treeNameString]
+	if entry, exist := ipTree.GetIP(net.ParseIP(ipString)); exist {
+		if time.Now().After(entry.ExpireAt) {
 			firewall.Logger.Infof("policy %s lookup ip %s in tree %s is true but expired", policyNameString, ipString, treeNameString)
 			return nil, nil
 		}
@@ -0,0 +1,70 @@
+package firewall
+
+import (
+	"net"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/open-policy-agent/opa/types"
+)
+
+// registerInTreeEntry registers in_tree_entry(policy, bucket, ip), the entry of the most specific
+// network containing the ip, undefined when the ip is not in the tree or the entry expired. Ex.:
+//
+//	reason = sprintf("blacklisted after %d hits: %s", [entry.hits, entry.reason]) {
+//	  entry := in_tree_entry("nouseragent", "blacklist", input.ip)
+//	}
+//
+// The entry is an object with network, expire_at, reason, source, created_at, hits and score.
+// created_at is only set when the entry carries it.
+func (firewall *Firewall) registerInTreeEntry() func(r *rego.Rego) {
+	return rego.Function3(inTreeEntryFunction, firewall.builtinInTreeEntry)
+}
+
+// inTreeEntryFunction declares in_tree_entry(policy, bucket, ip).
+var inTreeEntryFunction = &rego.Function{
+	Name: "in_tree_entry",
+	Decl: types.NewFunction(types.Args(types.S, types.S, types.S), types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+}
+
+func (firewall *Firewall) builtinInTreeEntry(bctx rego.BuiltinContext, policyName, treeName, ip *ast.Term) (*ast.Term, error) {
+	policyNameString, ok := policyName.Value.(ast.String)
+	if !ok {
+		return nil, nil
+	}
+	treeNameString, ok := treeName.Value.(ast.String)
+	if !ok {
+		return nil, nil
+	}
+	ipString, ok := ip.Value.(ast.String)
+	if !ok {
+		return nil, nil
+	}
+
+	state, ok := bctx.Context.Value(snapshotContextKey{}).(*snapshot)
+	if !ok {
+		firewall.Logger.Info("no snapshot found in evaluation context")
+		return nil, nil
+	}
+
+	ipTree, ok := state.IPTrees[string(policyNameString)][string(treeNameString)]
+	if !ok {
+		firewall.Logger.Debugf("couldn't find ip tree for policy %s and bucket %s", policyNameString, treeNameString)
+		return nil, nil
+	}
+
+	network, entry, exist := ipTree.GetNetwork(net.ParseIP(string(ipString)))
+	if !exist || time.Now().After(entry.ExpireAt) {
+		return nil, nil
+	}
+
+	document := entry.ToMap()
+	document["network"] = network
+	value, err := ast.InterfaceToValue(document)
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.NewTerm(value), nil
+}
@@ -0,0 +1,153 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// policyQuery is the query prepared for a single policy package. Every policy is compiled
+// in isolation so a broken package can't keep the others from being compiled or evaluated.
+type policyQuery struct {
+	Name     string
+	Priority int
+	DryRun   bool
+	// Package is the path of the policy package, Ex.: data.supplier.
+	Package string
+	// Hash identifies the rego the query was prepared from, see regoHash.
+	Hash string
+	// Revision is the revision of the snapshot the query was first published in.
+	Revision     uint64
+	PreparedEval rego.PreparedEvalQuery
+	// Stats are shared by the copies of the query made when its policy changes priority or dry run.
+	Stats *policyStats
+}
+
+// policyResult is the outcome of evaluating a single policy package.
+type policyResult struct {
+	Allow bool
+	Deny  bool
+	// Reason is the value of the reason rule when defined, or the messages of a partial deny set.
+	Reason interface{}
+	// Action is the value of the action rule when defined.
+	Action *Action
+}
+
+// policyQueryBody collects the allow, deny, reason and action rules of a package. Comprehensions
+// keep the query defined when the package doesn't declare one of the rules.
+const policyQueryBody = "allow := [x | x := %[1]s.allow]; deny := [x | x := %[1]s.deny]; reason := [x | x := %[1]s.reason]; action := [x | x := %[1]s.action]"
+
+// preparePolicyQuery compiles the policy module on its own against the snapshot store.
+func (firewall *Firewall) preparePolicyQuery(policy PolicyEvent) (*policyQuery, error) {
+	module, err := ast.ParseModule(policy.Name, policy.Rego)
+	if err != nil {
+		return nil, err
+	}
+	if module == nil {
+		return nil, fmt.Errorf("policy %s has an empty rego module", policy.Name)
+	}
+
+	packagePath := module.Package.Path.String()
+	preparedEval, err := rego.New(
+		rego.Query(fmt.Sprintf(policyQueryBody, packagePath)),
+		rego.ParsedModule(module),
+		rego.Store(firewall.store),
+		firewall.registerCustomBultin(),
+		firewall.registerInTreeEntry(),
+		firewall.registerChallengePassed(),
+	).PrepareForEval(firewall.context)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policyQuery{
+		Name:         policy.Name,
+		Priority:     policy.Priority,
+		DryRun:       policy.DryRun,
+		Package:      packagePath,
+		Hash:         regoHash(policy.Rego),
+		Revision:     firewall.revision + 1,
+		Stats:        &policyStats{},
+		PreparedEval: preparedEval,
+	}, nil
+}
+
+// sortPolicyQueries orders the queries by descending priority, then by name.
+func sortPolicyQueries(queries []*policyQuery) {
+	sort.Slice(queries, func(i, j int) bool {
+		if queries[i].Priority != queries[j].Priority {
+			return queries[i].Priority > queries[j].Priority
+		}
+		return queries[i].Name < queries[j].Name
+	})
+}
+
+// eval runs the policy query against the input.
+func (query *policyQuery) eval(ctx context.Context, input map[string]interface{}) (policyResult, error) {
+	resultSet, err := query.PreparedEval.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return policyResult{}, err
+	}
+	if len(resultSet) == 0 {
+		return policyResult{}, nil
+	}
+
+	return parsePolicyResult(resultSet[0].Bindings)
+}
+
+// parsePolicyResult reads the collected rules. allow and deny are either complete boolean
+// rules or partial sets, in which case any member matches. Other shapes are errors, the
+// action is only read when the policy matched.
+func parsePolicyResult(bindings rego.Vars) (policyResult, error) {
+	var result policyResult
+	var err error
+
+	if result.Allow, _, err = parseRule(bindings, "allow"); err != nil {
+		return policyResult{}, err
+	}
+
+	var messages []interface{}
+	if result.Deny, messages, err = parseRule(bindings, "deny"); err != nil {
+		return policyResult{}, err
+	}
+	if len(messages) > 0 {
+		result.Reason = messages
+	}
+
+	if reasons, ok := bindings["reason"].([]interface{}); ok && len(reasons) > 0 {
+		result.Reason = reasons[0]
+	}
+
+	// an invalid action falls back to the enforcer default, the policy still matches.
+	if actions, ok := bindings["action"].([]interface{}); ok && len(actions) > 0 && (result.Allow || result.Deny) {
+		if result.Action, err = parseAction(actions[0]); err != nil {
+			result.Action = nil
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// parseRule returns whether the rule matched and, for partial sets, its members.
+func parseRule(bindings rego.Vars, name string) (bool, []interface{}, error) {
+	values, ok := bindings[name].([]interface{})
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected %s binding %T", name, bindings[name])
+	}
+	if len(values) == 0 {
+		return false, nil, nil
+	}
+
+	switch value := values[0].(type) {
+	case bool:
+		return value, nil, nil
+	case []interface{}:
+		return len(value) > 0, value, nil
+	default:
+		return false, nil, fmt.Errorf("%s rule must be a boolean or a set, got %T", name, value)
+	}
+}
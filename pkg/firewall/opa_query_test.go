@@ -0,0 +1,180 @@
+package firewall
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// policyBindings are the bindings of a policy query, rules left out are undefined.
+func policyBindings(rules map[string][]interface{}) rego.Vars {
+	bindings := rego.Vars{}
+	for _, name := range []string{"allow", "deny", "reason", "action"} {
+		values := rules[name]
+		if values == nil {
+			values = []interface{}{}
+		}
+		bindings[name] = values
+	}
+	return bindings
+}
+
+func TestParsePolicyResult(t *testing.T) {
+	redirect := map[string]interface{}{"type": "redirect", "location": "https://www.example.com/blocked"}
+
+	tests := []struct {
+		name     string
+		bindings rego.Vars
+		want     policyResult
+		wantErr  bool
+	}{
+		{
+			name:     "undefined rules",
+			bindings: policyBindings(nil),
+			want:     policyResult{},
+		},
+		{
+			name:     "deny",
+			bindings: policyBindings(map[string][]interface{}{"deny": {true}}),
+			want:     policyResult{Deny: true},
+		},
+		{
+			name:     "deny false",
+			bindings: policyBindings(map[string][]interface{}{"deny": {false}}),
+			want:     policyResult{},
+		},
+		{
+			name:     "allow",
+			bindings: policyBindings(map[string][]interface{}{"allow": {true}}),
+			want:     policyResult{Allow: true},
+		},
+		{
+			name:     "partial deny set",
+			bindings: policyBindings(map[string][]interface{}{"deny": {[]interface{}{"scanner", "no user agent"}}}),
+			want:     policyResult{Deny: true, Reason: []interface{}{"scanner", "no user agent"}},
+		},
+		{
+			name:     "empty partial deny set",
+			bindings: policyBindings(map[string][]interface{}{"deny": {[]interface{}{}}}),
+			want:     policyResult{},
+		},
+		{
+			name:     "partial allow set",
+			bindings: policyBindings(map[string][]interface{}{"allow": {[]interface{}{"office"}}}),
+			want:     policyResult{Allow: true},
+		},
+		{
+			name:     "reason",
+			bindings: policyBindings(map[string][]interface{}{"deny": {true}, "reason": {"scanner"}}),
+			want:     policyResult{Deny: true, Reason: "scanner"},
+		},
+		{
+			name:     "reason wins over the deny messages",
+			bindings: policyBindings(map[string][]interface{}{"deny": {[]interface{}{"scanner"}}, "reason": {"bad bot"}}),
+			want:     policyResult{Deny: true, Reason: "bad bot"},
+		},
+		{
+			name:     "action",
+			bindings: policyBindings(map[string][]interface{}{"deny": {true}, "action": {redirect}}),
+			want:     policyResult{Deny: true, Action: &Action{Type: ActionRedirect, Location: "https://www.example.com/blocked"}},
+		},
+		{
+			name:     "action of an allow",
+			bindings: policyBindings(map[string][]interface{}{"allow": {true}, "action": {map[string]interface{}{"type": "log"}}}),
+			want:     policyResult{Allow: true, Action: &Action{Type: ActionLog}},
+		},
+		{
+			name:     "action without a match",
+			bindings: policyBindings(map[string][]interface{}{"action": {map[string]interface{}{"type": "unknown"}}}),
+			want:     policyResult{},
+		},
+		{
+			name:     "invalid action",
+			bindings: policyBindings(map[string][]interface{}{"deny": {true}, "action": {map[string]interface{}{"type": "redirect"}}}),
+			want:     policyResult{Deny: true},
+			wantErr:  true,
+		},
+		{
+			name:     "malformed action",
+			bindings: policyBindings(map[string][]interface{}{"deny": {true}, "action": {"block"}}),
+			want:     policyResult{Deny: true},
+			wantErr:  true,
+		},
+		{
+			name:     "non boolean deny",
+			bindings: policyBindings(map[string][]interface{}{"deny": {"yes"}}),
+			wantErr:  true,
+		},
+		{
+			name:     "non boolean allow",
+			bindings: policyBindings(map[string][]interface{}{"allow": {float64(1)}, "deny": {true}}),
+			wantErr:  true,
+		},
+		{
+			name:     "missing deny",
+			bindings: rego.Vars{"allow": []interface{}{}, "reason": []interface{}{}, "action": []interface{}{}},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := parsePolicyResult(test.bindings)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parsePolicyResult() error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(result, test.want) {
+				t.Errorf("parsePolicyResult() = %+v, want %+v", result, test.want)
+			}
+		})
+	}
+}
+
+func TestPolicyQueryEval(t *testing.T) {
+	firewall := newTestFirewall()
+
+	tests := []struct {
+		name string
+		rego string
+		want policyResult
+	}{
+		{
+			name: "no rules",
+			rego: "package empty\n\nhelper = true\n",
+			want: policyResult{},
+		},
+		{
+			name: "complete rules",
+			rego: "package complete\n\ndeny {\n  input.path == \"/admin\"\n}\n\nreason = \"admin\" {\n  deny\n}\n",
+			want: policyResult{Deny: true, Reason: "admin"},
+		},
+		{
+			name: "partial set",
+			rego: "package partial\n\ndeny[msg] {\n  input.path == \"/admin\"\n  msg := \"admin\"\n}\n",
+			want: policyResult{Deny: true, Reason: []interface{}{"admin"}},
+		},
+		{
+			name: "action",
+			rego: "package action\n\ndeny = true\n\naction = {\"type\": \"block\", \"status\": 403}\n",
+			want: policyResult{Deny: true, Action: &Action{Type: ActionBlock, Status: 403}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query, err := firewall.preparePolicyQuery(PolicyEvent{Name: test.name, Type: EventTypeFull, Rego: test.rego})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := query.eval(firewall.context, map[string]interface{}{"path": "/admin"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(result, test.want) {
+				t.Errorf("eval() = %+v, want %+v", result, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/open-policy-agent/opa/storage"
+	"github.com/open-policy-agent/opa/storage/inmem"
+)
+
+// snapshotStore is the store the policy queries are prepared against. Reads resolve in the data
+// of the snapshot being evaluated, the one in the evaluation context, so the data is published
+// along with the queries and ip trees reading it. The embedded store only hands out the
+// transactions, nothing is ever written to it.
+type snapshotStore struct {
+	storage.Store
+	firewall *Firewall
+}
+
+func newSnapshotStore(firewall *Firewall) *snapshotStore {
+	return &snapshotStore{Store: inmem.New(), firewall: firewall}
+}
+
+// Read returns the document at path in the data of the snapshot being evaluated, or of the
+// current snapshot outside of an evaluation.
+func (store *snapshotStore) Read(ctx context.Context, txn storage.Transaction, path storage.Path) (interface{}, error) {
+	state, ok := ctx.Value(snapshotContextKey{}).(*snapshot)
+	if !ok {
+		state = store.firewall.currentSnapshot()
+	}
+
+	var document interface{} = state.Data
+	for _, key := range path {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			if document, ok = node[key]; !ok {
+				return nil, notFoundError(path)
+			}
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, notFoundError(path)
+			}
+			document = node[index]
+		default:
+			return nil, notFoundError(path)
+		}
+	}
+
+	return document, nil
+}
+
+func notFoundError(path storage.Path) error {
+	return &storage.Error{
+		Code:    storage.NotFoundErr,
+		Message: fmt.Sprintf("%v: document does not exist", path),
+	}
+}
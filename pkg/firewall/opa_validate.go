@@ -0,0 +1,43 @@
+package firewall
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+// QuarantinedPolicy is a policy version rejected because its rego doesn't compile. The last
+// known good version of the policy, if any, keeps serving until a valid version arrives.
+type QuarantinedPolicy struct {
+	Policy PolicyEvent `json:"policy"`
+	Error  string      `json:"error"`
+	Time   time.Time   `json:"time"`
+}
+
+// customFunctions are the builtins registered by the firewall in every prepared query.
+var customFunctions = []*rego.Function{inTreeFunction, inTreeEntryFunction, challengePassedFunction}
+
+// validateRego compiles the module alone with the firewall builtins declared, as it is compiled
+// when the query is prepared, so invalid policies are rejected before reaching the enforcer.
+func validateRego(name, rego string) error {
+	module, err := ast.ParseModule(name, rego)
+	if err != nil {
+		return err
+	}
+	if module == nil {
+		return fmt.Errorf("policy %s has an empty rego module", name)
+	}
+
+	builtins := make(map[string]*ast.Builtin, len(customFunctions))
+	for _, function := range customFunctions {
+		builtins[function.Name] = &ast.Builtin{Name: function.Name, Decl: function.Decl}
+	}
+
+	compiler := ast.NewCompiler().WithBuiltins(builtins)
+	if compiler.Compile(map[string]*ast.Module{name: module}); compiler.Failed() {
+		return compiler.Errors
+	}
+	return nil
+}
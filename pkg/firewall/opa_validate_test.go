@@ -0,0 +1,87 @@
+package firewall
+
+import "testing"
+
+func TestValidateRego(t *testing.T) {
+	tests := []struct {
+		name    string
+		rego    string
+		wantErr bool
+	}{
+		{
+			name: "plain policy",
+			rego: "package nouseragent\n\ndefault deny = false\n\ndeny {\n  not input.headers[\"user-agent\"]\n}\n",
+		},
+		{
+			name: "in_tree",
+			rego: "package blocker\ndeny { in_tree(\"blocker\", \"blacklist\", input.ip) }\n",
+		},
+		{
+			name: "in_tree_entry",
+			rego: "package blocker\nreason = entry.reason { entry := in_tree_entry(\"blocker\", \"blacklist\", input.ip) }\n",
+		},
+		{
+			name: "challenge_passed",
+			rego: "package challenger\ndeny { not challenge_passed(input) }\naction = {\"type\": \"challenge\"}\n",
+		},
+		{
+			name: "data of another policy",
+			rego: "package login\ndeny { input.path == data.shared.paths[_] }\n",
+		},
+		{
+			name:    "empty",
+			rego:    "",
+			wantErr: true,
+		},
+		{
+			name:    "parse error",
+			rego:    "package broken\ndeny {",
+			wantErr: true,
+		},
+		{
+			name:    "unsafe variable",
+			rego:    "package unsafe\ndeny { x > 1 }\n",
+			wantErr: true,
+		},
+		{
+			name:    "unknown builtin",
+			rego:    "package unknown\ndeny { in_blacklist(input.ip) }\n",
+			wantErr: true,
+		},
+		{
+			name:    "in_tree without the ip",
+			rego:    "package blocker\ndeny { in_tree(\"blocker\", \"blacklist\") }\n",
+			wantErr: true,
+		},
+		{
+			name:    "in_tree with a number",
+			rego:    "package blocker\ndeny { in_tree(\"blocker\", \"blacklist\", 1) }\n",
+			wantErr: true,
+		},
+		{
+			// the argument following the declared ones is the output, one more is an error.
+			name:    "in_tree_entry with too many arguments",
+			rego:    "package blocker\ndeny { in_tree_entry(\"blocker\", \"blacklist\", input.ip, entry, true) }\n",
+			wantErr: true,
+		},
+		{
+			name:    "challenge_passed without input",
+			rego:    "package challenger\ndeny { not challenge_passed() }\n",
+			wantErr: true,
+		},
+		{
+			name:    "challenge_passed with too many arguments",
+			rego:    "package challenger\ndeny { not challenge_passed(input, input.ip, true) }\n",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateRego(test.name, test.rego)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateRego() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package firewall
+
+import (
+	"github.com/cainelli/opa-firewall/pkg/iptree"
+)
+
+// snapshot holds the compiled state used to evaluate requests. The tiers, ip trees, data and
+// policies of a published snapshot are never mutated: writers build a new one from the
+// current and swap it atomically, so readers on the request path never need to lock and
+// a request reads the data of the revision it is evaluated with, see snapshotStore.
+type snapshot struct {
+	// Revision increases every time a snapshot is published.
+	Revision uint64
+	// Tiers are the compiled policies grouped by priority, in evaluation order.
+	Tiers []*policyTier
+	// Data holds the data document of every policy by name, as read by the queries of the tiers.
+	// The data of a FULL event whose rego waits to be compiled is held back until it is.
+	Data     map[string]interface{}
+	IPTrees  IPTrees
+	Policies map[string]PolicyEvent
+	// Quarantined holds the rejected version of the policies by name.
+	Quarantined map[string]QuarantinedPolicy
+	// Replaced holds the version a FULL event replaced while the new rego waits to be compiled,
+	// it is restored if the new rego fails to compile.
+	Replaced map[string]PolicyEvent
+	// Metadata tells where each policy came from and when it last changed.
+	Metadata map[string]policyMetadata
+	// Tombstones holds the ip bucket entries removed by patches by policy, until they expire. FULL
+	// events still carrying them, Ex.: from the cache of a generator, don't add them back.
+	Tombstones map[string]IPBuckets
+}
+
+type snapshotContextKey struct{}
+
+// inputContextKey holds the input of the request being evaluated.
+type inputContextKey struct{}
+
+// currentSnapshot returns the snapshot currently serving requests.
+func (firewall *Firewall) currentSnapshot() *snapshot {
+	return firewall.state.Load().(*snapshot)
+}
+
+// publish makes the snapshot visible to new requests. Callers must hold firewall.mutex.
+func (firewall *Firewall) publish(state *snapshot) {
+	firewall.revision++
+	state.Revision = firewall.revision
+	firewall.state.Store(state)
+}
+
+// clone returns a copy of the snapshot whose maps can be modified without affecting
+// the original. Policies, data documents and trees themselves are shared and must be
+// copied before they are changed.
+func (state *snapshot) clone() *snapshot {
+	data := make(map[string]interface{}, len(state.Data))
+	for name, document := range state.Data {
+		data[name] = document
+	}
+
+	policies := make(map[string]PolicyEvent, len(state.Policies))
+	for name, policy := range state.Policies {
+		policies[name] = policy
+	}
+
+	ipTrees := make(IPTrees, len(state.IPTrees))
+	for policyName, buckets := range state.IPTrees {
+		ipTrees[policyName] = make(map[string]*iptree.IPTree, len(buckets))
+		for bucketName, tree := range buckets {
+			ipTrees[policyName][bucketName] = tree
+		}
+	}
+
+	quarantined := make(map[string]QuarantinedPolicy, len(state.Quarantined))
+	for name, policy := range state.Quarantined {
+		quarantined[name] = policy
+	}
+
+	replaced := make(map[string]PolicyEvent, len(state.Replaced))
+	for name, policy := range state.Replaced {
+		replaced[name] = policy
+	}
+
+	metadata := make(map[string]policyMetadata, len(state.Metadata))
+	for name, policyMetadata := range state.Metadata {
+		metadata[name] = policyMetadata
+	}
+
+	tombstones := make(map[string]IPBuckets, len(state.Tombstones))
+	for name, ipBuckets := range state.Tombstones {
+		tombstones[name] = ipBuckets
+	}
+
+	return &snapshot{
+		Tiers:       state.Tiers,
+		Data:        data,
+		IPTrees:     ipTrees,
+		Policies:    policies,
+		Quarantined: quarantined,
+		Replaced:    replaced,
+		Metadata:    metadata,
+		Tombstones:  tombstones,
+	}
+}
+
+// setData places the data document of the policy in the snapshot, a nil document removes it.
+func (state *snapshot) setData(policyName string, document interface{}) {
+	if document == nil {
+		delete(state.Data, policyName)
+		return
+	}
+	state.Data[policyName] = document
+}
+
+// getIPTreeCopyOrNew returns a copy of the tree for the given bucket, or a new one,
+// and places it in the snapshot. Trees are backed by immutable radix trees so the
+// copy is cheap and inserts on it don't leak into previous snapshots.
+func (state *snapshot) getIPTreeCopyOrNew(policyName, bucketName string) *iptree.IPTree {
+	if _, ok := state.IPTrees[policyName]; !ok {
+		state.IPTrees[policyName] = map[string]*iptree.IPTree{}
+	}
+
+	ipTree := iptree.New()
+	if current, ok := state.IPTrees[policyName][bucketName]; ok {
+		treeCopy := *current
+		ipTree = &treeCopy
+	}
+	state.IPTrees[policyName][bucketName] = ipTree
+
+	return ipTree
+}
+
+// addTombstone records the entry removed from the bucket. The tombstones are copied before
+// they are changed, they are shared with the previous snapshots.
+func (state *snapshot) addTombstone(policyName, bucketName, key string, entry IPEntry) {
+	tombstones := make(IPBuckets, len(state.Tombstones[policyName])+1)
+	for name, bucket := range state.Tombstones[policyName] {
+		tombstones[name] = bucket
+	}
+
+	bucket := make(IPBucket, len(tombstones[bucketName])+1)
+	for ipString, tombstone := range tombstones[bucketName] {
+		bucket[ipString] = tombstone
+	}
+	bucket[key] = entry
+	tombstones[bucketName] = bucket
+
+	state.Tombstones[policyName] = tombstones
+}
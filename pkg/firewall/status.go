@@ -0,0 +1,206 @@
+package firewall
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// PolicySourceStatic policies are read from the policies directory at startup.
+	PolicySourceStatic = "static"
+	// PolicySourceStream policies are consumed from the PolicyTopicName.
+	PolicySourceStream = "stream"
+)
+
+const (
+	// PolicyCompiled policies are evaluated with their current rego.
+	PolicyCompiled = "compiled"
+	// PolicyPending policies changed their rego and wait for the next compilation.
+	PolicyPending = "pending"
+	// PolicyQuarantined policies were rejected, their last known good version, if any, is evaluated.
+	PolicyQuarantined = "quarantined"
+	// PolicyDataOnly policies have no rego, their data and ip trees are used by other policies.
+	PolicyDataOnly = "data-only"
+)
+
+// policyMetadata tells where a policy came from and when it last changed.
+type policyMetadata struct {
+	Source    string
+	Revision  uint64
+	UpdatedAt time.Time
+}
+
+// nextMetadata returns the metadata of a policy changed in the next published snapshot.
+// Callers must hold firewall.mutex.
+func (firewall *Firewall) nextMetadata(source string) policyMetadata {
+	return policyMetadata{
+		Source:    source,
+		Revision:  firewall.revision + 1,
+		UpdatedAt: time.Now(),
+	}
+}
+
+// PolicyStatus is the lifecycle status of a policy on this enforcer.
+type PolicyStatus struct {
+	Name string `json:"name"`
+	// Source is static or stream.
+	Source string `json:"source,omitempty"`
+	// Revision of the snapshot where the policy last changed, UpdatedAt is when it happened.
+	Revision  uint64    `json:"revision"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Status is compiled, pending, quarantined or data-only.
+	Status string `json:"status"`
+	// Serving is set when a compiled version of the policy is evaluated, CompiledRevision is the
+	// revision of the snapshot where that version was first published.
+	Serving          bool   `json:"serving"`
+	CompiledRevision uint64 `json:"compiled_revision,omitempty"`
+	// LastError is why the policy was quarantined, QuarantinedAt is when.
+	LastError     string     `json:"last_error,omitempty"`
+	QuarantinedAt *time.Time `json:"quarantined_at,omitempty"`
+	// IPEntries is keyed by bucket and holds the number of networks in its ip tree.
+	IPEntries map[string]int `json:"ip_entries,omitempty"`
+	// Stats are the evaluations of the compiled version serving.
+	Stats *PolicyEvalStats `json:"stats,omitempty"`
+	// Policy is the version accepted, its ip buckets are left out unless requested.
+	Policy *PolicyEvent `json:"policy,omitempty"`
+}
+
+// PolicyEvalStats counts the evaluations of a compiled policy.
+type PolicyEvalStats struct {
+	Evaluations     uint64        `json:"evaluations"`
+	Allows          uint64        `json:"allows"`
+	Denies          uint64        `json:"denies"`
+	Errors          uint64        `json:"errors"`
+	AverageDuration time.Duration `json:"average_duration"`
+}
+
+// policyStats are updated by every evaluation, concurrently.
+type policyStats struct {
+	evaluations uint64
+	allows      uint64
+	denies      uint64
+	errors      uint64
+	nanoseconds uint64
+}
+
+func (stats *policyStats) record(result policyResult, duration time.Duration, err error) {
+	atomic.AddUint64(&stats.evaluations, 1)
+	atomic.AddUint64(&stats.nanoseconds, uint64(duration))
+	if err != nil {
+		atomic.AddUint64(&stats.errors, 1)
+	}
+	if result.Allow {
+		atomic.AddUint64(&stats.allows, 1)
+	}
+	if result.Deny {
+		atomic.AddUint64(&stats.denies, 1)
+	}
+}
+
+func (stats *policyStats) read() *PolicyEvalStats {
+	evalStats := &PolicyEvalStats{
+		Evaluations: atomic.LoadUint64(&stats.evaluations),
+		Allows:      atomic.LoadUint64(&stats.allows),
+		Denies:      atomic.LoadUint64(&stats.denies),
+		Errors:      atomic.LoadUint64(&stats.errors),
+	}
+	if evalStats.Evaluations > 0 {
+		evalStats.AverageDuration = time.Duration(atomic.LoadUint64(&stats.nanoseconds) / evalStats.Evaluations)
+	}
+	return evalStats
+}
+
+// PolicyStatuses returns the status of every policy, quarantined ones included, sorted by name.
+// The policies carry their ip buckets only when withIPBuckets is set. It also returns the
+// revision of the snapshot serving requests.
+func (firewall *Firewall) PolicyStatuses(withIPBuckets bool) ([]PolicyStatus, uint64) {
+	state := firewall.currentSnapshot()
+	queries := state.queriesByName()
+
+	names := make([]string, 0, len(state.Policies)+len(state.Quarantined))
+	for name := range state.Policies {
+		names = append(names, name)
+	}
+	for name := range state.Quarantined {
+		if _, ok := state.Policies[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	statuses := make([]PolicyStatus, 0, len(names))
+	for _, name := range names {
+		statuses = append(statuses, state.policyStatus(name, queries, withIPBuckets))
+	}
+	return statuses, state.Revision
+}
+
+// PolicyStatus returns the status of a policy, false when the enforcer doesn't know it.
+func (firewall *Firewall) PolicyStatus(name string, withIPBuckets bool) (PolicyStatus, bool) {
+	state := firewall.currentSnapshot()
+	_, found := state.Policies[name]
+	if _, quarantined := state.Quarantined[name]; !found && !quarantined {
+		return PolicyStatus{}, false
+	}
+	return state.policyStatus(name, state.queriesByName(), withIPBuckets), true
+}
+
+func (state *snapshot) queriesByName() map[string]*policyQuery {
+	queries := make(map[string]*policyQuery)
+	for _, tier := range state.Tiers {
+		for _, query := range tier.Queries {
+			queries[query.Name] = query
+		}
+	}
+	return queries
+}
+
+func (state *snapshot) policyStatus(name string, queries map[string]*policyQuery, withIPBuckets bool) PolicyStatus {
+	metadata := state.Metadata[name]
+	status := PolicyStatus{
+		Name:      name,
+		Source:    metadata.Source,
+		Revision:  metadata.Revision,
+		UpdatedAt: metadata.UpdatedAt,
+	}
+
+	policy, found := state.Policies[name]
+	query, serving := queries[name]
+	if serving {
+		status.Serving = true
+		status.CompiledRevision = query.Revision
+		status.Stats = query.Stats.read()
+	}
+
+	switch quarantined, ok := state.Quarantined[name]; {
+	case ok:
+		status.Status = PolicyQuarantined
+		status.LastError = quarantined.Error
+		status.QuarantinedAt = &quarantined.Time
+	case policy.Rego == "":
+		status.Status = PolicyDataOnly
+	case serving && query.Hash == regoHash(policy.Rego):
+		status.Status = PolicyCompiled
+	default:
+		status.Status = PolicyPending
+	}
+
+	if !found {
+		return status
+	}
+
+	if len(state.IPTrees[name]) > 0 {
+		status.IPEntries = make(map[string]int, len(state.IPTrees[name]))
+		for bucketName, ipTree := range state.IPTrees[name] {
+			status.IPEntries[bucketName] = ipTree.Len()
+		}
+	}
+
+	if !withIPBuckets {
+		policy.IPBuckets = nil
+	}
+	status.Policy = &policy
+
+	return status
+}
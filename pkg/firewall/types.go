@@ -2,25 +2,38 @@ package firewall
 
 import (
 	"context"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cainelli/opa-firewall/pkg/iptree"
-	"github.com/open-policy-agent/opa/rego"
+	"github.com/cainelli/opa-firewall/pkg/jsonpatch"
+	"github.com/open-policy-agent/opa/storage"
 	"github.com/sirupsen/logrus"
 )
 
 // Firewall defines the data structure used by firewall handler
 type Firewall struct {
-	Configuration    *Configuration
-	Logger           *logrus.Logger
-	PreparedEval     rego.PreparedEvalQuery
-	IPTrees          IPTrees
-	Policies         map[string]PolicyEvent
-	PoliciesBacklog  int
-	CompileInterval  time.Duration
-	context          context.Context
-	warmedUp         chan bool
-	startedConsuming bool
+	Configuration *Configuration
+	Logger        *logrus.Logger
+	// PoliciesBacklog is the lag of the policies consumer, it must be accessed atomically.
+	PoliciesBacklog int64
+	context         context.Context
+	// store is the store the queries are prepared against, see snapshotStore.
+	store storage.Store
+	// Challenger serves the challenge action, challenged requests are blocked when nil.
+	Challenger Challenger
+	// state holds the *snapshot serving requests. mutex serializes writers building
+	// the next snapshot, readers only load state.
+	state           atomic.Value
+	mutex           sync.Mutex
+	revision        uint64
+	compileRequests chan struct{}
+	decisionEvents  chan DecisionEvent
+	warmedUp        chan bool
+	// startedConsuming is set to 1 by the policies consumer, it must be accessed atomically.
+	startedConsuming int32
 }
 
 const (
@@ -28,6 +41,8 @@ const (
 	EventTypePatch = "PATCH"
 	// EventTypeFull ...
 	EventTypeFull = "FULL"
+	// EventTypeDelete removes the policy with its ip trees and data.
+	EventTypeDelete = "DELETE"
 )
 
 //IPTrees is a map where first key is the policyName, the second the bucket name its value is the iptree for the given bucket
@@ -35,8 +50,9 @@ type IPTrees map[string]map[string]*iptree.IPTree
 
 // PolicyEvent ...
 type PolicyEvent struct {
-	// Type can be FULL or INCR. FULL events must contain the rego policy which will be overridden during compilation.
-	// INCR types can skip the rego and send JSON patches into the Data field.
+	// Type can be FULL, PATCH or DELETE. FULL events must contain the rego policy which will be overridden during compilation.
+	// PATCH types can skip the rego and send JSON patches into the Data and DataPatch fields.
+	// DELETE types only need the name, the policy stops serving right away.
 	Type string `json:"type" yaml:"type"`
 	// Name of the rule. This must be unique across the running packages and during
 	// initialization we do checks to avoid conflicts.
@@ -50,27 +66,155 @@ type PolicyEvent struct {
 	// allow {
 	// 		data.partner.dev_key = input.header["x-dev-access-key"]
 	// }
+	// On PATCH events Data is a JSON Merge Patch (RFC 7386) of the policy data, null members are removed. Ex.:
+	// {"dev_key": "e5f6d7a1b2c3d4", "old_key": null}
 	Data interface{} `json:"data,omitempty" yaml:"data"`
+	// DataPatch are JSON Patch (RFC 6902) operations applied to the policy data on PATCH events,
+	// after the Data merge patch. They are applied all or none. Ex.:
+	// [{"op": "add", "path": "/partners/acme", "value": "a1b2c3d4e5f6d7"}]
+	DataPatch []jsonpatch.Operation `json:"data_patch,omitempty" yaml:"data_patch"`
 	// IPBuckets are the origin data structure that we build ip binary tree. Ex.
-	// {"blacklist":{"40.127.145.4":"2020-03-11T12:05:57.137118+01:00"}}
-	// The blacklist is the bucket name which can be used on the rego policy. The ip as key and its value is
-	// the expiration time of the IP in the binary tree. A example use case in a rego policy would be:
+	// {"blacklist":{"40.127.145.4":"2020-03-11T12:05:57.137118+01:00","10.0.0.0/8":"2020-03-11T12:05:57.137118+01:00"}}
+	// The blacklist is the bucket name which can be used on the rego policy. The ip or CIDR range as key and its value is
+	// the expiration time of the entry in the binary tree. Lookups match the most specific range containing the ip. A example use case in a rego policy would be:
 	// deny {
 	//   ip_in_tree(input.ip, blacklist)
 	// }
+	// The value can also be an object carrying metadata about the entry, see IPEntry. Ex.:
+	// {"blacklist":{"40.127.145.4":{"expire_at":"2020-03-11T12:05:57.137118+01:00","reason":"no user agent","source":"nouseragent","hits":3}}}
+	// On PATCH events an entry without expiration, null or the zero time, removes the ip or CIDR range
+	// from the bucket right away. Ex.: {"blacklist":{"40.127.145.4":null}}
+	// FULL events don't add the removed entry back until it would have expired, only a new entry expiring later.
+	// Once applied the buckets are keyed by the canonical network, 40.127.145.4 is kept as 40.127.145.4/32.
+	// The metadata is available to the policies with in_tree_entry:
+	// reason = sprintf("blacklisted: %s", [entry.reason]) {
+	//   entry := in_tree_entry("nouseragent", "blacklist", input.ip)
+	// }
 	IPBuckets IPBuckets `json:"ipbuckets,omitempty" yaml:"ipbuckets"`
+	// DryRun evaluates the policy but only logs the requests it would have denied. Useful
+	// to shadow a new policy against real traffic before enforcing it.
+	DryRun bool `json:"dryrun,omitempty" yaml:"dryrun"`
+	// Priority orders the evaluation of the policies, higher priorities are evaluated first
+	// and policies with the same priority are ordered by name. The first priority with a
+	// matching policy decides, so an allowlist with a higher priority than the bot rules
+	// always wins over them.
+	Priority int `json:"priority,omitempty" yaml:"priority"`
+	// Combining is the algorithm combining the policies sharing this priority: allow-overrides,
+	// deny-overrides or first-applicable. Defaults to Configuration.CombiningAlgorithm.
+	Combining string `json:"combining,omitempty" yaml:"combining"`
 }
 
 // IPBuckets key is bucketName ...
 type IPBuckets map[string]IPBucket
 
-// IPBucket key is ip, value is expiration time ...
-type IPBucket map[string]time.Time
+// IPBucket key is ip or CIDR range, value is the entry with its expiration time ...
+type IPBucket map[string]IPEntry
+
+// IPEntry is the expiration time and the optional metadata of an ip bucket entry.
+type IPEntry = iptree.Entry
 
 // Configuration defines the configuration section for firewall handler
 type Configuration struct {
+	// IsEnabled is the kill switch, when false requests are not evaluated at all. Defaults to true.
 	IsEnabled bool
-	DryRun    bool
+	// DryRun evaluates every request but never blocks, denials are only logged.
+	DryRun bool
+	// DecisionHeaders adds the decision to the response headers. It tells clients which
+	// policies matched so it should only be enabled for debugging.
+	DecisionHeaders bool
+	// DecisionLog sends decisions to the EventsTopicName. Defaults to true.
+	DecisionLog bool
+	// DecisionLogSampleRate is the ratio (0 to 1) of allowed requests sent to the decision log.
+	// Denied requests are always sent. Defaults to 0.01.
+	DecisionLogSampleRate float64
+	// DecisionLogRedactedHeaders are the lower cased headers whose values are redacted from the
+	// decision log, along with the cookie values and the body. From the environment they are read
+	// as comma separated names, authorization, proxy-authorization, cookie, set-cookie and x-api-key
+	// by default.
+	DecisionLogRedactedHeaders []string
+	// TrustedProxies are the networks whose forwarding headers are honoured when resolving
+	// the client ip. From the environment they are read as comma separated ips or CIDRs. None
+	// by default, the client ip is the address of the peer.
+	TrustedProxies []*net.IPNet
+	// ClientIPHeader is the lower cased forwarding header set by the trusted proxies, e.g.
+	// x-forwarded-for, forwarded or x-real-ip. The others are ignored. Defaults to x-forwarded-for.
+	ClientIPHeader string
+	// JA3Header is the lower cased header carrying the JA3 fingerprint computed by the trusted
+	// proxy terminating TLS. Go does not expose the client hello extensions to compute it here.
+	JA3Header string
+	// BodyInspection selects the requests whose body is parsed into the input, none by default.
+	// From the environment they are read as comma separated host/path-prefix rules.
+	BodyInspection []BodyInspectionRule
+	// BodyMaxSize is the maximum number of bytes buffered, larger bodies are not parsed.
+	// Defaults to DefaultBodyMaxSize.
+	BodyMaxSize int64
+	// PolicyTimeout bounds the evaluation of each policy, a policy timing out doesn't match.
+	// Zero disables the timeout.
+	PolicyTimeout time.Duration
+	// CombiningAlgorithm combines the policies of a priority which don't declare one. Defaults
+	// to allow-overrides.
+	CombiningAlgorithm string
+	// ChallengeSecret signs the challenge clearances, it must be shared by every enforcer. The
+	// challenge action blocks and challenge_passed is always false when it's empty.
+	ChallengeSecret string
+	// ChallengeDifficulty is the number of leading zero bits of the proof of work (0 to 32).
+	// Defaults to 16.
+	ChallengeDifficulty int
+	// ChallengeTTL is how long a solved challenge is valid. Defaults to an hour.
+	ChallengeTTL time.Duration
+	// GCInterval is the interval between the sweeps evicting expired ip bucket entries. Defaults
+	// to a minute, zero disables the sweeps.
+	GCInterval time.Duration
+	// CompileInterval is how long a compilation requested by a FULL event waits for the next
+	// events, a burst of events is compiled once. Defaults to 5 seconds.
+	CompileInterval time.Duration
+}
+
+// Decision is the outcome of evaluating a request against the compiled policies.
+type Decision struct {
+	// Allowed is false when the deciding priority denied the request with its combining algorithm.
+	Allowed bool `json:"allowed"`
+	// DryRun is set when the decision is only reported and never enforced.
+	DryRun bool `json:"dryrun,omitempty"`
+	// Disabled is set when the firewall is disabled and the request was not evaluated.
+	Disabled bool `json:"disabled,omitempty"`
+	// Overridden is set when the combining algorithm settled a conflict between allow and deny rules.
+	Overridden bool `json:"overridden,omitempty"`
+	// Algorithm and Priority identify the policies which decided, empty when none matched.
+	Algorithm string `json:"algorithm,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+	// DenyingPackages are the packages whose deny rule matched.
+	DenyingPackages []string `json:"denying_packages,omitempty"`
+	// AllowingPackages are the packages whose allow rule matched.
+	AllowingPackages []string `json:"allowing_packages,omitempty"`
+	// DryRunPackages are the packages in dry run whose deny rule matched.
+	DryRunPackages []string `json:"dryrun_packages,omitempty"`
+	// Reasons is keyed by package and holds the value of its reason rule, if the package
+	// matched and defines one. Ex.:
+	// reason = "blacklisted ip" {
+	//   in_tree("nouseragent", "blacklist", input.ip)
+	// }
+	Reasons map[string]interface{} `json:"reasons,omitempty"`
+	// Action is the action of the first denying package asking to block, nil when the request is
+	// not denied or the denying packages use the enforcer default block response.
+	Action *Action `json:"action,omitempty"`
+	// RequestHeaders are the changes of the headers actions of the matching packages.
+	RequestHeaders *HeaderChanges `json:"request_headers,omitempty"`
+	// Errors is keyed by package and holds the error of the packages which failed to evaluate.
+	Errors map[string]string `json:"errors,omitempty"`
+	// Duration is the time spent evaluating the request.
+	Duration time.Duration `json:"duration"`
+	// PolicyDurations is keyed by package and holds the time spent evaluating it.
+	PolicyDurations map[string]time.Duration `json:"policy_durations,omitempty"`
+	// Revision of the policies snapshot used to evaluate the request.
+	Revision uint64 `json:"revision"`
+}
+
+// DecisionEvent is the record sent to the EventsTopicName for every logged decision.
+type DecisionEvent struct {
+	Time     time.Time              `json:"time"`
+	Input    map[string]interface{} `json:"input"`
+	Decision Decision               `json:"decision"`
 }
 
 const (
@@ -0,0 +1,99 @@
+package iptree
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Entry is the value stored for every network of the tree. Only ExpireAt is required, the
+// metadata tells why the network was added.
+type Entry struct {
+	ExpireAt time.Time
+	// Reason is a human readable description, Ex.: "too many requests without user agent".
+	Reason string
+	// Source is the policy or detector which added the entry.
+	Source string
+	// CreatedAt is when the entry was first added.
+	CreatedAt time.Time
+	// Hits is how many times the network offended.
+	Hits int
+	// Score is the confidence of the detector, its scale is up to the source.
+	Score float64
+}
+
+type entryJSON struct {
+	ExpireAt  time.Time  `json:"expire_at"`
+	Reason    string     `json:"reason,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Hits      int        `json:"hits,omitempty"`
+	Score     float64    `json:"score,omitempty"`
+}
+
+// HasMetadata tells whether the entry carries more than its expiration time.
+func (entry Entry) HasMetadata() bool {
+	return entry.Reason != "" || entry.Source != "" || !entry.CreatedAt.IsZero() || entry.Hits != 0 || entry.Score != 0
+}
+
+// MarshalJSON encodes entries without metadata as their expiration time alone, the format
+// used before entries carried metadata. Ex.:
+// "2020-03-11T12:05:57.137118+01:00"
+// {"expire_at": "2020-03-11T12:05:57.137118+01:00", "reason": "no user agent", "hits": 3}
+func (entry Entry) MarshalJSON() ([]byte, error) {
+	if !entry.HasMetadata() {
+		return json.Marshal(entry.ExpireAt)
+	}
+
+	encoded := entryJSON{
+		ExpireAt: entry.ExpireAt,
+		Reason:   entry.Reason,
+		Source:   entry.Source,
+		Hits:     entry.Hits,
+		Score:    entry.Score,
+	}
+	if !entry.CreatedAt.IsZero() {
+		encoded.CreatedAt = &entry.CreatedAt
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes both the expiration time alone and the object with metadata.
+func (entry *Entry) UnmarshalJSON(data []byte) error {
+	var expireAt time.Time
+	if err := json.Unmarshal(data, &expireAt); err == nil {
+		*entry = Entry{ExpireAt: expireAt}
+		return nil
+	}
+
+	var decoded entryJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	*entry = Entry{
+		ExpireAt: decoded.ExpireAt,
+		Reason:   decoded.Reason,
+		Source:   decoded.Source,
+		Hits:     decoded.Hits,
+		Score:    decoded.Score,
+	}
+	if decoded.CreatedAt != nil {
+		entry.CreatedAt = *decoded.CreatedAt
+	}
+	return nil
+}
+
+// ToMap returns the entry as a document for the rego policies, time as RFC3339.
+func (entry Entry) ToMap() map[string]interface{} {
+	document := map[string]interface{}{
+		"expire_at": entry.ExpireAt.Format(time.RFC3339Nano),
+		"reason":    entry.Reason,
+		"source":    entry.Source,
+		"hits":      entry.Hits,
+		"score":     entry.Score,
+	}
+	if !entry.CreatedAt.IsZero() {
+		document["created_at"] = entry.CreatedAt.Format(time.RFC3339Nano)
+	}
+	return document
+}
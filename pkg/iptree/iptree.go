@@ -13,12 +13,16 @@ import (
 type IPTree struct {
 	IPv4 *iradix.Tree
 	IPv6 *iradix.Tree
+	// ipv4Prefixes and ipv6Prefixes count the networks of each prefix length, lookups only
+	// probe the lengths in use. They are arrays so copies of the tree don't share them.
+	ipv4Prefixes [8*net.IPv4len + 1]int
+	ipv6Prefixes [8*net.IPv6len + 1]int
 }
 
 // FlatJSON ...
 type FlatJSON struct {
-	IPv4 map[string]time.Time `json:"ipv4"`
-	IPv6 map[string]time.Time `json:"ipv6"`
+	IPv4 map[string]Entry `json:"ipv4"`
+	IPv6 map[string]Entry `json:"ipv6"`
 }
 
 // New ...
@@ -31,65 +35,258 @@ func New() *IPTree {
 	}
 }
 
-// GetIP returns the expiration time
-func (ipTree *IPTree) GetIP(ip net.IP) (time.Time, bool) {
-	switch {
-	case ipTree.isIPv4(ip):
-		if expireAt, ok := ipTree.IPv4.Get([]byte(ip.String())); ok {
-			return expireAt.(time.Time), ok
+// ParseNetwork parses an ip bucket entry which can either be a single ip address
+// ("1.2.3.4", "2001:db8::1") or a CIDR range ("1.2.3.0/24", "2001:db8::/32").
+// Single addresses are returned as a host network (/32 or /128).
+func ParseNetwork(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
 		}
-	case ipTree.isIPv6(ip):
-		if expireAt, ok := ipTree.IPv6.Get([]byte(ip.String())); ok {
-			return expireAt.(time.Time), ok
+		return network, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("could not parse ip %s", entry)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)}, nil
+}
+
+// GetIP returns the entry of the most specific network containing the ip. Expired entries
+// are skipped, the broader networks containing the ip still match until they expire too.
+// IPv4-mapped IPv6 addresses are looked up as IPv4. It doesn't allocate.
+func (ipTree *IPTree) GetIP(ip net.IP) (Entry, bool) {
+	_, entry, ok := ipTree.lookup(ip, time.Now())
+	return entry, ok
+}
+
+// GetNetwork returns the most specific network containing the ip and its entry.
+func (ipTree *IPTree) GetNetwork(ip net.IP) (string, Entry, bool) {
+	ones, entry, ok := ipTree.lookup(ip, time.Now())
+	if !ok {
+		return "", entry, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return fromKey(toKey(ip4, ones)), entry, true
+	}
+	return fromKey(toKey(ip, ones)), entry, true
+}
+
+// lookup returns the prefix length of the most specific network containing the ip and its entry.
+func (ipTree *IPTree) lookup(ip net.IP, now time.Time) (int, Entry, bool) {
+	var buffer [maxKeyLen]byte
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return longestActivePrefix(ipTree.IPv4, ipTree.ipv4Prefixes[:], ip4, buffer[:], now)
+	}
+	if len(ip) == net.IPv6len {
+		return longestActivePrefix(ipTree.IPv6, ipTree.ipv6Prefixes[:], ip, buffer[:], now)
+	}
+	return 0, Entry{}, false
+}
+
+// longestActivePrefix probes the prefix lengths in use, from the most specific to the broadest,
+// and returns the first network containing the ip not expired at the given time.
+func longestActivePrefix(tree *iradix.Tree, prefixes []int, ip net.IP, buffer []byte, now time.Time) (int, Entry, bool) {
+	for ones := len(prefixes) - 1; ones >= 0; ones-- {
+		if prefixes[ones] == 0 {
+			continue
+		}
+		if value, ok := tree.Get(putKey(buffer, ip, ones)); ok {
+			if entry := value.(Entry); !now.After(entry.ExpireAt) {
+				return ones, entry, true
+			}
 		}
 	}
-	return time.Time{}, false
+	return 0, Entry{}, false
+}
+
+// DeleteExpired removes the entries expired at the given time and returns how many were removed.
+// Trees are immutable, the tree is replaced only when entries were removed.
+func (ipTree *IPTree) DeleteExpired(now time.Time) int {
+	var removedIPv4, removedIPv6 int
+	ipTree.IPv4, removedIPv4 = deleteExpired(ipTree.IPv4, ipTree.ipv4Prefixes[:], now)
+	ipTree.IPv6, removedIPv6 = deleteExpired(ipTree.IPv6, ipTree.ipv6Prefixes[:], now)
+	return removedIPv4 + removedIPv6
 }
 
-// TODO cleanup old entries
-func garbageCollector() {}
+func deleteExpired(tree *iradix.Tree, prefixes []int, now time.Time) (*iradix.Tree, int) {
+	txn := tree.Txn()
+	removed := 0
 
-// AddCIDR TODO
-func (ipTree *IPTree) AddCIDR() error {
-	return fmt.Errorf("not implemented")
+	it := tree.Root().Iterator()
+	for key, entry, ok := it.Next(); ok; key, entry, ok = it.Next() {
+		if now.After(entry.(Entry).ExpireAt) {
+			txn.Delete(key)
+			prefixes[prefixLen(key)]--
+			removed++
+		}
+	}
+
+	if removed == 0 {
+		return tree, 0
+	}
+	return txn.Commit(), removed
 }
 
-// AddIP ...
-func (ipTree *IPTree) AddIP(ip net.IP, expireAt time.Time) error {
-	switch {
-	case ipTree.isIPv4(ip):
-		ipTree.IPv4, _, _ = ipTree.IPv4.Insert([]byte(ip.String()), expireAt)
-	case ipTree.isIPv6(ip):
-		ipTree.IPv6, _, _ = ipTree.IPv6.Insert([]byte(ip.String()), expireAt)
-	default:
-		return fmt.Errorf("Could not parse IP")
+// AddCIDR adds a network to the tree. Lookups of any ip inside the network will
+// match this entry unless a more specific network is also present.
+func (ipTree *IPTree) AddCIDR(network *net.IPNet, entry Entry) error {
+	key, ipv4, err := networkKey(network)
+	if err != nil {
+		return err
 	}
+
+	ipTree.insert(key, ipv4, entry)
 	return nil
 }
 
-func (ipTree *IPTree) isIPv4(ip net.IP) bool {
-	return strings.Count(ip.String(), ".") == 3
+// Delete removes the network from the tree and tells whether it was there. Only the exact
+// network is removed, the networks containing it or contained by it are kept.
+func (ipTree *IPTree) Delete(network *net.IPNet) (bool, error) {
+	key, ipv4, err := networkKey(network)
+	if err != nil {
+		return false, err
+	}
+
+	tree, prefixes := ipTree.family(ipv4)
+	var deleted bool
+	if *tree, _, deleted = (*tree).Delete(key); deleted {
+		prefixes[prefixLen(key)]--
+	}
+	return deleted, nil
+}
+
+// insert adds or replaces the entry of the key in the tree of its address family.
+func (ipTree *IPTree) insert(key []byte, ipv4 bool, entry Entry) {
+	tree, prefixes := ipTree.family(ipv4)
+	var updated bool
+	if *tree, _, updated = (*tree).Insert(key, entry); !updated {
+		prefixes[prefixLen(key)]++
+	}
 }
 
-func (ipTree *IPTree) isIPv6(ip net.IP) bool {
-	return strings.Count(ip.String(), ":") >= 2
+// family returns the tree and the prefix counts of the IPv4 or the IPv6 networks.
+func (ipTree *IPTree) family(ipv4 bool) (**iradix.Tree, []int) {
+	if ipv4 {
+		return &ipTree.IPv4, ipTree.ipv4Prefixes[:]
+	}
+	return &ipTree.IPv6, ipTree.ipv6Prefixes[:]
+}
+
+// networkKey returns the key of the network and whether it goes to the IPv4 tree.
+func networkKey(network *net.IPNet) ([]byte, bool, error) {
+	ones, bits := network.Mask.Size()
+	if bits == 0 {
+		return nil, false, fmt.Errorf("Could not parse CIDR %s: non canonical mask", network)
+	}
+
+	if ip4 := network.IP.To4(); ip4 != nil {
+		// IPv4-mapped IPv6 networks (::ffff:1.2.3.0/120) are stored as IPv4.
+		if bits == 8*net.IPv6len {
+			ones -= 8 * (net.IPv6len - net.IPv4len)
+		}
+		if ones < 0 {
+			return nil, false, fmt.Errorf("Could not parse CIDR %s", network)
+		}
+		return toKey(ip4, ones), true, nil
+	}
+
+	if len(network.IP) == net.IPv6len && bits == 8*net.IPv6len {
+		return toKey(network.IP, ones), false, nil
+	}
+
+	return nil, false, fmt.Errorf("Could not parse CIDR %s", network)
+}
+
+// Len returns the number of networks in the tree.
+func (ipTree *IPTree) Len() int {
+	return ipTree.IPv4.Len() + ipTree.IPv6.Len()
+}
+
+// AddIP adds a single address to the tree.
+func (ipTree *IPTree) AddIP(ip net.IP, entry Entry) error {
+	if ip4 := ip.To4(); ip4 != nil {
+		ipTree.insert(toKey(ip4, 8*net.IPv4len), true, entry)
+		return nil
+	}
+
+	if len(ip) == net.IPv6len {
+		ipTree.insert(toKey(ip, 8*net.IPv6len), false, entry)
+		return nil
+	}
+
+	return fmt.Errorf("Could not parse IP")
+}
+
+// maxKeyLen is the key length of an IPv6 network.
+const maxKeyLen = net.IPv6len + 1
+
+// toKey returns the 4 or 16 byte form of the address masked to prefixLen bits, followed by
+// prefixLen. Networks of different lengths never share a key, lookups probe each length in use.
+// The key is owned by the tree once inserted.
+func toKey(ip net.IP, prefixLen int) []byte {
+	return putKey(make([]byte, len(ip)+1), ip, prefixLen)
+}
+
+// putKey writes the key into buffer, which must hold len(ip)+1 bytes, and returns it.
+func putKey(buffer []byte, ip net.IP, prefixLen int) []byte {
+	key := buffer[:len(ip)+1]
+	for i := range ip {
+		switch bits := prefixLen - 8*i; {
+		case bits >= 8:
+			key[i] = ip[i]
+		case bits <= 0:
+			key[i] = 0
+		default:
+			key[i] = ip[i] &^ (0xff >> uint(bits))
+		}
+	}
+	key[len(ip)] = byte(prefixLen)
+	return key
+}
+
+// prefixLen returns the prefix length of a tree key.
+func prefixLen(key []byte) int {
+	return int(key[len(key)-1])
+}
+
+// fromKey converts a tree key back to its network representation. Host entries
+// are returned as plain addresses, anything shorter in CIDR notation.
+func fromKey(key []byte) string {
+	addressLen := len(key) - 1
+	ip := make(net.IP, addressLen)
+	copy(ip, key)
+
+	if prefixLen(key) == 8*addressLen {
+		return ip.String()
+	}
+
+	network := &net.IPNet{IP: ip, Mask: net.CIDRMask(prefixLen(key), 8*addressLen)}
+	return network.String()
 }
 
 // ToFlatJSON returns the tree represented in a flat JSON format.
 func (ipTree *IPTree) ToFlatJSON() (FlatJSON, error) {
 	flatJSON := FlatJSON{
-		IPv4: make(map[string]time.Time),
-		IPv6: make(map[string]time.Time),
+		IPv4: make(map[string]Entry),
+		IPv6: make(map[string]Entry),
 	}
 
 	it := ipTree.IPv4.Root().Iterator()
-	for key, expireAt, ok := it.Next(); ok; key, _, ok = it.Next() {
-		flatJSON.IPv4[string(key)] = expireAt.(time.Time)
+	for key, entry, ok := it.Next(); ok; key, entry, ok = it.Next() {
+		flatJSON.IPv4[fromKey(key)] = entry.(Entry)
 	}
 
 	it = ipTree.IPv6.Root().Iterator()
-	for key, expireAt, ok := it.Next(); ok; key, _, ok = it.Next() {
-		flatJSON.IPv6[string(key)] = expireAt.(time.Time)
+	for key, entry, ok := it.Next(); ok; key, entry, ok = it.Next() {
+		flatJSON.IPv6[fromKey(key)] = entry.(Entry)
 	}
 
 	return flatJSON, nil
@@ -0,0 +1,333 @@
+package iptree
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTree(t testing.TB, networks ...string) *IPTree {
+	ipTree := New()
+	for _, entry := range networks {
+		network, err := ParseNetwork(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ipTree.AddCIDR(network, Entry{ExpireAt: time.Now().Add(time.Hour), Reason: entry}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ipTree
+}
+
+func TestGetNetwork(t *testing.T) {
+	ipTree := newTree(t,
+		"10.0.0.0/8",
+		"10.1.0.0/16",
+		"10.1.2.3",
+		"2001:db8::/32",
+		"2001:db8:1::/48",
+		"2001:db8:1::1",
+	)
+
+	tests := []struct {
+		ip          string
+		wantNetwork string
+		wantOK      bool
+	}{
+		{ip: "10.1.2.3", wantNetwork: "10.1.2.3", wantOK: true},
+		{ip: "10.1.2.4", wantNetwork: "10.1.0.0/16", wantOK: true},
+		{ip: "10.2.0.1", wantNetwork: "10.0.0.0/8", wantOK: true},
+		{ip: "11.0.0.1", wantOK: false},
+		{ip: "::ffff:10.1.2.3", wantNetwork: "10.1.2.3", wantOK: true},
+		{ip: "::ffff:10.2.0.1", wantNetwork: "10.0.0.0/8", wantOK: true},
+		{ip: "2001:db8:1::1", wantNetwork: "2001:db8:1::1", wantOK: true},
+		{ip: "2001:db8:1::2", wantNetwork: "2001:db8:1::/48", wantOK: true},
+		{ip: "2001:db8:2::1", wantNetwork: "2001:db8::/32", wantOK: true},
+		{ip: "2001:db9::1", wantOK: false},
+		// the ipv4 networks don't contain ipv6 addresses sharing their bits.
+		{ip: "a01:203::", wantOK: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.ip, func(t *testing.T) {
+			network, entry, ok := ipTree.GetNetwork(net.ParseIP(test.ip))
+			if ok != test.wantOK {
+				t.Fatalf("GetNetwork(%s) ok = %v, want %v", test.ip, ok, test.wantOK)
+			}
+			if network != test.wantNetwork {
+				t.Errorf("GetNetwork(%s) network = %s, want %s", test.ip, network, test.wantNetwork)
+			}
+			if ok && entry.Reason == "" {
+				t.Errorf("GetNetwork(%s) returned an empty entry", test.ip)
+			}
+		})
+	}
+}
+
+func TestDefaultRoutes(t *testing.T) {
+	ipTree := newTree(t, "0.0.0.0/0")
+
+	for _, ip := range []string{"0.0.0.0", "192.0.2.1", "255.255.255.255", "::ffff:192.0.2.1"} {
+		if network, _, ok := ipTree.GetNetwork(net.ParseIP(ip)); !ok || network != "0.0.0.0/0" {
+			t.Errorf("GetNetwork(%s) = %s, %v, want 0.0.0.0/0", ip, network, ok)
+		}
+	}
+	if _, ok := ipTree.GetIP(net.ParseIP("2001:db8::1")); ok {
+		t.Error("0.0.0.0/0 should not contain ipv6 addresses")
+	}
+
+	ipTree = newTree(t, "::/0")
+	if network, _, ok := ipTree.GetNetwork(net.ParseIP("2001:db8::1")); !ok || network != "::/0" {
+		t.Errorf("GetNetwork(2001:db8::1) = %s, %v, want ::/0", network, ok)
+	}
+	if _, ok := ipTree.GetIP(net.ParseIP("192.0.2.1")); ok {
+		t.Error("::/0 should not contain ipv4 addresses")
+	}
+}
+
+func TestIPv4MappedNetworks(t *testing.T) {
+	tests := []struct {
+		network  string
+		wantIPv4 string
+		wantIPv6 string
+	}{
+		{network: "::ffff:192.0.2.0/120", wantIPv4: "192.0.2.0/24"},
+		{network: "::ffff:192.0.2.1/128", wantIPv4: "192.0.2.1"},
+		{network: "::ffff:0.0.0.0/96", wantIPv4: "0.0.0.0/0"},
+		{network: "::ffff:192.0.2.1", wantIPv4: "192.0.2.1"},
+		// shorter prefixes contain addresses which are not ipv4-mapped.
+		{network: "::ffff:0.0.0.0/95", wantIPv6: "::fffe:0:0/95"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.network, func(t *testing.T) {
+			network, err := ParseNetwork(test.network)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ipTree := New()
+			if err := ipTree.AddCIDR(network, Entry{}); err != nil {
+				t.Fatal(err)
+			}
+
+			flatJSON, _ := ipTree.ToFlatJSON()
+			want := flatJSON.IPv4
+			wantNetwork := test.wantIPv4
+			if test.wantIPv6 != "" {
+				want, wantNetwork = flatJSON.IPv6, test.wantIPv6
+			}
+			if _, ok := want[wantNetwork]; !ok || len(flatJSON.IPv4)+len(flatJSON.IPv6) != 1 {
+				t.Errorf("AddCIDR(%s) = %v, want %s", test.network, flatJSON, wantNetwork)
+			}
+		})
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ipTree := newTree(t, "10.0.0.0/8", "10.1.0.0/16", "2001:db8::/32")
+
+	tests := []struct {
+		network     string
+		wantDeleted bool
+		wantLen     int
+	}{
+		// only the exact network is deleted.
+		{network: "10.1.2.0/24", wantDeleted: false, wantLen: 3},
+		{network: "10.1.0.0/16", wantDeleted: true, wantLen: 2},
+		{network: "10.1.0.0/16", wantDeleted: false, wantLen: 2},
+		{network: "::ffff:10.0.0.0/104", wantDeleted: true, wantLen: 1},
+		{network: "2001:db8::/32", wantDeleted: true, wantLen: 0},
+	}
+
+	for _, test := range tests {
+		network, err := ParseNetwork(test.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deleted, err := ipTree.Delete(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != test.wantDeleted {
+			t.Errorf("Delete(%s) = %v, want %v", test.network, deleted, test.wantDeleted)
+		}
+		if ipTree.Len() != test.wantLen {
+			t.Errorf("Delete(%s) left %d networks, want %d", test.network, ipTree.Len(), test.wantLen)
+		}
+	}
+
+	if _, ok := ipTree.GetIP(net.ParseIP("10.1.2.3")); ok {
+		t.Error("GetIP(10.1.2.3) matched a deleted network")
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	now := time.Now()
+	ipTree := New()
+	entries := map[string]time.Time{
+		"192.0.2.1":       now.Add(-time.Minute),
+		"192.0.2.2":       now.Add(time.Minute),
+		"198.51.100.0/24": now.Add(-time.Second),
+		"2001:db8::1":     now.Add(-time.Hour),
+		"2001:db8::2":     now.Add(time.Hour),
+	}
+	for entry, expireAt := range entries {
+		network, err := ParseNetwork(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ipTree.AddCIDR(network, Entry{ExpireAt: expireAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	previous := ipTree.IPv4
+	if removed := ipTree.DeleteExpired(now); removed != 3 {
+		t.Errorf("DeleteExpired() = %d, want 3", removed)
+	}
+	if previous.Len() != 3 {
+		t.Error("DeleteExpired() modified the previous tree")
+	}
+
+	flatJSON, _ := ipTree.ToFlatJSON()
+	if _, ok := flatJSON.IPv4["192.0.2.2"]; !ok || len(flatJSON.IPv4) != 1 {
+		t.Errorf("ipv4 = %v, want 192.0.2.2", flatJSON.IPv4)
+	}
+	if _, ok := flatJSON.IPv6["2001:db8::2"]; !ok || len(flatJSON.IPv6) != 1 {
+		t.Errorf("ipv6 = %v, want 2001:db8::2", flatJSON.IPv6)
+	}
+
+	unchanged := ipTree.IPv4
+	if removed := ipTree.DeleteExpired(now); removed != 0 || ipTree.IPv4 != unchanged {
+		t.Errorf("DeleteExpired() = %d, the tree should be kept when nothing expired", removed)
+	}
+}
+
+func TestGetIPSkipsExpiredNetworks(t *testing.T) {
+	now := time.Now()
+	ipTree := New()
+	entries := map[string]time.Time{
+		"10.0.0.0/8":    now.Add(time.Hour),
+		"10.0.0.1":      now.Add(-time.Minute),
+		"10.1.0.0/16":   now.Add(-time.Minute),
+		"2001:db8::/32": now.Add(time.Hour),
+		"2001:db8::1":   now.Add(-time.Minute),
+		"192.0.2.0/24":  now.Add(-time.Minute),
+	}
+	for entry, expireAt := range entries {
+		network, err := ParseNetwork(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ipTree.AddCIDR(network, Entry{ExpireAt: expireAt}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		ip          string
+		wantNetwork string
+		wantOK      bool
+	}{
+		// the expired host entries don't hide the active networks containing them.
+		{ip: "10.0.0.1", wantNetwork: "10.0.0.0/8", wantOK: true},
+		{ip: "10.1.2.3", wantNetwork: "10.0.0.0/8", wantOK: true},
+		{ip: "2001:db8::1", wantNetwork: "2001:db8::/32", wantOK: true},
+		{ip: "192.0.2.1", wantOK: false},
+	}
+
+	for _, test := range tests {
+		network, _, ok := ipTree.GetNetwork(net.ParseIP(test.ip))
+		if ok != test.wantOK || network != test.wantNetwork {
+			t.Errorf("GetNetwork(%s) = %s, %v, want %s, %v", test.ip, network, ok, test.wantNetwork, test.wantOK)
+		}
+	}
+}
+
+func TestTreeCopiesAreIndependent(t *testing.T) {
+	ipTree := newTree(t, "10.0.0.0/8")
+
+	// snapshots copy the tree by value before changing it.
+	treeCopy := *ipTree
+	for _, entry := range []string{"10.1.0.0/16", "10.1.0.0/16", "2001:db8::/32"} {
+		network, _ := ParseNetwork(entry)
+		if err := treeCopy.AddCIDR(network, Entry{ExpireAt: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if network, _, _ := ipTree.GetNetwork(net.ParseIP("10.1.2.3")); network != "10.0.0.0/8" {
+		t.Errorf("GetNetwork(10.1.2.3) = %s on the original tree, want 10.0.0.0/8", network)
+	}
+	if _, ok := ipTree.GetIP(net.ParseIP("2001:db8::1")); ok {
+		t.Error("GetIP(2001:db8::1) matched a network added to the copy")
+	}
+	if network, _, _ := treeCopy.GetNetwork(net.ParseIP("10.1.2.3")); network != "10.1.0.0/16" {
+		t.Errorf("GetNetwork(10.1.2.3) = %s on the copy, want 10.1.0.0/16", network)
+	}
+
+	// the network added twice is gone once deleted.
+	network, _ := ParseNetwork("10.1.0.0/16")
+	if _, err := treeCopy.Delete(network); err != nil {
+		t.Fatal(err)
+	}
+	if network, _, _ := treeCopy.GetNetwork(net.ParseIP("10.1.2.3")); network != "10.0.0.0/8" {
+		t.Errorf("GetNetwork(10.1.2.3) = %s once deleted, want 10.0.0.0/8", network)
+	}
+}
+
+func TestGetIPDoesNotAllocate(t *testing.T) {
+	ipTree := newTree(t, "10.0.0.0/8", "10.1.2.3", "2001:db8::/32")
+	ips := []net.IP{
+		net.ParseIP("10.1.2.3"),
+		net.ParseIP("10.1.2.3").To4(),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.1"),
+		nil,
+	}
+
+	for _, ip := range ips {
+		if allocs := testing.AllocsPerRun(100, func() { ipTree.GetIP(ip) }); allocs != 0 {
+			t.Errorf("GetIP(%s) allocates %v times", ip, allocs)
+		}
+	}
+}
+
+func BenchmarkGetIP(b *testing.B) {
+	ipTree := New()
+	expireAt := time.Now().Add(time.Hour)
+	for i := 0; i < 1000; i++ {
+		ipv4 := net.IPv4(10, byte(i>>8), byte(i), 0).To4()
+		if err := ipTree.AddCIDR(&net.IPNet{IP: ipv4, Mask: net.CIDRMask(24, 32)}, Entry{ExpireAt: expireAt}); err != nil {
+			b.Fatal(err)
+		}
+
+		ipv6 := net.ParseIP("2001:db8::")
+		ipv6[4], ipv6[5] = byte(i>>8), byte(i)
+		if err := ipTree.AddCIDR(&net.IPNet{IP: ipv6, Mask: net.CIDRMask(48, 128)}, Entry{ExpireAt: expireAt}); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	benchmarks := []struct {
+		name string
+		ip   net.IP
+	}{
+		{name: "ipv4", ip: net.ParseIP("10.1.2.3").To4()},
+		{name: "ipv6", ip: net.ParseIP("2001:db8:102::1")},
+		{name: "ipv4-mapped", ip: net.ParseIP("::ffff:10.1.2.3")},
+		{name: "miss", ip: net.ParseIP("192.0.2.1").To4()},
+	}
+
+	for _, benchmark := range benchmarks {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ipTree.GetIP(benchmark.ip)
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// OperationAdd ...
+	OperationAdd = "add"
+	// OperationRemove ...
+	OperationRemove = "remove"
+	// OperationReplace ...
+	OperationReplace = "replace"
+	// OperationMove ...
+	OperationMove = "move"
+	// OperationCopy ...
+	OperationCopy = "copy"
+	// OperationTest ...
+	OperationTest = "test"
+)
+
+// Operation is a RFC 6902 JSON Patch operation. Ex.:
+// {"op": "add", "path": "/partners/acme", "value": "a1b2c3d4e5f6d7"}
+// {"op": "move", "from": "/partners/acme", "path": "/revoked/acme"}
+type Operation struct {
+	Op    string      `json:"op" yaml:"op"`
+	Path  string      `json:"path" yaml:"path"`
+	From  string      `json:"from,omitempty" yaml:"from"`
+	Value interface{} `json:"value,omitempty" yaml:"value"`
+}
+
+// Normalize returns the document as decoded by encoding/json, the only types the patches
+// operate on are map[string]interface{}, []interface{}, string, float64, bool and nil.
+func Normalize(document interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	var normalized interface{}
+	err = json.Unmarshal(encoded, &normalized)
+	return normalized, err
+}
+
+// Apply applies the operations in order to a copy of the normalized document. Either every
+// operation succeeds or the error is returned and the document is left untouched.
+func Apply(document interface{}, operations []Operation) (interface{}, error) {
+	patched := deepCopy(document)
+
+	for i, operation := range operations {
+		var err error
+		patched, err = apply(patched, operation)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %v", i, operation.Op, operation.Path, err)
+		}
+	}
+
+	return patched, nil
+}
+
+// MergePatch applies a RFC 7386 JSON Merge Patch to a copy of the normalized document. Null
+// members of the patch remove the member from the document, objects are merged recursively
+// and any other value replaces the target. Ex.:
+// {"partners": {"acme": "a1b2c3d4e5f6d7", "globex": null}}
+func MergePatch(document interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return deepCopy(patch)
+	}
+
+	documentObject, ok := document.(map[string]interface{})
+	if !ok {
+		documentObject = make(map[string]interface{})
+	}
+
+	merged := make(map[string]interface{}, len(documentObject)+len(patchObject))
+	for key, value := range documentObject {
+		merged[key] = deepCopy(value)
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = MergePatch(merged[key], value)
+	}
+
+	return merged
+}
+
+func apply(document interface{}, operation Operation) (interface{}, error) {
+	switch operation.Op {
+	case OperationAdd:
+		return add(document, operation.Path, deepCopy(operation.Value))
+	case OperationRemove:
+		document, _, err := remove(document, operation.Path)
+		return document, err
+	case OperationReplace:
+		document, _, err := remove(document, operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		return add(document, operation.Path, deepCopy(operation.Value))
+	case OperationMove:
+		if strings.HasPrefix(operation.Path, operation.From+"/") {
+			return nil, fmt.Errorf("can't move %s into one of its children", operation.From)
+		}
+		document, value, err := remove(document, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		return add(document, operation.Path, value)
+	case OperationCopy:
+		value, err := get(document, operation.From)
+		if err != nil {
+			return nil, err
+		}
+		return add(document, operation.Path, deepCopy(value))
+	case OperationTest:
+		value, err := get(document, operation.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, operation.Value) {
+			return nil, fmt.Errorf("test failed, value is %v", value)
+		}
+		return document, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", operation.Op)
+	}
+}
+
+// add sets the value at path, inserting it when the parent is an array.
+func add(document interface{}, path string, value interface{}) (interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+
+	parent, err := resolve(document, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	key := tokens[len(tokens)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[key] = value
+		return document, nil
+	case []interface{}:
+		index := len(container)
+		if key != "-" {
+			if index, err = arrayIndex(key, len(container)+1); err != nil {
+				return nil, err
+			}
+		}
+		container = append(container, nil)
+		copy(container[index+1:], container[index:])
+		container[index] = value
+		return setParent(document, tokens[:len(tokens)-1], container)
+	default:
+		return nil, fmt.Errorf("parent of %s is not an object or array", path)
+	}
+}
+
+// remove deletes the value at path and returns it.
+func remove(document interface{}, path string) (interface{}, interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, document, nil
+	}
+
+	parent, err := resolve(document, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key := tokens[len(tokens)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		value, ok := container[key]
+		if !ok {
+			return nil, nil, fmt.Errorf("%s not found", path)
+		}
+		delete(container, key)
+		return document, value, nil
+	case []interface{}:
+		index, err := arrayIndex(key, len(container))
+		if err != nil {
+			return nil, nil, err
+		}
+		value := container[index]
+		container = append(container[:index], container[index+1:]...)
+		document, err = setParent(document, tokens[:len(tokens)-1], container)
+		return document, value, err
+	default:
+		return nil, nil, fmt.Errorf("parent of %s is not an object or array", path)
+	}
+}
+
+func get(document interface{}, path string) (interface{}, error) {
+	tokens, err := parsePointer(path)
+	if err != nil {
+		return nil, err
+	}
+	return resolve(document, tokens)
+}
+
+// setParent replaces the array at tokens, slices can't be resized in place.
+func setParent(document interface{}, tokens []string, array []interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return array, nil
+	}
+
+	parent, err := resolve(document, tokens[:len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	key := tokens[len(tokens)-1]
+	switch container := parent.(type) {
+	case map[string]interface{}:
+		container[key] = array
+	case []interface{}:
+		index, err := arrayIndex(key, len(container))
+		if err != nil {
+			return nil, err
+		}
+		container[index] = array
+	}
+	return document, nil
+}
+
+func resolve(document interface{}, tokens []string) (interface{}, error) {
+	current := document
+	for i, token := range tokens {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, fmt.Errorf("/%s not found", strings.Join(tokens[:i+1], "/"))
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			current = container[index]
+		default:
+			return nil, fmt.Errorf("/%s is not an object or array", strings.Join(tokens[:i], "/"))
+		}
+	}
+	return current, nil
+}
+
+// parsePointer splits a RFC 6901 JSON Pointer into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid pointer %q, it must start with /", pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index >= length {
+		return 0, fmt.Errorf("array index %d out of bounds", index)
+	}
+	return index, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(typed))
+		for key, child := range typed {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(typed))
+		for i, child := range typed {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	default:
+		return value
+	}
+}
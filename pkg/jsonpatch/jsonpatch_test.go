@@ -0,0 +1,287 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, document string) interface{} {
+	t.Helper()
+
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(document), &decoded); err != nil {
+		t.Fatalf("invalid json %s: %v", document, err)
+	}
+	return decoded
+}
+
+// The RFC 6902 appendix A examples, plus the array and pointer edge cases.
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name     string
+		document string
+		patch    string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "A.1 adding an object member",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			want:     `{"baz": "qux", "foo": "bar"}`,
+		},
+		{
+			name:     "A.2 adding an array element",
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			want:     `{"foo": ["bar", "qux", "baz"]}`,
+		},
+		{
+			name:     "A.3 removing an object member",
+			document: `{"baz": "qux", "foo": "bar"}`,
+			patch:    `[{"op": "remove", "path": "/baz"}]`,
+			want:     `{"foo": "bar"}`,
+		},
+		{
+			name:     "A.4 removing an array element",
+			document: `{"foo": ["bar", "qux", "baz"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/1"}]`,
+			want:     `{"foo": ["bar", "baz"]}`,
+		},
+		{
+			name:     "A.5 replacing a value",
+			document: `{"baz": "qux", "foo": "bar"}`,
+			patch:    `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			want:     `{"baz": "boo", "foo": "bar"}`,
+		},
+		{
+			name:     "A.6 moving a value",
+			document: `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch:    `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			want:     `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{
+			name:     "A.7 moving an array element",
+			document: `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch:    `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			want:     `{"foo": ["all", "cows", "eat", "grass"]}`,
+		},
+		{
+			name:     "A.8 testing a value: success",
+			document: `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch:    `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			want:     `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		{
+			name:     "A.9 testing a value: error",
+			document: `{"baz": "qux"}`,
+			patch:    `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "A.10 adding a nested member object",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			want:     `{"foo": "bar", "child": {"grandchild": {}}}`,
+		},
+		{
+			name:     "A.11 ignoring unrecognized elements",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			want:     `{"foo": "bar", "baz": "qux"}`,
+		},
+		{
+			name:     "A.12 adding to a nonexistent target",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "A.14 ~ escape ordering",
+			document: `{"/": 9, "~1": 10}`,
+			patch:    `[{"op": "test", "path": "/~01", "value": 10}]`,
+			want:     `{"/": 9, "~1": 10}`,
+		},
+		{
+			name:     "A.15 comparing strings and numbers",
+			document: `{"/": 9, "~1": 10}`,
+			patch:    `[{"op": "test", "path": "/~01", "value": "10"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "A.16 adding an array value",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			want:     `{"foo": ["bar", ["abc", "def"]]}`,
+		},
+		{
+			name:     "escaped slash and tilde",
+			document: `{"a/b": {"m~n": 1}}`,
+			patch:    `[{"op": "replace", "path": "/a~1b/m~0n", "value": 2}]`,
+			want:     `{"a/b": {"m~n": 2}}`,
+		},
+		{
+			name:     "inserting at the end of an array",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/1", "value": "baz"}]`,
+			want:     `{"foo": ["bar", "baz"]}`,
+		},
+		{
+			name:     "inserting past the end of an array",
+			document: `{"foo": ["bar"]}`,
+			patch:    `[{"op": "add", "path": "/foo/2", "value": "baz"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "leading zero array index",
+			document: `{"foo": ["bar", "baz"]}`,
+			patch:    `[{"op": "remove", "path": "/foo/01"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "removing from a nested array",
+			document: `{"foo": [["a", "b"], ["c"]]}`,
+			patch:    `[{"op": "remove", "path": "/foo/0/0"}, {"op": "add", "path": "/foo/1/0", "value": "b"}]`,
+			want:     `{"foo": [["b"], ["b", "c"]]}`,
+		},
+		{
+			name:     "moving into a child",
+			document: `{"foo": {"bar": {}}}`,
+			patch:    `[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "moving into a sibling sharing the prefix",
+			document: `{"foo": 1, "foobar": {}}`,
+			patch:    `[{"op": "move", "from": "/foo", "path": "/foobar/foo"}]`,
+			want:     `{"foobar": {"foo": 1}}`,
+		},
+		{
+			name:     "copying a value",
+			document: `{"foo": {"bar": [1]}}`,
+			patch:    `[{"op": "copy", "from": "/foo", "path": "/baz"}, {"op": "add", "path": "/baz/bar/-", "value": 2}]`,
+			want:     `{"foo": {"bar": [1]}, "baz": {"bar": [1, 2]}}`,
+		},
+		{
+			name:     "replacing the root",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "replace", "path": "", "value": ["baz"]}]`,
+			want:     `["baz"]`,
+		},
+		{
+			name:     "testing numbers",
+			document: `{"foo": {"bar": 1.0, "baz": [1, 2.5]}}`,
+			patch:    `[{"op": "test", "path": "/foo", "value": {"bar": 1, "baz": [1.0, 2.5]}}]`,
+			want:     `{"foo": {"bar": 1, "baz": [1, 2.5]}}`,
+		},
+		{
+			name:     "removing a missing member",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "remove", "path": "/baz"}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "replacing a missing member",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "replace", "path": "/baz", "value": 1}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "pointer without a leading slash",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "add", "path": "baz", "value": 1}]`,
+			wantErr:  true,
+		},
+		{
+			name:     "unknown operation",
+			document: `{"foo": "bar"}`,
+			patch:    `[{"op": "merge", "path": "/foo", "value": 1}]`,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			document := decode(t, test.document)
+
+			var operations []Operation
+			if err := json.Unmarshal([]byte(test.patch), &operations); err != nil {
+				t.Fatal(err)
+			}
+
+			patched, err := Apply(document, operations)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("Apply() = %v, want an error", patched)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Apply() error = %v", err)
+				}
+				if want := decode(t, test.want); !reflect.DeepEqual(patched, want) {
+					t.Errorf("Apply() = %v, want %v", patched, want)
+				}
+			}
+
+			// the document is never modified, the operations work on a copy.
+			if original := decode(t, test.document); !reflect.DeepEqual(document, original) {
+				t.Errorf("Apply() modified the document: %v, want %v", document, original)
+			}
+		})
+	}
+}
+
+func TestApplyIsAtomic(t *testing.T) {
+	document := decode(t, `{"foo": ["bar"]}`)
+	operations := []Operation{
+		{Op: OperationAdd, Path: "/foo/-", Value: "baz"},
+		{Op: OperationRemove, Path: "/missing"},
+	}
+
+	if _, err := Apply(document, operations); err == nil {
+		t.Fatal("Apply() should fail on the second operation")
+	}
+	if want := decode(t, `{"foo": ["bar"]}`); !reflect.DeepEqual(document, want) {
+		t.Errorf("document = %v, want %v", document, want)
+	}
+}
+
+// The RFC 7386 appendix A examples.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		document string
+		patch    string
+		want     string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.document+" "+test.patch, func(t *testing.T) {
+			document := decode(t, test.document)
+
+			merged := MergePatch(document, decode(t, test.patch))
+			if want := decode(t, test.want); !reflect.DeepEqual(merged, want) {
+				t.Errorf("MergePatch() = %v, want %v", merged, want)
+			}
+			if original := decode(t, test.document); !reflect.DeepEqual(document, original) {
+				t.Errorf("MergePatch() modified the document: %v, want %v", document, original)
+			}
+		})
+	}
+}
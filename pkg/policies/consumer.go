@@ -0,0 +1,186 @@
+package policies
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+)
+
+const (
+	// AccessLogTopicName is the default topic ingress events are read from.
+	AccessLogTopicName = "access-logs"
+	// ConsumerGroupID is the default consumer group of the policy generator.
+	ConsumerGroupID = "policy-generator"
+)
+
+// retryBackoff is how long Run waits before sending again a policy event which could not be sent.
+var retryBackoff = 5 * time.Second
+
+const (
+	// SourceKafka reads events from the access log topic.
+	SourceKafka = "kafka"
+	// SourceFile reads a JSONL file once.
+	SourceFile = "file"
+	// SourceStdin reads JSONL from the standard input.
+	SourceStdin = "stdin"
+	// SourceTail follows an access log file.
+	SourceTail = "tail"
+)
+
+// ConsumerConfiguration defines where and how ingress events are consumed from.
+type ConsumerConfiguration struct {
+	// Source is one of kafka, file, stdin or tail.
+	Source string
+	// Path of the file read by the file and tail sources.
+	Path string
+	// Format of the events, see NewParser. Defaults to the IngressEvent JSON.
+	Format string
+	// HAProxyCapturedHeaders are the comma separated names of the request headers captured
+	// by haproxy, in their configuration order.
+	HAProxyCapturedHeaders []string
+	Topic                  string
+	GroupID                string
+	// Workers is the number of consumers joining the group. Kafka spreads the topic
+	// partitions between them so they are processed in parallel.
+	Workers int
+}
+
+// NewConsumerConfiguration reads the consumer configuration from the environment.
+func NewConsumerConfiguration() (ConsumerConfiguration, error) {
+	configuration := ConsumerConfiguration{
+		Source:  SourceKafka,
+		Format:  FormatIngress,
+		Topic:   AccessLogTopicName,
+		GroupID: ConsumerGroupID,
+		Workers: 1,
+	}
+
+	if source := os.Getenv("EVENT_SOURCE"); source != "" {
+		configuration.Source = source
+	}
+	configuration.Path = os.Getenv("EVENT_SOURCE_PATH")
+	if format := os.Getenv("ACCESS_LOG_FORMAT"); format != "" {
+		configuration.Format = format
+	}
+	if headers := os.Getenv("ACCESS_LOG_HAPROXY_HEADERS"); headers != "" {
+		for _, header := range strings.Split(headers, ",") {
+			configuration.HAProxyCapturedHeaders = append(configuration.HAProxyCapturedHeaders, strings.ToLower(strings.TrimSpace(header)))
+		}
+	}
+	if topic := os.Getenv("ACCESS_LOG_TOPIC"); topic != "" {
+		configuration.Topic = topic
+	}
+	if groupID := os.Getenv("ACCESS_LOG_GROUP_ID"); groupID != "" {
+		configuration.GroupID = groupID
+	}
+	if workers := os.Getenv("ACCESS_LOG_WORKERS"); workers != "" {
+		n, err := strconv.Atoi(workers)
+		if err != nil {
+			return configuration, err
+		}
+		if n < 1 {
+			return configuration, fmt.Errorf("ACCESS_LOG_WORKERS must be at least 1, got %d", n)
+		}
+		configuration.Workers = n
+	}
+
+	switch configuration.Source {
+	case SourceKafka, SourceStdin:
+	case SourceFile, SourceTail:
+		if configuration.Path == "" {
+			return configuration, fmt.Errorf("EVENT_SOURCE_PATH is required for %s source", configuration.Source)
+		}
+	default:
+		return configuration, fmt.Errorf("unknown event source %s", configuration.Source)
+	}
+
+	if _, err := NewParser(configuration); err != nil {
+		return configuration, err
+	}
+
+	return configuration, nil
+}
+
+// Consume runs the controller against the configured source. For kafka it starts Workers
+// consumers in the same group and blocks while they are running.
+func (controller *PolicyController) Consume(configuration ConsumerConfiguration) error {
+	parser, err := NewParser(configuration)
+	if err != nil {
+		return err
+	}
+	controller.Parser = parser
+
+	switch configuration.Source {
+	case SourceFile:
+		source, err := NewFileSource(configuration.Path)
+		if err != nil {
+			return err
+		}
+		return controller.Run(source)
+	case SourceStdin:
+		return controller.Run(NewReaderSource(os.Stdin))
+	case SourceTail:
+		source, err := NewTailSource(configuration.Path, false)
+		if err != nil {
+			return err
+		}
+		return controller.Run(source)
+	case SourceKafka:
+	default:
+		return fmt.Errorf("unknown event source %s", configuration.Source)
+	}
+
+	sources := make([]*KafkaSource, 0, configuration.Workers)
+	for i := 0; i < configuration.Workers; i++ {
+		source, err := NewKafkaSource(configuration.Topic, configuration.GroupID, controller.Logger)
+		if err != nil {
+			for _, source := range sources {
+				source.Close()
+			}
+			return err
+		}
+		sources = append(sources, source)
+	}
+
+	// the first worker failing stops its siblings, their uncommitted events are left for
+	// the next consumer joining the group.
+	var (
+		wg       sync.WaitGroup
+		stopOnce sync.Once
+		firstErr error
+	)
+	for _, source := range sources {
+		wg.Add(1)
+		go func(source *KafkaSource) {
+			defer wg.Done()
+			if err := controller.Run(source); err != nil {
+				stopOnce.Do(func() {
+					firstErr = err
+					for _, source := range sources {
+						source.Stop()
+					}
+				})
+			}
+		}(source)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// evaluateMessage returns the policy events of the ingress event. Messages which can't be
+// parsed are skipped.
+func (controller *PolicyController) evaluateMessage(value []byte) []firewall.PolicyEvent {
+	event, err := controller.Parser.Parse(value)
+	if err != nil {
+		controller.Logger.Warningf("could not parse event: %v", err)
+		return nil
+	}
+
+	return controller.Evaluate(event)
+}
@@ -0,0 +1,105 @@
+package policies
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// maxEventSize is the longest line line-based sources accept.
+const maxEventSize = 1024 * 1024
+
+// EventSource is where the PolicyController reads raw ingress events from.
+type EventSource interface {
+	// Read blocks until the next event is available. It returns io.EOF once the source
+	// is exhausted, any other error is not recoverable.
+	Read() ([]byte, error)
+	// Commit marks the last event read as processed.
+	Commit() error
+	// Close releases the resources held by the source.
+	Close() error
+}
+
+// ReaderSource reads one event per line (JSONL) from a reader until it is exhausted.
+type ReaderSource struct {
+	reader  io.ReadCloser
+	scanner *bufio.Scanner
+}
+
+// NewReaderSource reads events from reader, e.g. os.Stdin.
+func NewReaderSource(reader io.ReadCloser) *ReaderSource {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxEventSize)
+
+	return &ReaderSource{
+		reader:  reader,
+		scanner: scanner,
+	}
+}
+
+// NewFileSource reads events from a JSONL file.
+func NewFileSource(path string) (*ReaderSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewReaderSource(file), nil
+}
+
+// Read returns the next non empty line.
+func (source *ReaderSource) Read() ([]byte, error) {
+	for source.scanner.Scan() {
+		line := bytes.TrimSpace(source.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		// the scanner reuses its buffer, the event must outlive the next Scan.
+		return append([]byte(nil), line...), nil
+	}
+
+	if err := source.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Commit is a no-op, lines are not tracked.
+func (source *ReaderSource) Commit() error {
+	return nil
+}
+
+// Close ...
+func (source *ReaderSource) Close() error {
+	return source.reader.Close()
+}
+
+// ChannelSource reads events from a channel until it is closed. Mostly useful for tests.
+type ChannelSource struct {
+	Events chan []byte
+}
+
+// NewChannelSource ...
+func NewChannelSource(events chan []byte) *ChannelSource {
+	return &ChannelSource{Events: events}
+}
+
+// Read ...
+func (source *ChannelSource) Read() ([]byte, error) {
+	value, ok := <-source.Events
+	if !ok {
+		return nil, io.EOF
+	}
+	return value, nil
+}
+
+// Commit is a no-op.
+func (source *ChannelSource) Commit() error {
+	return nil
+}
+
+// Close is a no-op, the channel is owned by the sender.
+func (source *ChannelSource) Close() error {
+	return nil
+}
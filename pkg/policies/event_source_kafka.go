@@ -0,0 +1,96 @@
+package policies
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/stream"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// KafkaSource reads events from a topic as a member of a consumer group. Offsets are only
+// stored on Commit, so uncommitted events are read again after a restart or rebalance.
+type KafkaSource struct {
+	Consumer *kafka.Consumer
+	Logger   *logrus.Logger
+	last     *kafka.Message
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// pollTimeout bounds how long Read waits for a message before checking if it was stopped.
+const pollTimeout = 100 * time.Millisecond
+
+// NewKafkaSource subscribes a new group consumer to the topic.
+func NewKafkaSource(topic, groupID string, logger *logrus.Logger) (*KafkaSource, error) {
+	consumer, err := stream.NewGroupConsumer(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := consumer.SubscribeTopics([]string{topic}, nil); err != nil {
+		consumer.Close()
+		return nil, err
+	}
+
+	return &KafkaSource{
+		Consumer: consumer,
+		Logger:   logger,
+		stopped:  make(chan struct{}),
+	}, nil
+}
+
+// Read blocks until the next message, it returns io.EOF once the source is stopped. Non
+// fatal consumer errors are logged and skipped.
+func (source *KafkaSource) Read() ([]byte, error) {
+	for {
+		select {
+		case <-source.stopped:
+			return nil, io.EOF
+		default:
+		}
+
+		msg, err := source.Consumer.ReadMessage(pollTimeout)
+		if err == nil {
+			source.last = msg
+			return msg.Value, nil
+		}
+
+		kafkaErr, ok := err.(kafka.Error)
+		if ok && kafkaErr.Code() == kafka.ErrTimedOut {
+			continue
+		}
+		if ok && kafkaErr.IsFatal() {
+			return nil, err
+		}
+		source.Logger.Error(err)
+	}
+}
+
+// Stop makes Read return io.EOF, it is safe to call from other goroutines. The consumer is
+// closed by whoever is reading from it.
+func (source *KafkaSource) Stop() {
+	source.stopOnce.Do(func() {
+		close(source.stopped)
+	})
+}
+
+// Commit stores the offset after the last message, it is committed in the background.
+func (source *KafkaSource) Commit() error {
+	if source.last == nil {
+		return nil
+	}
+
+	processed := source.last.TopicPartition
+	processed.Offset++
+	_, err := source.Consumer.StoreOffsets([]kafka.TopicPartition{processed})
+
+	return err
+}
+
+// Close leaves the consumer group.
+func (source *KafkaSource) Close() error {
+	return source.Consumer.Close()
+}
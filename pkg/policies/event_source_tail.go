@@ -0,0 +1,187 @@
+package policies
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TailSource follows a growing file like `tail -F`, e.g. an nginx or envoy access log.
+// It survives truncation and rotation by re-opening the path and never returns io.EOF
+// until it is closed. Lines longer than maxEventSize are dropped.
+type TailSource struct {
+	Path         string
+	PollInterval time.Duration
+	// mutex guards file, Close may run while Read is blocked reading it, Ex.: a named pipe.
+	mutex  sync.Mutex
+	file   *os.File
+	reader *bufio.Reader
+	offset int64
+	// partial is the line read so far, discarding is set while the rest of an overlong line
+	// is skipped.
+	partial    []byte
+	discarding bool
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewTailSource starts following path from its end, or from its beginning if fromStart is set.
+func NewTailSource(path string, fromStart bool) (*TailSource, error) {
+	source := &TailSource{
+		Path:         path,
+		PollInterval: time.Second,
+		closed:       make(chan struct{}),
+	}
+
+	whence := io.SeekEnd
+	if fromStart {
+		whence = io.SeekStart
+	}
+	if err := source.open(whence); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func (source *TailSource) open(whence int) error {
+	file, err := os.Open(source.Path)
+	if err != nil {
+		return err
+	}
+
+	offset, err := file.Seek(0, whence)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+	if source.isClosed() {
+		file.Close()
+		return io.EOF
+	}
+
+	if source.file != nil {
+		source.file.Close()
+	}
+	source.file = file
+	source.reader = bufio.NewReader(file)
+	source.offset = offset
+	source.partial = nil
+	source.discarding = false
+
+	return nil
+}
+
+// Read blocks until a complete line is written to the file. It returns io.EOF once closed.
+func (source *TailSource) Read() ([]byte, error) {
+	for {
+		if source.isClosed() {
+			return nil, io.EOF
+		}
+
+		// the buffer of the reader bounds what is read at once, overlong lines are never held.
+		chunk, err := source.reader.ReadSlice('\n')
+		source.offset += int64(len(chunk))
+		if !source.discarding {
+			source.partial = append(source.partial, chunk...)
+		}
+		if len(source.partial) > maxEventSize {
+			// the rest of the line, up to its newline, must not be read as an event.
+			source.partial = nil
+			source.discarding = true
+		}
+
+		switch {
+		case err == nil:
+			if source.discarding {
+				source.discarding = false
+				continue
+			}
+			line := bytes.TrimSpace(source.partial)
+			source.partial = nil
+			if len(line) == 0 {
+				continue
+			}
+			return line, nil
+		case err == bufio.ErrBufferFull:
+			continue
+		case err != io.EOF:
+			if source.isClosed() {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		select {
+		case <-source.closed:
+			return nil, io.EOF
+		case <-time.After(source.PollInterval):
+		}
+
+		if err := source.reopenIfRotated(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// reopenIfRotated starts reading from the beginning when the file was truncated or the path
+// now points to a new file. A rotated file is only left once its end is read, the lines
+// written before the rotation are not lost.
+func (source *TailSource) reopenIfRotated() error {
+	info, err := os.Stat(source.Path)
+	if os.IsNotExist(err) {
+		// rotated but not yet re-created.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	current, err := source.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !os.SameFile(info, current) && current.Size() > source.offset:
+		// lines were written to the rotated file since we reached its end.
+		return nil
+	case !os.SameFile(info, current):
+		return source.open(io.SeekStart)
+	case info.Size() < source.offset:
+		return source.open(io.SeekStart)
+	}
+	return nil
+}
+
+func (source *TailSource) isClosed() bool {
+	select {
+	case <-source.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Commit is a no-op, offsets are not persisted.
+func (source *TailSource) Commit() error {
+	return nil
+}
+
+// Close stops following the file, a Read in progress returns io.EOF.
+func (source *TailSource) Close() error {
+	var err error
+	source.closeOnce.Do(func() {
+		source.mutex.Lock()
+		defer source.mutex.Unlock()
+		close(source.closed)
+		err = source.file.Close()
+	})
+	return err
+}
@@ -0,0 +1,200 @@
+package policies
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTail follows a new file holding content, it returns the source, the file to write
+// to and a function removing both.
+func newTestTail(t *testing.T, content string, fromStart bool) (*TailSource, *os.File, func()) {
+	dir, err := ioutil.TempDir("", "tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "access.log")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	write(t, file, content)
+
+	source, err := NewTailSource(path, fromStart)
+	if err != nil {
+		file.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	source.PollInterval = 10 * time.Millisecond
+
+	return source, file, func() {
+		source.Close()
+		file.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func write(t *testing.T, file *os.File, content string) {
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readLine reads the next line, failing the test when none comes in time.
+func readLine(t *testing.T, source *TailSource) string {
+	type result struct {
+		line []byte
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		line, err := source.Read()
+		results <- result{line, err}
+	}()
+
+	select {
+	case result := <-results:
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		return string(result.line)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no line was read")
+		return ""
+	}
+}
+
+func TestTailSourceFollows(t *testing.T) {
+	source, file, cleanup := newTestTail(t, "before\n", false)
+	defer cleanup()
+
+	write(t, file, "first\n\n  second  \n")
+	if line := readLine(t, source); line != "first" {
+		t.Errorf("read %q, want first, the lines written before are skipped", line)
+	}
+	if line := readLine(t, source); line != "second" {
+		t.Errorf("read %q, want second", line)
+	}
+
+	// a line is only read once its newline is written.
+	write(t, file, `{"status":`)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = file.WriteString(" 200}\n")
+	}()
+	if line := readLine(t, source); line != `{"status": 200}` {
+		t.Errorf("read %q, want the completed line", line)
+	}
+}
+
+func TestTailSourceFromStart(t *testing.T) {
+	source, _, cleanup := newTestTail(t, "before\n", true)
+	defer cleanup()
+
+	if line := readLine(t, source); line != "before" {
+		t.Errorf("read %q, want before", line)
+	}
+}
+
+func TestTailSourceTruncated(t *testing.T) {
+	source, file, cleanup := newTestTail(t, "", false)
+	defer cleanup()
+
+	write(t, file, "first line\n")
+	if line := readLine(t, source); line != "first line" {
+		t.Fatalf("read %q, want first line", line)
+	}
+
+	if err := file.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	write(t, file, "new\n")
+	if line := readLine(t, source); line != "new" {
+		t.Errorf("read %q, want new, read from the beginning once truncated", line)
+	}
+}
+
+func TestTailSourceRotated(t *testing.T) {
+	source, file, cleanup := newTestTail(t, "", false)
+	defer cleanup()
+
+	write(t, file, "one\n")
+	if line := readLine(t, source); line != "one" {
+		t.Fatalf("read %q, want one", line)
+	}
+
+	// the writer keeps writing to the rotated file until it re-opens the path.
+	if err := os.Rename(source.Path, source.Path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(source.Path, []byte("three\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	write(t, file, "two\n")
+
+	for _, want := range []string{"two", "three"} {
+		if line := readLine(t, source); line != want {
+			t.Errorf("read %q, want %s", line, want)
+		}
+	}
+}
+
+func TestTailSourceDropsOverlongLines(t *testing.T) {
+	source, file, cleanup := newTestTail(t, "", false)
+	defer cleanup()
+	overlong := string(bytes.Repeat([]byte("x"), maxEventSize+1))
+
+	write(t, file, overlong+"\nfirst\n")
+	if line := readLine(t, source); line != "first" {
+		t.Errorf("read %q, want first", line)
+	}
+
+	// the rest of an overlong line written later is dropped as well.
+	write(t, file, overlong)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _ = file.WriteString(`"rest": "of the line"}` + "\nsecond\n")
+	}()
+	if line := readLine(t, source); line != "second" {
+		t.Errorf("read %.40q, want second", line)
+	}
+}
+
+func TestTailSourceClose(t *testing.T) {
+	source, _, cleanup := newTestTail(t, "", false)
+	defer cleanup()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := source.Read()
+		errs <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := source.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		if err != io.EOF {
+			t.Errorf("Read() = %v, want io.EOF once closed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close() didn't interrupt Read()")
+	}
+
+	if _, err := source.Read(); err != io.EOF {
+		t.Errorf("Read() = %v after Close(), want io.EOF", err)
+	}
+	if err := source.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+}
@@ -70,7 +70,7 @@ func (policy *Policy) Process(event *policies.IngressEvent) (firewall.PolicyEven
 	// Do not process the rule if the event date/time is too old.
 	// TODO: move this to the interface caller if possible as it is common between all policies
 	if time.Now().After(eventTime.Add(policy.BlockDuration)) {
-		policy.Logger.Debug("event is too old (%s) to be processed", eventTime)
+		policy.Logger.Debugf("event is too old (%s) to be processed", eventTime)
 		return firewall.PolicyEvent{}, nil
 	}
 
@@ -83,14 +83,20 @@ func (policy *Policy) Process(event *policies.IngressEvent) (firewall.PolicyEven
 		// skip if policy was already returned for this IP but keeps falling into rate limit.
 		// TODO: maybe rate limiter provides something in these lines.
 		if _, ok := policy.Cache[BlackListIPBucketName].Get(event.IP); !ok {
-			policy.Cache[BlackListIPBucketName].Set(event.IP, true, policy.BlockDuration)
+			// the firewall tracks the creation time and the hits of the entry.
+			entry := firewall.IPEntry{
+				ExpireAt: time.Now().Add(policy.BlockDuration),
+				Reason:   "too many requests without user agent",
+				Source:   policy.Name(),
+			}
+			policy.Cache[BlackListIPBucketName].Set(event.IP, entry, policy.BlockDuration)
 
 			return firewall.PolicyEvent{
 				Name: policy.Name(),
 				Type: firewall.EventTypePatch,
 				IPBuckets: firewall.IPBuckets{
 					BlackListIPBucketName: {
-						event.IP: time.Now().Add(policy.BlockDuration),
+						event.IP: entry,
 					},
 				},
 			}, nil
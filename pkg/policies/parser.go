@@ -0,0 +1,175 @@
+package policies
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatIngress is the IngressEvent JSON representation.
+	FormatIngress = "ingress"
+	// FormatNginxCombined is the nginx predefined combined log_format.
+	FormatNginxCombined = "nginx-combined"
+	// FormatNginxJSON is a log_format with escape=json named after the nginx variables.
+	FormatNginxJSON = "nginx-json"
+	// FormatEnvoy is the envoy default access log format.
+	FormatEnvoy = "envoy"
+	// FormatEnvoyJSON is an envoy json_format named after the default format fields.
+	FormatEnvoyJSON = "envoy-json"
+	// FormatALB is the AWS application load balancer access log format.
+	FormatALB = "alb"
+	// FormatHAProxy is the HAProxy HTTP log format (option httplog).
+	FormatHAProxy = "haproxy"
+)
+
+// Parser converts a raw access log line into an IngressEvent.
+type Parser interface {
+	Parse(line []byte) (*IngressEvent, error)
+}
+
+// NewParser returns the parser for the configured access log format.
+func NewParser(configuration ConsumerConfiguration) (Parser, error) {
+	switch configuration.Format {
+	case FormatIngress, "":
+		return &IngressParser{}, nil
+	case FormatNginxCombined:
+		return &NginxCombinedParser{}, nil
+	case FormatNginxJSON:
+		return &NginxJSONParser{}, nil
+	case FormatEnvoy:
+		return &EnvoyParser{}, nil
+	case FormatEnvoyJSON:
+		return &EnvoyJSONParser{}, nil
+	case FormatALB:
+		return &ALBParser{}, nil
+	case FormatHAProxy:
+		return &HAProxyParser{CapturedRequestHeaders: configuration.HAProxyCapturedHeaders}, nil
+	default:
+		return nil, fmt.Errorf("unknown access log format %s", configuration.Format)
+	}
+}
+
+// IngressParser parses events already in the IngressEvent JSON representation.
+type IngressParser struct{}
+
+// Parse ...
+func (parser *IngressParser) Parse(line []byte) (*IngressEvent, error) {
+	event := &IngressEvent{}
+	if err := json.Unmarshal(line, event); err != nil {
+		return nil, err
+	}
+
+	return event, nil
+}
+
+// newIngressEvent fills the fields shared by every access log format. Headers must be lower cased.
+func newIngressEvent(eventTime time.Time, ip, host, method, path, status string, headers map[string][]string) *IngressEvent {
+	if headers == nil {
+		headers = make(map[string][]string)
+	}
+	if host != "" {
+		headers["host"] = []string{host}
+	}
+
+	event := &IngressEvent{
+		Host:    host,
+		Method:  method,
+		Path:    path,
+		Headers: headers,
+		IP:      ip,
+		Time:    eventTime.UTC().Format(time.RFC3339Nano),
+		Status:  status,
+	}
+	if userAgent, ok := headers["user-agent"]; ok && len(userAgent) > 0 {
+		event.UserAgent = userAgent[0]
+	}
+
+	return event
+}
+
+// setHeader adds the value unless it is empty or the "-" placeholder for missing values.
+func setHeader(headers map[string][]string, name, value string) {
+	if value == "" || value == "-" {
+		return
+	}
+	headers[name] = []string{value}
+}
+
+// splitRequestLine splits "GET /path?query HTTP/1.1". Absolute URIs are reduced to their path,
+// their host is returned separately. The query string is dropped.
+func splitRequestLine(requestLine string) (method, host, path string, err error) {
+	parts := strings.Fields(requestLine)
+	if len(parts) < 2 {
+		return "", "", "", fmt.Errorf("invalid request line %q", requestLine)
+	}
+
+	method, path = parts[0], strings.SplitN(parts[1], "?", 2)[0]
+	if index := strings.Index(path, "://"); index >= 0 {
+		path = path[index+len("://"):]
+		host = path
+		if slash := strings.Index(path, "/"); slash >= 0 {
+			host, path = path[:slash], path[slash:]
+		} else {
+			path = "/"
+		}
+	}
+
+	return method, host, path, nil
+}
+
+// stripPort removes the port of "ip:port" and "[ipv6]:port" addresses.
+func stripPort(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// lastForwardedFor returns the right-most address of an x-forwarded-for list, which is the
+// one appended by the proxy writing the access log.
+func lastForwardedFor(forwardedFor string) string {
+	addresses := strings.Split(forwardedFor, ",")
+	return strings.TrimSpace(addresses[len(addresses)-1])
+}
+
+// splitQuoted splits the line by spaces, keeping double quoted fields (with backslash
+// escapes) together and unquoted.
+func splitQuoted(line string) ([]string, error) {
+	var fields []string
+	var field strings.Builder
+	inQuotes, inField, escaped := false, false, false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"':
+			inQuotes = !inQuotes
+			inField = true
+		case r == ' ' && !inQuotes:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,51 @@
+package policies
+
+import (
+	"fmt"
+	"time"
+)
+
+// positions of the fields used from the ALB access log entry, see
+// https://docs.aws.amazon.com/elasticloadbalancing/latest/application/load-balancer-access-logs.html
+const (
+	albTimeField      = 1
+	albClientField    = 3
+	albStatusField    = 8
+	albRequestField   = 12
+	albUserAgentField = 13
+	albTraceIDField   = 17
+	albDomainField    = 18
+)
+
+// ALBParser parses AWS application load balancer access logs.
+type ALBParser struct{}
+
+// Parse ...
+func (parser *ALBParser) Parse(line []byte) (*IngressEvent, error) {
+	fields, err := splitQuoted(string(line))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) <= albDomainField {
+		return nil, fmt.Errorf("not an alb log line: %q", line)
+	}
+
+	eventTime, err := time.Parse(time.RFC3339, fields[albTimeField])
+	if err != nil {
+		return nil, err
+	}
+
+	method, host, path, err := splitRequestLine(fields[albRequestField])
+	if err != nil {
+		return nil, err
+	}
+	if domain := placeholderToEmpty(fields[albDomainField]); domain != "" {
+		host = domain
+	}
+
+	headers := make(map[string][]string)
+	setHeader(headers, "user-agent", fields[albUserAgentField])
+	setHeader(headers, "x-amzn-trace-id", fields[albTraceIDField])
+
+	return newIngressEvent(eventTime, stripPort(fields[albClientField]), stripPort(host), method, path, fields[albStatusField], headers), nil
+}
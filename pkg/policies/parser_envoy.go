@@ -0,0 +1,93 @@
+package policies
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// [%START_TIME%] "%REQ(:METHOD)% %REQ(X-ENVOY-ORIGINAL-PATH?:PATH)% %PROTOCOL%" %RESPONSE_CODE% %RESPONSE_FLAGS%
+// %BYTES_RECEIVED% %BYTES_SENT% %DURATION% %RESP(X-ENVOY-UPSTREAM-SERVICE-TIME)% "%REQ(X-FORWARDED-FOR)%"
+// "%REQ(USER-AGENT)%" "%REQ(X-REQUEST-ID)%" "%REQ(:AUTHORITY)%" "%UPSTREAM_HOST%"
+var envoyRegexp = regexp.MustCompile(`^\[([^\]]+)\] "([^"]*)" (\d{3}) \S+ \S+ \S+ \S+ \S+ "([^"]*)" "([^"]*)" "([^"]*)" "([^"]*)" "([^"]*)"`)
+
+// EnvoyParser parses the envoy default access log format. The client ip is the right-most
+// x-forwarded-for address, the one envoy appends when use_remote_address is set.
+type EnvoyParser struct{}
+
+// Parse ...
+func (parser *EnvoyParser) Parse(line []byte) (*IngressEvent, error) {
+	match := envoyRegexp.FindStringSubmatch(string(line))
+	if match == nil {
+		return nil, fmt.Errorf("not an envoy log line: %q", line)
+	}
+
+	eventTime, err := time.Parse(time.RFC3339, match[1])
+	if err != nil {
+		return nil, err
+	}
+
+	method, _, path, err := splitRequestLine(match[2])
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string][]string)
+	setHeader(headers, "x-forwarded-for", match[4])
+	setHeader(headers, "user-agent", match[5])
+	setHeader(headers, "x-request-id", match[6])
+
+	return newIngressEvent(eventTime, lastForwardedFor(placeholderToEmpty(match[4])), placeholderToEmpty(match[7]), method, path, match[3], headers), nil
+}
+
+// envoyJSONEvent is a json_format using the snake cased names of the default format, Ex.:
+// json_format: {"start_time": "%START_TIME%", "method": "%REQ(:METHOD)%", "authority": "%REQ(:AUTHORITY)%", ...}
+type envoyJSONEvent struct {
+	StartTime               string      `json:"start_time"`
+	Method                  string      `json:"method"`
+	Path                    string      `json:"path"`
+	ResponseCode            json.Number `json:"response_code"`
+	XForwardedFor           string      `json:"x_forwarded_for"`
+	UserAgent               string      `json:"user_agent"`
+	RequestID               string      `json:"request_id"`
+	Authority               string      `json:"authority"`
+	DownstreamRemoteAddress string      `json:"downstream_remote_address"`
+}
+
+// EnvoyJSONParser parses envoy json_format access logs. The client ip is taken from
+// downstream_remote_address, or from x_forwarded_for if missing.
+type EnvoyJSONParser struct{}
+
+// Parse ...
+func (parser *EnvoyJSONParser) Parse(line []byte) (*IngressEvent, error) {
+	envoyEvent := &envoyJSONEvent{}
+	if err := json.Unmarshal(line, envoyEvent); err != nil {
+		return nil, err
+	}
+
+	eventTime, err := time.Parse(time.RFC3339, envoyEvent.StartTime)
+	if err != nil {
+		return nil, err
+	}
+
+	ip := stripPort(placeholderToEmpty(envoyEvent.DownstreamRemoteAddress))
+	if ip == "" {
+		ip = lastForwardedFor(placeholderToEmpty(envoyEvent.XForwardedFor))
+	}
+
+	headers := make(map[string][]string)
+	setHeader(headers, "x-forwarded-for", envoyEvent.XForwardedFor)
+	setHeader(headers, "user-agent", envoyEvent.UserAgent)
+	setHeader(headers, "x-request-id", envoyEvent.RequestID)
+
+	return newIngressEvent(eventTime, ip, placeholderToEmpty(envoyEvent.Authority), envoyEvent.Method, envoyEvent.Path, envoyEvent.ResponseCode.String(), headers), nil
+}
+
+// placeholderToEmpty converts the "-" envoy writes for missing values.
+func placeholderToEmpty(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
@@ -0,0 +1,55 @@
+package policies
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const haproxyTimeLayout = "02/Jan/2006:15:04:05.000"
+
+// [syslog prefix] client_ip:port [accept_date] frontend backend/server timers status bytes
+// req_cookie res_cookie termination_state conns queues {captured_req_headers} {captured_res_headers} "request"
+var haproxyRegexp = regexp.MustCompile(`(\S+):\d+ \[([^\]]+)\] \S+ \S+ \S+ (-?\d+) \S+ \S+ \S+ \S+ \S+ \S+ (?:\{([^}]*)\} )?(?:\{[^}]*\} )?"([^"]*)"`)
+
+// HAProxyParser parses the HAProxy HTTP log format. HAProxy does not log request headers
+// unless captured, CapturedRequestHeaders are the lower cased names of the "capture request
+// header" statements in their configuration order. Ex.: []string{"host", "user-agent"}.
+type HAProxyParser struct {
+	CapturedRequestHeaders []string
+}
+
+// Parse ...
+func (parser *HAProxyParser) Parse(line []byte) (*IngressEvent, error) {
+	match := haproxyRegexp.FindStringSubmatch(string(line))
+	if match == nil {
+		return nil, fmt.Errorf("not a haproxy log line: %q", line)
+	}
+
+	// accept_date has no timezone, haproxy logs it in the local time of the server.
+	eventTime, err := time.ParseInLocation(haproxyTimeLayout, match[2], time.Local)
+	if err != nil {
+		return nil, err
+	}
+
+	method, host, path, err := splitRequestLine(match[5])
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string][]string)
+	if match[4] != "" {
+		values := strings.Split(match[4], "|")
+		for i, name := range parser.CapturedRequestHeaders {
+			if i < len(values) {
+				setHeader(headers, name, values[i])
+			}
+		}
+	}
+	if host == "" && len(headers["host"]) > 0 {
+		host = headers["host"][0]
+	}
+
+	return newIngressEvent(eventTime, match[1], host, method, path, match[3], headers), nil
+}
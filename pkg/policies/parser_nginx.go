@@ -0,0 +1,107 @@
+package policies
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const nginxTimeLocalLayout = "02/Jan/2006:15:04:05 -0700"
+
+// '$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"'
+// anything appended to the combined format is ignored.
+var nginxCombinedRegexp = regexp.MustCompile(`^(\S+) \S+ \S+ \[([^\]]+)\] "([^"]*)" (\d{3}) \S+ "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"`)
+
+// NginxCombinedParser parses the nginx predefined combined log format. It has no host.
+type NginxCombinedParser struct{}
+
+// Parse ...
+func (parser *NginxCombinedParser) Parse(line []byte) (*IngressEvent, error) {
+	match := nginxCombinedRegexp.FindStringSubmatch(string(line))
+	if match == nil {
+		return nil, fmt.Errorf("not a nginx combined log line: %q", line)
+	}
+
+	eventTime, err := time.Parse(nginxTimeLocalLayout, match[2])
+	if err != nil {
+		return nil, err
+	}
+
+	method, host, path, err := splitRequestLine(match[3])
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string][]string)
+	setHeader(headers, "referer", match[5])
+	setHeader(headers, "user-agent", match[6])
+
+	return newIngressEvent(eventTime, match[1], host, method, path, match[4], headers), nil
+}
+
+// NginxJSONParser parses a log_format with escape=json whose keys are the nginx variable
+// names, e.g. {"remote_addr":"$remote_addr","time_iso8601":"$time_iso8601",...}. Every
+// http_* variable is mapped to its request header.
+type NginxJSONParser struct{}
+
+// Parse ...
+func (parser *NginxJSONParser) Parse(line []byte) (*IngressEvent, error) {
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, err
+	}
+
+	var eventTime time.Time
+	var err error
+	switch {
+	case stringField(fields, "time_iso8601") != "":
+		eventTime, err = time.Parse(time.RFC3339, stringField(fields, "time_iso8601"))
+	case stringField(fields, "time_local") != "":
+		eventTime, err = time.Parse(nginxTimeLocalLayout, stringField(fields, "time_local"))
+	default:
+		err = fmt.Errorf("missing time_iso8601 or time_local")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	headers := make(map[string][]string)
+	for key := range fields {
+		if strings.HasPrefix(key, "http_") {
+			setHeader(headers, strings.Replace(strings.TrimPrefix(key, "http_"), "_", "-", -1), stringField(fields, key))
+		}
+	}
+
+	method := stringField(fields, "request_method")
+	path := stringField(fields, "uri")
+	if requestURI := stringField(fields, "request_uri"); requestURI != "" {
+		path = strings.SplitN(requestURI, "?", 2)[0]
+	}
+	if request := stringField(fields, "request"); request != "" && (method == "" || path == "") {
+		method, _, path, err = splitRequestLine(request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	host := stringField(fields, "host")
+	if host == "" {
+		host = stringField(fields, "http_host")
+	}
+
+	return newIngressEvent(eventTime, stringField(fields, "remote_addr"), host, method, path, stringField(fields, "status"), headers), nil
+}
+
+// stringField returns the field as a string, numbers included.
+func stringField(fields map[string]interface{}, key string) string {
+	switch value := fields[key].(type) {
+	case string:
+		return value
+	case float64:
+		return fmt.Sprintf("%v", value)
+	default:
+		return ""
+	}
+}
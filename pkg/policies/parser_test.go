@@ -0,0 +1,185 @@
+package policies
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsers(t *testing.T) {
+	// haproxy logs the accept date in the local time of the server.
+	haproxyTime := time.Date(2020, time.March, 6, 14, 13, 12, 449000000, time.Local).UTC().Format(time.RFC3339Nano)
+
+	tests := []struct {
+		name          string
+		configuration ConsumerConfiguration
+		line          string
+		want          *IngressEvent
+	}{
+		{
+			name:          "ingress",
+			configuration: ConsumerConfiguration{Format: FormatIngress},
+			line:          `{"host":"example.com","method":"GET","path":"/","ip":"192.0.2.1","time":"1583503992.449","status":"200"}`,
+			want: &IngressEvent{
+				Host:   "example.com",
+				Method: "GET",
+				Path:   "/",
+				IP:     "192.0.2.1",
+				Time:   "1583503992.449",
+				Status: "200",
+			},
+		},
+		{
+			name:          "nginx combined",
+			configuration: ConsumerConfiguration{Format: FormatNginxCombined},
+			line:          `192.0.2.1 - - [06/Mar/2020:14:13:12 +0100] "GET /login?next=%2F HTTP/1.1" 403 153 "https://example.com/" "curl/7.68.0"`,
+			want: &IngressEvent{
+				Method: "GET",
+				Path:   "/login",
+				Headers: map[string][]string{
+					"referer":    {"https://example.com/"},
+					"user-agent": {"curl/7.68.0"},
+				},
+				IP:        "192.0.2.1",
+				Time:      "2020-03-06T13:13:12Z",
+				Status:    "403",
+				UserAgent: "curl/7.68.0",
+			},
+		},
+		{
+			name:          "nginx json",
+			configuration: ConsumerConfiguration{Format: FormatNginxJSON},
+			line:          `{"remote_addr":"2001:db8::1","time_iso8601":"2020-03-06T14:13:12+01:00","request_method":"POST","request_uri":"/api?x=1","status":"201","host":"example.com","http_user_agent":"Mozilla/5.0","http_x_request_id":"abc"}`,
+			want: &IngressEvent{
+				Host:   "example.com",
+				Method: "POST",
+				Path:   "/api",
+				Headers: map[string][]string{
+					"host":         {"example.com"},
+					"user-agent":   {"Mozilla/5.0"},
+					"x-request-id": {"abc"},
+				},
+				IP:        "2001:db8::1",
+				Time:      "2020-03-06T13:13:12Z",
+				Status:    "201",
+				UserAgent: "Mozilla/5.0",
+			},
+		},
+		{
+			name:          "envoy",
+			configuration: ConsumerConfiguration{Format: FormatEnvoy},
+			line:          `[2020-03-06T13:13:12.449Z] "GET /health HTTP/1.1" 200 - 0 2 1 1 "198.51.100.7, 192.0.2.1" "kube-probe/1.17" "8d2a1f4e" "example.com" "10.0.0.5:8080"`,
+			want: &IngressEvent{
+				Host:   "example.com",
+				Method: "GET",
+				Path:   "/health",
+				Headers: map[string][]string{
+					"host":            {"example.com"},
+					"x-forwarded-for": {"198.51.100.7, 192.0.2.1"},
+					"user-agent":      {"kube-probe/1.17"},
+					"x-request-id":    {"8d2a1f4e"},
+				},
+				IP:        "192.0.2.1",
+				Time:      "2020-03-06T13:13:12.449Z",
+				Status:    "200",
+				UserAgent: "kube-probe/1.17",
+			},
+		},
+		{
+			name:          "envoy without x-forwarded-for",
+			configuration: ConsumerConfiguration{Format: FormatEnvoy},
+			line:          `[2020-03-06T13:13:12.449Z] "GET / HTTP/1.1" 200 - 0 2 1 1 "-" "-" "-" "-" "-"`,
+			want: &IngressEvent{
+				Method:  "GET",
+				Path:    "/",
+				Headers: map[string][]string{},
+				Time:    "2020-03-06T13:13:12.449Z",
+				Status:  "200",
+			},
+		},
+		{
+			name:          "envoy json",
+			configuration: ConsumerConfiguration{Format: FormatEnvoyJSON},
+			line:          `{"start_time":"2020-03-06T13:13:12.449Z","method":"DELETE","path":"/items/1","response_code":204,"x_forwarded_for":"-","user_agent":"Go-http-client/1.1","request_id":"-","authority":"example.com","downstream_remote_address":"192.0.2.1:51234"}`,
+			want: &IngressEvent{
+				Host:   "example.com",
+				Method: "DELETE",
+				Path:   "/items/1",
+				Headers: map[string][]string{
+					"host":       {"example.com"},
+					"user-agent": {"Go-http-client/1.1"},
+				},
+				IP:        "192.0.2.1",
+				Time:      "2020-03-06T13:13:12.449Z",
+				Status:    "204",
+				UserAgent: "Go-http-client/1.1",
+			},
+		},
+		{
+			name:          "alb",
+			configuration: ConsumerConfiguration{Format: FormatALB},
+			line:          `https 2020-03-06T13:13:12.449000Z app/my-loadbalancer/50dc6c495c0c9188 192.0.2.1:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET https://example.com:443/index.html?lang=en HTTP/1.1" "curl/7.46.0" ECDHE-RSA-AES128-GCM-SHA256 TLSv1.2 arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "example.com" "arn:aws:acm:us-east-2:123456789012:certificate/12345678-1234-1234-1234-123456789012" 0 2020-03-06T13:13:12.448000Z "forward" "-" "-" "10.0.0.1:80" "200"`,
+			want: &IngressEvent{
+				Host:   "example.com",
+				Method: "GET",
+				Path:   "/index.html",
+				Headers: map[string][]string{
+					"host":            {"example.com"},
+					"user-agent":      {"curl/7.46.0"},
+					"x-amzn-trace-id": {"Root=1-58337262-36d228ad5d99923122bbe354"},
+				},
+				IP:        "192.0.2.1",
+				Time:      "2020-03-06T13:13:12.449Z",
+				Status:    "200",
+				UserAgent: "curl/7.46.0",
+			},
+		},
+		{
+			name:          "haproxy",
+			configuration: ConsumerConfiguration{Format: FormatHAProxy, HAProxyCapturedHeaders: []string{"host", "user-agent"}},
+			line:          `Mar  6 14:13:12 localhost haproxy[14389]: 192.0.2.1:33317 [06/Mar/2020:14:13:12.449] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {example.com|Wget/1.20} "GET /index.html HTTP/1.1"`,
+			want: &IngressEvent{
+				Host:   "example.com",
+				Method: "GET",
+				Path:   "/index.html",
+				Headers: map[string][]string{
+					"host":       {"example.com"},
+					"user-agent": {"Wget/1.20"},
+				},
+				IP:        "192.0.2.1",
+				Time:      haproxyTime,
+				Status:    "200",
+				UserAgent: "Wget/1.20",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parser, err := NewParser(test.configuration)
+			if err != nil {
+				t.Fatalf("NewParser() error = %v", err)
+			}
+
+			got, err := parser.Parse([]byte(test.line))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParsersRejectOtherFormats(t *testing.T) {
+	for _, format := range []string{FormatNginxCombined, FormatEnvoy, FormatALB, FormatHAProxy} {
+		parser, err := NewParser(ConsumerConfiguration{Format: format})
+		if err != nil {
+			t.Fatalf("NewParser(%s) error = %v", format, err)
+		}
+		if _, err := parser.Parse([]byte("not an access log line")); err == nil {
+			t.Errorf("%s: Parse() should fail on unknown lines", format)
+		}
+	}
+}
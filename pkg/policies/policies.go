@@ -1,9 +1,8 @@
 package policies
 
 import (
-	"bufio"
 	"encoding/json"
-	"os"
+	"io"
 	"time"
 
 	"github.com/cainelli/opa-firewall/pkg/firewall"
@@ -21,6 +20,7 @@ func New(policies []PolicyInterface, logger *logrus.Logger) *PolicyController {
 	policyController := &PolicyController{
 		Logger:             logger,
 		Policies:           policies,
+		Parser:             &IngressParser{},
 		Producer:           producer,
 		syncPolicyInterval: 15 * time.Second, // TODO: make it configurable and fix interval before production
 	}
@@ -32,38 +32,36 @@ func New(policies []PolicyInterface, logger *logrus.Logger) *PolicyController {
 	return policyController
 }
 
-// Run ...
-func (controller *PolicyController) Run() {
-	file, err := os.Open("./config/development/events.json")
-	if err != nil {
-		controller.Logger.Fatal(err)
-	}
-	defer file.Close()
+// Run reads the source until it is exhausted and sends the policy events for every ingress
+// event. An event is only committed after its policy events were sent. The event is evaluated
+// once, the sends failing are retried until they succeed so the policies don't process the same
+// event twice. The source is closed when Run returns.
+func (controller *PolicyController) Run(source EventSource) error {
+	defer source.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		event := &IngressEvent{}
-
-		err := json.Unmarshal(scanner.Bytes(), event)
+	for {
+		value, err := source.Read()
+		if err == io.EOF {
+			return nil
+		}
 		if err != nil {
-			controller.Logger.Warning("could not parse json", err)
-			continue
+			return err
 		}
 
-		policyEvents := controller.Evaluate(event)
-		if len(policyEvents) > 0 {
-			for _, policyEvent := range policyEvents {
+		for _, policyEvent := range controller.evaluateMessage(value) {
+			for {
 				err := controller.SendPolicyEvent(policyEvent)
-				if err != nil {
-					controller.Logger.Error(err)
-					continue
+				if err == nil {
+					break
 				}
+				controller.Logger.Errorf("%v (retrying in %s)", err, retryBackoff)
+				time.Sleep(retryBackoff)
 			}
 		}
-	}
 
-	if err := scanner.Err(); err != nil {
-		controller.Logger.Error(err)
+		if err := source.Commit(); err != nil {
+			controller.Logger.Error(err)
+		}
 	}
 }
 
@@ -115,18 +113,19 @@ func (controller *PolicyController) SendPolicyEvent(event firewall.PolicyEvent)
 	// TODO: cleanup logging
 	controller.Logger.Infof("sending event: %s", string(policyEventBytes))
 
-	controller.Producer.Produce(&kafka.Message{
+	// nothing is delivered when the message can't be enqueued, waiting would block forever.
+	err = controller.Producer.Produce(&kafka.Message{
 		TopicPartition: kafka.TopicPartition{Topic: &topicName},
 		Value:          policyEventBytes,
 	}, deliveryChan)
-
-	if err == nil {
-		event := <-deliveryChan
-		message := event.(*kafka.Message)
-		err = message.TopicPartition.Error
+	if err != nil {
+		return err
 	}
 
-	return err
+	delivery := <-deliveryChan
+	message := delivery.(*kafka.Message)
+
+	return message.TopicPartition.Error
 }
 
 func (controller *PolicyController) periodicallySyncPolicies() {
@@ -0,0 +1,180 @@
+package policies
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/sirupsen/logrus"
+)
+
+// recorder keeps the order in which the controller produces and commits.
+type recorder struct {
+	calls []string
+}
+
+func (recorder *recorder) record(call string) {
+	recorder.calls = append(recorder.calls, call)
+}
+
+// failingProducer fails the delivery of the policy events named in failures, as many times
+// as given.
+type failingProducer struct {
+	*recorder
+	failures map[string]int
+}
+
+func (producer *failingProducer) Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error {
+	var event firewall.PolicyEvent
+	if err := json.Unmarshal(msg.Value, &event); err != nil {
+		return err
+	}
+
+	var err error
+	if producer.failures[event.Name] > 0 {
+		producer.failures[event.Name]--
+		err = errors.New("delivery failed")
+		producer.record("failed:" + event.Name)
+	} else {
+		producer.record("produce:" + event.Name)
+	}
+
+	go func() {
+		deliveryChan <- &kafka.Message{TopicPartition: kafka.TopicPartition{Error: err}}
+	}()
+	return nil
+}
+
+// recordingSource records the commits of a ChannelSource.
+type recordingSource struct {
+	*ChannelSource
+	*recorder
+}
+
+func (source *recordingSource) Commit() error {
+	source.record("commit")
+	return source.ChannelSource.Commit()
+}
+
+// echoPolicy returns a policy event named after the policy and the event path.
+type echoPolicy struct {
+	name      string
+	processed int
+}
+
+func (policy *echoPolicy) IsRelevant(event *IngressEvent) (bool, error) {
+	return event.Path != "/ignored", nil
+}
+
+func (policy *echoPolicy) Process(event *IngressEvent) (firewall.PolicyEvent, error) {
+	policy.processed++
+	return firewall.PolicyEvent{Name: policy.name + event.Path}, nil
+}
+
+func (policy *echoPolicy) Get() (firewall.PolicyEvent, error) {
+	return firewall.PolicyEvent{}, nil
+}
+
+func (policy *echoPolicy) Name() string {
+	return policy.name
+}
+
+func newTestController(producer Producer, policies ...PolicyInterface) *PolicyController {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	return &PolicyController{
+		Logger:   logger,
+		Policies: policies,
+		Parser:   &IngressParser{},
+		Producer: producer,
+	}
+}
+
+func TestRun(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	tests := []struct {
+		name     string
+		policies []string
+		events   []string
+		failures map[string]int
+		want     []string
+		// wantProcessed is how many events each policy processed.
+		wantProcessed int
+	}{
+		{
+			name:     "commits after the policy events are sent",
+			policies: []string{"echo"},
+			events:   []string{`{"path":"/a"}`, `{"path":"/b"}`},
+			want: []string{
+				"produce:echo/a", "commit",
+				"produce:echo/b", "commit",
+			},
+			wantProcessed: 2,
+		},
+		{
+			name:     "retries the failed sends only",
+			policies: []string{"first", "second"},
+			events:   []string{`{"path":"/a"}`, `{"path":"/b"}`},
+			failures: map[string]int{"second/a": 2},
+			want: []string{
+				"produce:first/a", "failed:second/a", "failed:second/a", "produce:second/a", "commit",
+				"produce:first/b", "produce:second/b", "commit",
+			},
+			wantProcessed: 2,
+		},
+		{
+			name:     "commits events without policy events",
+			policies: []string{"echo"},
+			events:   []string{`{"path":"/ignored"}`, `not json`, `{"path":"/a"}`},
+			want: []string{
+				"commit",
+				"commit",
+				"produce:echo/a", "commit",
+			},
+			wantProcessed: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := &recorder{}
+			policies := make([]*echoPolicy, len(test.policies))
+			policyInterfaces := make([]PolicyInterface, len(test.policies))
+			for i, name := range test.policies {
+				policies[i] = &echoPolicy{name: name}
+				policyInterfaces[i] = policies[i]
+			}
+			controller := newTestController(&failingProducer{recorder: recorder, failures: test.failures}, policyInterfaces...)
+
+			events := make(chan []byte, len(test.events))
+			for _, event := range test.events {
+				events <- []byte(event)
+			}
+			close(events)
+
+			source := &recordingSource{ChannelSource: NewChannelSource(events), recorder: recorder}
+			if err := controller.Run(source); err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			if !reflect.DeepEqual(recorder.calls, test.want) {
+				t.Errorf("calls = %q, want %q", recorder.calls, test.want)
+			}
+
+			// the failed sends don't process the event again, rate limits and caches count it once.
+			for _, policy := range policies {
+				if policy.processed != test.wantProcessed {
+					t.Errorf("%s processed %d events, want %d", policy.name, policy.processed, test.wantProcessed)
+				}
+			}
+		})
+	}
+}
@@ -17,20 +17,28 @@ import (
 type PolicyController struct {
 	Logger             *logrus.Logger
 	Policies           []PolicyInterface
-	Producer           *kafka.Producer
+	Parser             Parser
+	Producer           Producer
 	syncPolicyInterval time.Duration
 }
 
+// Producer publishes the policy events, it is implemented by *kafka.Producer.
+type Producer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
+}
+
 // IngressEvent defines the event struct sent during the request cycle
 type IngressEvent struct {
-	Host        string              `json:"host,omitempty"`
-	Path        string              `json:"path,omitempty"`
-	Headers     map[string][]string `json:"headers,omitempty"`
-	IP          string              `json:"ip,omitempty"`
-	Time        string              `json:"time,omitempty"`
-	Status      string              `json:"status,omitempty"`
-	UserAgent   string              `json:"user-agent,omitempty"`
-	EncryptedIP string              `json:"encrypted-ip,omitempty"`
+	Host    string              `json:"host,omitempty"`
+	Method  string              `json:"method,omitempty"`
+	Path    string              `json:"path,omitempty"`
+	Headers map[string][]string `json:"headers,omitempty"`
+	IP      string              `json:"ip,omitempty"`
+	// Time is either a unix timestamp with milliseconds (1583503992.449) or RFC3339.
+	Time        string `json:"time,omitempty"`
+	Status      string `json:"status,omitempty"`
+	UserAgent   string `json:"user-agent,omitempty"`
+	EncryptedIP string `json:"encrypted-ip,omitempty"`
 }
 
 // PolicyInterface is the interface that rules needs to implement to be evaluated
@@ -60,9 +68,13 @@ type Policy struct {
 
 // ConvertEventTime takes an event time string and converts it to time.Time
 func (policy *Policy) ConvertEventTime(timeString string) (time.Time, error) {
+	if eventTime, err := time.Parse(time.RFC3339, timeString); err == nil {
+		return eventTime, nil
+	}
+
 	timeSplitted := strings.Split(timeString, ".")
 	if len(timeSplitted) != 2 {
-		return time.Time{}, fmt.Errorf("wrong time format:%s, expected something like 1583503992.449", timeString)
+		return time.Time{}, fmt.Errorf("wrong time format:%s, expected something like 1583503992.449 or RFC3339", timeString)
 	}
 
 	unixTimeStamp, err := strconv.ParseInt(timeSplitted[0], 10, 64)
@@ -81,11 +93,16 @@ func (policy *Policy) ConvertEventTime(timeString string) (time.Time, error) {
 
 }
 
-// GetIPBucketFromCache ...
+// GetIPBucketFromCache returns the unexpired entries of the cache. Items are expected to be
+// the firewall.IPEntry sent for the ip, anything else is sent with its expiration only.
 func (policy *Policy) GetIPBucketFromCache(cache *cache.Cache) firewall.IPBucket {
 	ipBucket := make(firewall.IPBucket)
 	for ip, item := range cache.Items() {
-		ipBucket[ip] = time.Unix(0, item.Expiration)
+		entry, ok := item.Object.(firewall.IPEntry)
+		if !ok {
+			entry = firewall.IPEntry{ExpireAt: time.Unix(0, item.Expiration)}
+		}
+		ipBucket[ip] = entry
 	}
 	return ipBucket
 }
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultBlockBodyTemplate = `<html><body><h1>Access denied</h1>{{if .RequestID}}<p>Request id: {{.RequestID}}</p>{{end}}</body></html>`
+
+// New initializes the reverse proxy
+func New(fw *firewall.Firewall, configuration *Configuration, logger *logrus.Logger) (*Proxy, error) {
+	blockTemplate, err := template.New("block").Parse(configuration.BlockBodyTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := &Proxy{
+		Configuration: configuration,
+		Firewall:      fw,
+		Logger:        logger,
+		ReverseProxy:  httputil.NewSingleHostReverseProxy(configuration.Upstream),
+		blockTemplate: blockTemplate,
+	}
+	proxy.ReverseProxy.ErrorHandler = proxy.upstreamError
+
+	return proxy, nil
+}
+
+// NewConfiguration reads the proxy configuration from the environment. PROXY_UPSTREAM is required.
+func NewConfiguration() (*Configuration, error) {
+	configuration := &Configuration{
+		BlockStatus:       http.StatusTooManyRequests,
+		BlockBodyTemplate: defaultBlockBodyTemplate,
+		BlockContentType:  "text/html; charset=utf-8",
+	}
+
+	upstream := os.Getenv("PROXY_UPSTREAM")
+	if upstream == "" {
+		return nil, fmt.Errorf("missing PROXY_UPSTREAM")
+	}
+	upstreamURL, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if upstreamURL.Scheme == "" || upstreamURL.Host == "" {
+		return nil, fmt.Errorf("PROXY_UPSTREAM must be an absolute url, got %s", upstream)
+	}
+	configuration.Upstream = upstreamURL
+
+	if blockStatus := os.Getenv("PROXY_BLOCK_STATUS"); blockStatus != "" {
+		code, err := strconv.Atoi(blockStatus)
+		if err != nil {
+			return nil, err
+		}
+		if code < 400 || code > 599 {
+			return nil, fmt.Errorf("PROXY_BLOCK_STATUS must be a 4xx or 5xx status, got %d", code)
+		}
+		configuration.BlockStatus = code
+	}
+
+	if blockBodyTemplate := os.Getenv("PROXY_BLOCK_BODY_TEMPLATE"); blockBodyTemplate != "" {
+		configuration.BlockBodyTemplate = blockBodyTemplate
+	}
+	if blockContentType := os.Getenv("PROXY_BLOCK_CONTENT_TYPE"); blockContentType != "" {
+		configuration.BlockContentType = blockContentType
+	}
+
+	if retryAfter := os.Getenv("PROXY_RETRY_AFTER"); retryAfter != "" {
+		seconds, err := strconv.Atoi(retryAfter)
+		if err != nil {
+			return nil, err
+		}
+		configuration.RetryAfter = seconds
+	}
+
+	return configuration, nil
+}
+
+// ServeHTTP forwards allowed requests to the upstream, with the header changes of the
+// decision, and executes the decision action for blocked ones.
+func (proxy *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	input := proxy.Firewall.RequestInput(request)
+	decision := proxy.Firewall.Decide(input)
+
+	if proxy.Firewall.Configuration.DecisionHeaders {
+		decision.SetHeaders(writer.Header())
+	}
+
+	if decision.Blocks() {
+		proxy.Firewall.BlockResponse(input, decision, proxy.blockResponse(request, decision)).Write(writer, request)
+		return
+	}
+
+	decision.RequestHeaders.Apply(request.Header)
+	proxy.ReverseProxy.ServeHTTP(writer, request)
+}
+
+// blockResponse renders the configured block response, used unless the decision action overrides it.
+func (proxy *Proxy) blockResponse(request *http.Request, decision firewall.Decision) firewall.Response {
+	response := firewall.Response{
+		Status: proxy.Configuration.BlockStatus,
+		Header: make(http.Header),
+	}
+	if proxy.Configuration.RetryAfter > 0 {
+		response.Header.Set("Retry-After", strconv.Itoa(proxy.Configuration.RetryAfter))
+	}
+	response.Header.Set("Content-Type", proxy.Configuration.BlockContentType)
+	response.Header.Set("Cache-Control", "no-store")
+
+	body := &bytes.Buffer{}
+	err := proxy.blockTemplate.Execute(body, BlockData{
+		Host:       request.Host,
+		Path:       request.URL.Path,
+		RequestID:  request.Header.Get("X-Request-Id"),
+		RetryAfter: proxy.Configuration.RetryAfter,
+		Decision:   decision,
+	})
+	if err != nil {
+		proxy.Logger.Error(err)
+	}
+	response.Body = body.Bytes()
+
+	return response
+}
+
+func (proxy *Proxy) upstreamError(writer http.ResponseWriter, request *http.Request, err error) {
+	proxy.Logger.Errorf("upstream %s: %v", proxy.Configuration.Upstream, err)
+	writer.WriteHeader(http.StatusBadGateway)
+}
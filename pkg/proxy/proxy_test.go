@@ -0,0 +1,259 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	"github.com/sirupsen/logrus"
+)
+
+// testPolicy denies 203.0.113.7, bodies logging in as mallory, and answers a few paths with
+// the other actions.
+const testPolicy = `package enforcer
+
+deny {
+  input.ip == "203.0.113.7"
+}
+
+deny {
+  input.body.username == "mallory"
+}
+
+deny {
+  startswith(input.path, "/action/")
+}
+
+action = {"type": "redirect", "location": "https://www.example.com/blocked"} {
+  input.path == "/action/moved"
+}
+
+action = {"type": "headers", "add": {"x-suspicious": "1"}, "remove": ["x-debug"]} {
+  input.path == "/action/tagged"
+}
+`
+
+// upstreamRequest is what the upstream received.
+type upstreamRequest struct {
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+func newTestProxy(t *testing.T, upstream *httptest.Server, blockBodyTemplate string) *Proxy {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+
+	fw := firewall.NewStatic(logger, &firewall.Configuration{
+		IsEnabled:          true,
+		DecisionHeaders:    true,
+		CombiningAlgorithm: firewall.CombiningAllowOverrides,
+		BodyInspection:     []firewall.BodyInspectionRule{{Host: "www.example.com", PathPrefix: "/login"}},
+		BodyMaxSize:        firewall.DefaultBodyMaxSize,
+	}, firewall.PolicyEvent{Name: "enforcer", Type: firewall.EventTypeFull, Rego: testPolicy})
+
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := New(fw, &Configuration{
+		Upstream:          upstreamURL,
+		BlockStatus:       http.StatusTooManyRequests,
+		BlockBodyTemplate: blockBodyTemplate,
+		BlockContentType:  "text/html; charset=utf-8",
+		RetryAfter:        30,
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// newUpstream records the requests it receives on received and answers them with 200 upstream.
+func newUpstream(received chan<- upstreamRequest) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		received <- upstreamRequest{Path: request.URL.Path, Header: request.Header, Body: string(body)}
+		writer.Header().Set("X-Upstream", "1")
+		_, _ = writer.Write([]byte("upstream"))
+	}))
+}
+
+func TestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name             string
+		remoteAddr       string
+		method           string
+		path             string
+		body             string
+		header           map[string]string
+		wantStatus       int
+		wantForwarded    bool
+		wantBody         string
+		wantHeaders      map[string]string
+		wantUpstreamBody string
+		wantUpstream     map[string]string
+	}{
+		{
+			name:          "allowed",
+			remoteAddr:    "198.51.100.1:41234",
+			method:        http.MethodGet,
+			path:          "/",
+			wantStatus:    http.StatusOK,
+			wantForwarded: true,
+			wantBody:      "upstream",
+			wantHeaders:   map[string]string{"X-Upstream": "1", firewall.HeaderDecision: firewall.DecisionAllow},
+			wantUpstream:  map[string]string{"X-Forwarded-For": "198.51.100.1"},
+		},
+		{
+			name:        "blocked",
+			remoteAddr:  "203.0.113.7:41234",
+			method:      http.MethodGet,
+			path:        "/",
+			header:      map[string]string{"X-Request-Id": "a1b2c3"},
+			wantStatus:  http.StatusTooManyRequests,
+			wantBody:    "<p>Request id: a1b2c3</p>",
+			wantHeaders: map[string]string{"Retry-After": "30", "Content-Type": "text/html; charset=utf-8", "Cache-Control": "no-store", firewall.HeaderDeniedBy: "enforcer"},
+		},
+		{
+			name:        "blocked request id is escaped",
+			remoteAddr:  "203.0.113.7:41234",
+			method:      http.MethodGet,
+			path:        "/",
+			header:      map[string]string{"X-Request-Id": "<script>alert(1)</script>"},
+			wantStatus:  http.StatusTooManyRequests,
+			wantBody:    "&lt;script&gt;alert(1)&lt;/script&gt;",
+			wantHeaders: map[string]string{"X-Upstream": ""},
+		},
+		{
+			name:        "redirect",
+			remoteAddr:  "198.51.100.1:41234",
+			method:      http.MethodGet,
+			path:        "/action/moved",
+			wantStatus:  http.StatusFound,
+			wantHeaders: map[string]string{"Location": "https://www.example.com/blocked", "Retry-After": ""},
+		},
+		{
+			name:          "headers action",
+			remoteAddr:    "198.51.100.1:41234",
+			method:        http.MethodGet,
+			path:          "/action/tagged",
+			header:        map[string]string{"X-Debug": "1", "X-Kept": "1"},
+			wantStatus:    http.StatusOK,
+			wantForwarded: true,
+			wantBody:      "upstream",
+			wantUpstream:  map[string]string{"X-Suspicious": "1", "X-Debug": "", "X-Kept": "1"},
+		},
+		{
+			name:             "inspected body is forwarded",
+			remoteAddr:       "198.51.100.1:41234",
+			method:           http.MethodPost,
+			path:             "/login",
+			body:             `{"username": "alice"}`,
+			header:           map[string]string{"Content-Type": "application/json"},
+			wantStatus:       http.StatusOK,
+			wantForwarded:    true,
+			wantBody:         "upstream",
+			wantUpstreamBody: `{"username": "alice"}`,
+		},
+		{
+			name:       "inspected body is blocked",
+			remoteAddr: "198.51.100.1:41234",
+			method:     http.MethodPost,
+			path:       "/login",
+			body:       `{"username": "mallory"}`,
+			header:     map[string]string{"Content-Type": "application/json"},
+			wantStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received := make(chan upstreamRequest, 1)
+			upstream := newUpstream(received)
+			defer upstream.Close()
+			proxy := newTestProxy(t, upstream, defaultBlockBodyTemplate)
+
+			request := httptest.NewRequest(test.method, "http://www.example.com"+test.path, strings.NewReader(test.body))
+			request.RemoteAddr = test.remoteAddr
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, request)
+
+			if recorder.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", recorder.Code, test.wantStatus)
+			}
+			if !strings.Contains(recorder.Body.String(), test.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", recorder.Body, test.wantBody)
+			}
+			for key, value := range test.wantHeaders {
+				if recorder.Header().Get(key) != value {
+					t.Errorf("header %s = %q, want %q", key, recorder.Header().Get(key), value)
+				}
+			}
+
+			select {
+			case forwarded := <-received:
+				if !test.wantForwarded {
+					t.Fatalf("%s was forwarded", forwarded.Path)
+				}
+				if forwarded.Path != test.path {
+					t.Errorf("upstream path = %s, want %s", forwarded.Path, test.path)
+				}
+				if forwarded.Body != test.wantUpstreamBody {
+					t.Errorf("upstream body = %q, want %q", forwarded.Body, test.wantUpstreamBody)
+				}
+				for key, value := range test.wantUpstream {
+					if forwarded.Header.Get(key) != value {
+						t.Errorf("upstream header %s = %q, want %q", key, forwarded.Header.Get(key), value)
+					}
+				}
+			default:
+				if test.wantForwarded {
+					t.Error("the request was not forwarded")
+				}
+			}
+		})
+	}
+}
+
+func TestServeHTTPUpstreamDown(t *testing.T) {
+	upstream := newUpstream(make(chan upstreamRequest, 1))
+	proxy := newTestProxy(t, upstream, defaultBlockBodyTemplate)
+	upstream.Close()
+
+	request := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	request.RemoteAddr = "198.51.100.1:41234"
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want %d", recorder.Code, http.StatusBadGateway)
+	}
+}
+
+func TestBlockBodyTemplate(t *testing.T) {
+	upstream := newUpstream(make(chan upstreamRequest, 1))
+	defer upstream.Close()
+	proxy := newTestProxy(t, upstream, `{{.Host}}{{.Path}} retry in {{.RetryAfter}}s, denied by {{index .Decision.DenyingPackages 0}}`)
+
+	request := httptest.NewRequest(http.MethodGet, "http://www.example.com/login", nil)
+	request.RemoteAddr = "203.0.113.7:41234"
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, request)
+
+	if want := "www.example.com/login retry in 30s, denied by enforcer"; recorder.Body.String() != want {
+		t.Errorf("body = %q, want %q", recorder.Body, want)
+	}
+
+	if _, err := New(proxy.Firewall, &Configuration{BlockBodyTemplate: "{{.Host"}, proxy.Logger); err == nil {
+		t.Error("New() accepted an invalid block body template")
+	}
+}
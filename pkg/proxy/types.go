@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/cainelli/opa-firewall/pkg/firewall"
+	"github.com/sirupsen/logrus"
+)
+
+// Proxy forwards the requests allowed by the firewall to the upstream and answers the denied
+// ones with the configured block response.
+type Proxy struct {
+	Configuration *Configuration
+	Firewall      *firewall.Firewall
+	Logger        *logrus.Logger
+	ReverseProxy  *httputil.ReverseProxy
+	blockTemplate *template.Template
+}
+
+// Configuration defines the upstream and the block response.
+type Configuration struct {
+	// Upstream is the base url requests are forwarded to.
+	Upstream *url.URL
+	// BlockStatus is the http status of the block response.
+	BlockStatus int
+	// BlockBodyTemplate is a html/template rendered with BlockData as the block response body.
+	BlockBodyTemplate string
+	// BlockContentType is the content type of the block response.
+	BlockContentType string
+	// RetryAfter is the Retry-After header value in seconds, not sent when zero.
+	RetryAfter int
+}
+
+// BlockData is available to the block body template.
+type BlockData struct {
+	Host       string
+	Path       string
+	RequestID  string
+	RetryAfter int
+	Decision   firewall.Decision
+}
@@ -0,0 +1,76 @@
+package stream
+
+import (
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// BatchProducer produces fire-and-forget messages to a single topic. Messages are batched
+// by librdkafka before being sent and delivery failures are reported to OnError.
+type BatchProducer struct {
+	Producer *kafka.Producer
+	Topic    string
+	OnError  func(error)
+}
+
+// NewBatchProducer creates a producer lingering up to lingerMs milliseconds to batch messages.
+func NewBatchProducer(topic string, lingerMs int, onError func(error)) (*BatchProducer, error) {
+	configuration, err := autoDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	librdConfig, err := NewLibrdConfigMap(configuration)
+	if err != nil {
+		return nil, err
+	}
+	librdConfig.SetKey("linger.ms", lingerMs)
+	// acks from the leader are enough for events, losing a few is acceptable.
+	librdConfig.SetKey("request.required.acks", 1)
+
+	producer, err := kafka.NewProducer(librdConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	batchProducer := &BatchProducer{
+		Producer: producer,
+		Topic:    topic,
+		OnError:  onError,
+	}
+
+	go batchProducer.deliveryReports()
+
+	return batchProducer, nil
+}
+
+// Produce enqueues the message without waiting for its delivery. It returns an error when
+// the message could not be enqueued, e.g. the local queue is full.
+func (batchProducer *BatchProducer) Produce(key, value []byte) error {
+	return batchProducer.Producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &batchProducer.Topic, Partition: kafka.PartitionAny},
+		Key:            key,
+		Value:          value,
+	}, nil)
+}
+
+// Close flushes pending messages for up to timeoutMs milliseconds and closes the producer.
+func (batchProducer *BatchProducer) Close(timeoutMs int) {
+	batchProducer.Producer.Flush(timeoutMs)
+	batchProducer.Producer.Close()
+}
+
+// deliveryReports drains the producer events so librdkafka never blocks on them.
+func (batchProducer *BatchProducer) deliveryReports() {
+	for event := range batchProducer.Producer.Events() {
+		switch ev := event.(type) {
+		case *kafka.Message:
+			if ev.TopicPartition.Error != nil && batchProducer.OnError != nil {
+				batchProducer.OnError(ev.TopicPartition.Error)
+			}
+		case kafka.Error:
+			if batchProducer.OnError != nil {
+				batchProducer.OnError(ev)
+			}
+		}
+	}
+}
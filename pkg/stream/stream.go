@@ -42,6 +42,29 @@ func NewConsumer() (*kafka.Consumer, error) {
 	return kafka.NewConsumer(librdConfig)
 }
 
+// NewGroupConsumer creates a consumer joining the given consumer group. Offsets are committed
+// periodically but only after being stored with StoreOffsets, so callers decide when a message
+// is processed. A group.id set through LIBRD__GROUP_ID takes precedence over groupID.
+func NewGroupConsumer(groupID string) (*kafka.Consumer, error) {
+	configuration, err := autoDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	librdConfig, err := NewLibrdConfigMap(configuration)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, _ := librdConfig.Get("group.id", ""); value == "" {
+		librdConfig.SetKey("group.id", groupID)
+	}
+	librdConfig.SetKey("enable.auto.commit", true)
+	librdConfig.SetKey("enable.auto.offset.store", false)
+
+	return kafka.NewConsumer(librdConfig)
+}
+
 func environmentOrDefault(environmentName string, defaulValue string) string {
 	if os.Getenv(environmentName) != "" {
 		return os.Getenv(environmentName)